@@ -45,6 +45,7 @@ const (
 	AlertBadCertificateStatsResponse Alert = 113
 	AlertBadCertificateHashValue     Alert = 114
 	AlertUnknownPSKIdentity          Alert = 115
+	AlertCertificateRequired         Alert = 116
 	AlertNoApplicationProtocol       Alert = 120
 	AlertWouldBlock                  Alert = 254
 	AlertNoAlert                     Alert = 255
@@ -80,6 +81,7 @@ var alertText = map[Alert]string{
 	AlertBadCertificateStatsResponse: "bad certificate status response",
 	AlertBadCertificateHashValue:     "bad certificate hash value",
 	AlertUnknownPSKIdentity:          "unknown PSK identity",
+	AlertCertificateRequired:         "certificate required",
 	AlertNoApplicationProtocol:       "no application protocol",
 	AlertNoRenegotiation:             "no renegotiation",
 	AlertWouldBlock:                  "would have blocked",
@@ -97,3 +99,24 @@ func (e Alert) String() string {
 func (e Alert) Error() string {
 	return e.String()
 }
+
+// AlertError is the error returned when a connection fails because of a TLS
+// alert.  Remote is true if the alert was received from the peer, and false
+// if it was sent to the peer.
+type AlertError struct {
+	Alert  Alert
+	Remote bool
+}
+
+func (e AlertError) Error() string {
+	if e.Remote {
+		return "tls.alert: Remote error: " + e.Alert.String()
+	}
+	return "tls.alert: Local error: " + e.Alert.String()
+}
+
+// Unwrap returns the alert, so that errors.Is can compare an AlertError with
+// an Alert
+func (e AlertError) Unwrap() error {
+	return e.Alert
+}
@@ -1,6 +1,7 @@
 package mint
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -9,3 +10,16 @@ func TestAlert(t *testing.T) {
 	assertEquals(t, AlertCloseNotify.Error(), "close notify")
 	assertEquals(t, Alert(0xfd).String(), "alert(253)")
 }
+
+func TestAlertError(t *testing.T) {
+	var err error = AlertError{Alert: AlertBadCertificate}
+	assertEquals(t, err.Error(), "tls.alert: Local error: bad certificate")
+	assert(t, errors.Is(err, AlertBadCertificate), "AlertError does not unwrap to its alert")
+
+	err = AlertError{Alert: AlertUnknownCA, Remote: true}
+	assertEquals(t, err.Error(), "tls.alert: Remote error: unknown certificate authority")
+
+	var alertErr AlertError
+	assert(t, errors.As(err, &alertErr), "Failed to find AlertError")
+	assert(t, alertErr.Remote, "Remote flag was lost")
+}
@@ -0,0 +1,247 @@
+package mint
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// AntiReplay decides whether a server accepts the early data in a
+// ClientHello, as in RFC 8446, Section 8.  A ClientHello with early data is
+// passed to AcceptEarlyData once its PSK has been verified, along with the
+// binder for that PSK, which is unique to the ClientHello, and the ticket
+// age the client reported (zero for external PSKs).  If it returns false, the
+// early data is skipped and the handshake carries on without it.
+type AntiReplay interface {
+	AcceptEarlyData(psk *PreSharedKey, binder []byte, ticketAge time.Duration) bool
+}
+
+// ticketAgeTolerance is how far the ticket age reported by a client can be
+// from the age known to the server before early data is rejected by
+// FreshTickets
+const ticketAgeTolerance = 5 * time.Second
+
+// FreshTickets only checks that early data is fresh, as in RFC 8446, Section
+// 8.3: the ticket age reported by the client must be within five seconds of
+// the time since the ticket was issued.  This limits when a ClientHello can be
+// replayed, but not how often.  Early data with external PSKs, which have no
+// ticket age, is always accepted.  This is what servers do if no AntiReplay
+// is configured.
+type FreshTickets struct{}
+
+func (FreshTickets) AcceptEarlyData(psk *PreSharedKey, binder []byte, ticketAge time.Duration) bool {
+	if !psk.IsResumption {
+		return true
+	}
+
+	knownTicketAge := time.Since(psk.ReceivedAt)
+	ticketAgeDelta := knownTicketAge - ticketAge
+	if ticketAgeDelta < 0 {
+		ticketAgeDelta = -ticketAgeDelta
+	}
+	if ticketAgeDelta > ticketAgeTolerance {
+		logf(logTypeNegotiation, "Rejecting early data with ticket age out of tolerance |%v - %v| > [%v]",
+			knownTicketAge, ticketAge, ticketAgeTolerance)
+		return false
+	}
+	return true
+}
+
+// usedTicket is an entry in the expiry heap of SingleUseTickets
+type usedTicket struct {
+	id        string
+	expiresAt time.Time
+}
+
+// usedTicketHeap orders used tickets by expiry time, soonest first
+type usedTicketHeap []usedTicket
+
+func (h usedTicketHeap) Len() int            { return len(h) }
+func (h usedTicketHeap) Less(i, j int) bool  { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h usedTicketHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *usedTicketHeap) Push(x interface{}) { *h = append(*h, x.(usedTicket)) }
+
+func (h *usedTicketHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// SingleUseTickets allows early data to be sent with each PSK only once, as
+// in RFC 8446, Section 8.1.  PSK identities are remembered until the PSKs
+// expire, so this is best suited to servers that issue their own tickets.
+type SingleUseTickets struct {
+	mutex    sync.Mutex
+	used     map[string]bool
+	expiries usedTicketHeap
+	now      func() time.Time
+}
+
+func NewSingleUseTickets() *SingleUseTickets {
+	return &SingleUseTickets{
+		used: map[string]bool{},
+		now:  time.Now,
+	}
+}
+
+func (s *SingleUseTickets) AcceptEarlyData(psk *PreSharedKey, binder []byte, ticketAge time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Forget about PSKs that have expired, since they cannot be used again.
+	// External PSKs have no expiry time, so they are never put in the heap
+	// and are remembered forever.
+	now := s.now()
+	for len(s.expiries) > 0 && now.After(s.expiries[0].expiresAt) {
+		expired := heap.Pop(&s.expiries).(usedTicket)
+		delete(s.used, expired.id)
+	}
+
+	id := hex.EncodeToString(psk.Identity)
+	if s.used[id] {
+		logf(logTypeNegotiation, "Rejecting early data for used PSK [%x]", psk.Identity)
+		return false
+	}
+
+	s.used[id] = true
+	if !psk.ExpiresAt.IsZero() {
+		heap.Push(&s.expiries, usedTicket{id: id, expiresAt: psk.ExpiresAt})
+	}
+	return true
+}
+
+const (
+	bloomBitsPerEntry = 16
+	bloomHashes       = 8
+)
+
+// bloomFilter is a fixed-size set of byte strings, which can report false
+// positives but never false negatives
+type bloomFilter []uint64
+
+func newBloomFilter(capacity int) bloomFilter {
+	return make(bloomFilter, (capacity*bloomBitsPerEntry+63)/64)
+}
+
+// indices returns the bits that represent a value, using double hashing
+func (f bloomFilter) indices(value []byte) []uint64 {
+	h := sha256.Sum256(value)
+	h1 := binary.BigEndian.Uint64(h[0:8])
+	h2 := binary.BigEndian.Uint64(h[8:16])
+	bits := uint64(len(f)) * 64
+
+	indices := make([]uint64, bloomHashes)
+	for i := range indices {
+		indices[i] = (h1 + uint64(i)*h2) % bits
+	}
+	return indices
+}
+
+func (f bloomFilter) contains(value []byte) bool {
+	for _, i := range f.indices(value) {
+		if f[i/64]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f bloomFilter) add(value []byte) {
+	for _, i := range f.indices(value) {
+		f[i/64] |= 1 << (i % 64)
+	}
+}
+
+// ClientHelloRecorder rejects replayed early data by recording the binders of
+// the ClientHellos it accepts, as in RFC 8446, Section 8.2.  Binders are kept
+// in Bloom filters that are rotated every window, so memory use is fixed no
+// matter how many connections are made; a false positive only means that
+// some early data is rejected.
+//
+// A recording is only good for as long as it is kept, so early data is also
+// required to be fresh, as in RFC 8446, Section 8.3: the time at which the
+// ClientHello was expected to arrive, according to the ticket age, must be
+// within half a window of the present.  External PSKs have no ticket age, so
+// early data with them is always rejected.
+//
+// A ClientHelloRecorder must be created with NewClientHelloRecorder.
+type ClientHelloRecorder struct {
+	mutex        sync.Mutex
+	window       time.Duration
+	capacity     int
+	current      bloomFilter
+	previous     bloomFilter
+	currentStart time.Time
+	now          func() time.Time
+}
+
+// NewClientHelloRecorder returns a recorder whose filters are sized for about
+// capacity ClientHellos per window, and at least one.
+func NewClientHelloRecorder(window time.Duration, capacity int) *ClientHelloRecorder {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	r := &ClientHelloRecorder{
+		window:   window,
+		capacity: capacity,
+		now:      time.Now,
+	}
+	r.current = newBloomFilter(capacity)
+	r.previous = newBloomFilter(capacity)
+	r.currentStart = r.now()
+	return r
+}
+
+// rotate starts a new filter once a window has passed.  Binders stay in the
+// previous filter for a further window, so every binder is remembered for at
+// least one window after it was recorded.
+func (r *ClientHelloRecorder) rotate(now time.Time) {
+	elapsed := now.Sub(r.currentStart)
+	if elapsed < r.window {
+		return
+	}
+
+	if elapsed < 2*r.window {
+		r.previous = r.current
+	} else {
+		r.previous = newBloomFilter(r.capacity)
+	}
+	r.current = newBloomFilter(r.capacity)
+	r.currentStart = now
+}
+
+func (r *ClientHelloRecorder) AcceptEarlyData(psk *PreSharedKey, binder []byte, ticketAge time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	r.rotate(now)
+
+	if !psk.IsResumption {
+		logf(logTypeNegotiation, "Rejecting early data with external PSK [%x]", psk.Identity)
+		return false
+	}
+
+	expectedArrival := psk.ReceivedAt.Add(ticketAge)
+	skew := now.Sub(expectedArrival)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > r.window/2 {
+		logf(logTypeNegotiation, "Rejecting early data outside the window [%v] > [%v]", skew, r.window/2)
+		return false
+	}
+
+	if r.current.contains(binder) || r.previous.contains(binder) {
+		logf(logTypeNegotiation, "Rejecting early data from recorded ClientHello [%x]", binder)
+		return false
+	}
+
+	r.current.add(binder)
+	return true
+}
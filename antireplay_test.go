@@ -0,0 +1,147 @@
+package mint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSingleUseTickets(t *testing.T) {
+	now := time.Now()
+	tickets := NewSingleUseTickets()
+	tickets.now = func() time.Time { return now }
+
+	ticket := &PreSharedKey{
+		IsResumption: true,
+		Identity:     []byte{0, 1, 2, 3},
+		ExpiresAt:    now.Add(time.Minute),
+	}
+	external := &PreSharedKey{Identity: []byte{4, 5, 6, 7}}
+	binder := []byte{8, 9, 10, 11}
+
+	// Test that each PSK can be used once
+	assert(t, tickets.AcceptEarlyData(ticket, binder, 0), "Rejected first use of ticket")
+	assert(t, !tickets.AcceptEarlyData(ticket, binder, 0), "Accepted second use of ticket")
+	assert(t, tickets.AcceptEarlyData(external, binder, 0), "Rejected first use of external PSK")
+	assert(t, !tickets.AcceptEarlyData(external, binder, 0), "Accepted second use of external PSK")
+
+	// Test that expired tickets are forgotten, but external PSKs are not
+	now = now.Add(2 * time.Minute)
+	assert(t, !tickets.AcceptEarlyData(external, binder, 0), "Accepted reuse of external PSK")
+	assertEquals(t, len(tickets.used), 1)
+	assertEquals(t, len(tickets.expiries), 0)
+}
+
+func TestFreshTickets(t *testing.T) {
+	ticket := &PreSharedKey{
+		IsResumption: true,
+		Identity:     []byte{0, 1, 2, 3},
+		ReceivedAt:   time.Now().Add(-time.Minute),
+	}
+	external := &PreSharedKey{Identity: []byte{4, 5, 6, 7}}
+	binder := []byte{8, 9, 10, 11}
+
+	// Test that early data is accepted, as often as it is sent, as long as
+	// the ticket age is about right
+	fresh := FreshTickets{}
+	assert(t, fresh.AcceptEarlyData(ticket, binder, time.Minute), "Rejected fresh ClientHello")
+	assert(t, fresh.AcceptEarlyData(ticket, binder, time.Minute), "Rejected fresh ClientHello")
+	assert(t, fresh.AcceptEarlyData(external, binder, 0), "Rejected early data with an external PSK")
+
+	// Test that early data is rejected if the ticket age is wrong
+	assert(t, !fresh.AcceptEarlyData(ticket, binder, 0), "Accepted early ClientHello")
+	assert(t, !fresh.AcceptEarlyData(ticket, binder, 2*time.Minute), "Accepted late ClientHello")
+}
+
+func TestClientHelloRecorder(t *testing.T) {
+	window := 10 * time.Second
+	now := time.Now()
+	recorder := NewClientHelloRecorder(window, 100)
+	recorder.now = func() time.Time { return now }
+
+	issuedAt := now.Add(-time.Minute)
+	ticket := &PreSharedKey{
+		IsResumption: true,
+		Identity:     []byte{0, 1, 2, 3},
+		ReceivedAt:   issuedAt,
+	}
+	binder1 := []byte{8, 9, 10, 11}
+	binder2 := []byte{12, 13, 14, 15}
+
+	// Test that each ClientHello is accepted once
+	assert(t, recorder.AcceptEarlyData(ticket, binder1, time.Minute), "Rejected first ClientHello")
+	assert(t, !recorder.AcceptEarlyData(ticket, binder1, time.Minute), "Accepted replayed ClientHello")
+	assert(t, recorder.AcceptEarlyData(ticket, binder2, time.Minute), "Rejected second ClientHello")
+
+	// Test that recordings survive one rotation
+	now = now.Add(window)
+	assert(t, !recorder.AcceptEarlyData(ticket, binder1, now.Sub(issuedAt)), "Accepted replay after rotation")
+
+	// Test that ClientHellos outside the window are rejected
+	assert(t, !recorder.AcceptEarlyData(ticket, []byte{1}, now.Sub(issuedAt)-window), "Accepted stale ClientHello")
+	assert(t, !recorder.AcceptEarlyData(ticket, []byte{2}, now.Sub(issuedAt)+window), "Accepted early ClientHello")
+
+	// Test that early data is not accepted with external PSKs
+	external := &PreSharedKey{Identity: []byte{4, 5, 6, 7}}
+	assert(t, !recorder.AcceptEarlyData(external, []byte{3}, 0), "Accepted early data with an external PSK")
+
+	// Test that recordings are forgotten after two windows
+	now = now.Add(2 * window)
+	assert(t, recorder.AcceptEarlyData(ticket, binder1, now.Sub(issuedAt)), "Rejected ClientHello after two windows")
+
+	// Test that a recorder without capacity still works
+	recorder = NewClientHelloRecorder(window, 0)
+	ticket.ReceivedAt = time.Now()
+	assert(t, recorder.AcceptEarlyData(ticket, binder1, 0), "Rejected first ClientHello")
+	assert(t, !recorder.AcceptEarlyData(ticket, binder1, 0), "Accepted replayed ClientHello")
+}
+
+func TestEarlyDataReplay(t *testing.T) {
+	earlyData := []byte("hello 0xRTT world!")
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
+	}
+	serverConfig := &Config{
+		ServerName:     serverName,
+		CipherSuites:   []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:           psks,
+		AllowEarlyData: true,
+		AntiReplay:     NewSingleUseTickets(),
+	}
+
+	// The first server accepts the early data
+	client := NewEngine(clientConfig, true)
+	client.EarlyData = earlyData
+	assertEquals(t, client.Handshake(), WouldBlock)
+	firstFlight := client.Output()
+
+	server := NewEngine(serverConfig, false)
+	server.Input(firstFlight)
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, server.State().UsingEarlyData, "Server did not accept early data")
+	assertByteEquals(t, server.EarlyData, earlyData)
+
+	// A replay of the same flight is not accepted
+	replayServer := NewEngine(serverConfig, false)
+	replayServer.Input(firstFlight)
+	assertEquals(t, replayServer.Handshake(), WouldBlock)
+	_, waitingForEOED := replayServer.hState.(ServerStateWaitEOED)
+	assert(t, !waitingForEOED, "Server accepted replayed early data")
+	assertEquals(t, len(replayServer.EarlyData), 0)
+
+	// A new connection falls back to 1-RTT
+	client = NewEngine(clientConfig, true)
+	client.EarlyData = earlyData
+	server = NewEngine(serverConfig, false)
+	clientErr, serverErr = runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, !client.State().UsingEarlyData, "Client reported early data")
+	assert(t, !server.State().UsingEarlyData, "Server accepted early data")
+	assertEquals(t, len(server.EarlyData), 0)
+	assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
+}
@@ -15,9 +15,10 @@ var url string
 
 func main() {
 	url := flag.String("url", "https://localhost:4430", "URL to send request")
+	insecure := flag.Bool("insecure", false, "skip verification of the server certificate")
 	flag.Parse()
 	mintdial := func(network, addr string) (net.Conn, error) {
-		return mint.Dial(network, addr, nil)
+		return mint.Dial(network, addr, &mint.Config{InsecureSkipVerify: *insecure})
 	}
 
 	tr := &http.Transport{
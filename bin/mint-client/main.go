@@ -3,17 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 
 	"github.com/bifurcation/mint"
 )
 
 var addr string
+var insecure bool
 
 func main() {
 	flag.StringVar(&addr, "addr", "localhost:4430", "port")
+	flag.BoolVar(&insecure, "insecure", false, "skip verification of the server certificate")
 	flag.Parse()
 
-	conn, err := mint.Dial("tcp", addr, nil)
+	config := &mint.Config{InsecureSkipVerify: insecure}
+	conn, err := mint.Dial("tcp", addr, config)
 
 	if err != nil {
 		fmt.Println("TLS handshake failed:", err)
@@ -29,9 +33,14 @@ func main() {
 	for err == nil {
 		read, err = conn.Read(buffer)
 		fmt.Println(" ~~ read: ", read)
-		response += string(buffer)
+		response += string(buffer[:read])
+	}
+
+	// An HTTP/1.0 response is delimited by the end of the connection, so it is
+	// only complete if the server sent close_notify.
+	if err != io.EOF {
+		fmt.Println("Response truncated:", err)
 	}
-	fmt.Println("err:", err)
 	fmt.Println("Received from server:")
 	fmt.Println(response)
 }
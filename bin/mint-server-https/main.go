@@ -202,8 +202,8 @@ func main() {
 		}
 
 		if !h2 {
-			alert := srv.Serve(listener)
-			if alert != mint.AlertNoAlert {
+			err := srv.Serve(listener)
+			if err != nil {
 				log.Printf("Serve Error: %v", err)
 			}
 		} else {
@@ -0,0 +1,210 @@
+package mint
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// This file implements the CCM mode of operation (RFC 3610, NIST SP 800-38C)
+// as a cipher.AEAD, since the standard library only provides GCM.  TLS uses it
+// with a 12-byte nonce and either a 16-byte or an 8-byte tag (RFC 6655).
+
+const ccmBlockSize = 16
+
+type ccm struct {
+	block     cipher.Block
+	nonceSize int
+	tagSize   int
+}
+
+// newCCM returns a CCM AEAD using the given block cipher, which must have a
+// 16-byte block size.  The nonce size must be between 7 and 13 octets, and
+// the tag size must be an even number between 4 and 16 octets.
+func newCCM(block cipher.Block, nonceSize, tagSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != ccmBlockSize {
+		return nil, fmt.Errorf("tls.ccm: Block size must be %d", ccmBlockSize)
+	}
+
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, fmt.Errorf("tls.ccm: Invalid nonce size %d", nonceSize)
+	}
+
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, fmt.Errorf("tls.ccm: Invalid tag size %d", tagSize)
+	}
+
+	return &ccm{block: block, nonceSize: nonceSize, tagSize: tagSize}, nil
+}
+
+func (c *ccm) NonceSize() int {
+	return c.nonceSize
+}
+
+func (c *ccm) Overhead() int {
+	return c.tagSize
+}
+
+// lengthSize is the size of the message length field, L in RFC 3610
+func (c *ccm) lengthSize() int {
+	return 15 - c.nonceSize
+}
+
+func (c *ccm) maxLength() uint64 {
+	L := c.lengthSize()
+	if L >= 8 {
+		return ^uint64(0)
+	}
+	return (uint64(1) << uint(8*L)) - 1
+}
+
+// counterBlock returns the counter block A_i with the counter set to zero
+func (c *ccm) counterBlock(nonce []byte) []byte {
+	A := make([]byte, ccmBlockSize)
+	A[0] = byte(c.lengthSize() - 1)
+	copy(A[1:], nonce)
+	return A
+}
+
+// tag computes the unencrypted CBC-MAC over the additional data and plaintext
+func (c *ccm) tag(nonce, plaintext, data []byte) []byte {
+	L := c.lengthSize()
+
+	// B_0 = flags || nonce || message length
+	B := make([]byte, ccmBlockSize)
+	B[0] = byte(((c.tagSize - 2) / 2) << 3)
+	B[0] |= byte(L - 1)
+	if len(data) > 0 {
+		B[0] |= 0x40
+	}
+	copy(B[1:], nonce)
+
+	msgLen := uint64(len(plaintext))
+	for i := ccmBlockSize - 1; i > c.nonceSize; i-- {
+		B[i] = byte(msgLen)
+		msgLen >>= 8
+	}
+
+	X := make([]byte, ccmBlockSize)
+	c.block.Encrypt(X, B)
+
+	mac := func(in []byte) {
+		for len(in) > 0 {
+			n := len(in)
+			if n > ccmBlockSize {
+				n = ccmBlockSize
+			}
+
+			// Short blocks are implicitly zero-padded
+			for i := 0; i < n; i++ {
+				X[i] ^= in[i]
+			}
+			c.block.Encrypt(X, X)
+			in = in[n:]
+		}
+	}
+
+	if len(data) > 0 {
+		// The additional data is prefixed with an encoding of its length, and
+		// the result is padded out to a block boundary
+		var header []byte
+		dataLen := uint64(len(data))
+		switch {
+		case dataLen < 0xFF00:
+			header = make([]byte, 2)
+			binary.BigEndian.PutUint16(header, uint16(dataLen))
+		case dataLen <= 0xFFFFFFFF:
+			header = make([]byte, 6)
+			header[0], header[1] = 0xFF, 0xFE
+			binary.BigEndian.PutUint32(header[2:], uint32(dataLen))
+		default:
+			header = make([]byte, 10)
+			header[0], header[1] = 0xFF, 0xFF
+			binary.BigEndian.PutUint64(header[2:], dataLen)
+		}
+
+		padded := make([]byte, len(header)+len(data))
+		copy(padded, header)
+		copy(padded[len(header):], data)
+		mac(padded)
+	}
+
+	mac(plaintext)
+	return X[:c.tagSize]
+}
+
+// crypt applies the CTR keystream starting at counter value 1, and returns
+// the encryption of the counter block A_0 for use on the tag
+func (c *ccm) crypt(nonce, dst, src []byte) []byte {
+	A := c.counterBlock(nonce)
+
+	S0 := make([]byte, ccmBlockSize)
+	c.block.Encrypt(S0, A)
+
+	A[ccmBlockSize-1] = 1
+	cipher.NewCTR(c.block, A).XORKeyStream(dst, src)
+	return S0
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// newly added tail.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, data []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("tls.ccm: Incorrect nonce length given to CCM")
+	}
+	if uint64(len(plaintext)) > c.maxLength() {
+		panic("tls.ccm: Plaintext too large for CCM")
+	}
+
+	T := c.tag(nonce, plaintext, data)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+c.tagSize)
+	S0 := c.crypt(nonce, out[:len(plaintext)], plaintext)
+
+	for i := 0; i < c.tagSize; i++ {
+		out[len(plaintext)+i] = T[i] ^ S0[i]
+	}
+	return ret
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("tls.ccm: Incorrect nonce length given to CCM")
+	}
+	if len(ciphertext) < c.tagSize {
+		return nil, fmt.Errorf("tls.ccm: Ciphertext too short")
+	}
+	if uint64(len(ciphertext)-c.tagSize) > c.maxLength() {
+		return nil, fmt.Errorf("tls.ccm: Ciphertext too large")
+	}
+
+	tagStart := len(ciphertext) - c.tagSize
+	ret, out := sliceForAppend(dst, tagStart)
+	S0 := c.crypt(nonce, out, ciphertext[:tagStart])
+
+	T := c.tag(nonce, out, data)
+	for i := 0; i < c.tagSize; i++ {
+		T[i] ^= S0[i]
+	}
+
+	if subtle.ConstantTimeCompare(T, ciphertext[tagStart:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, fmt.Errorf("tls.ccm: Message authentication failed")
+	}
+
+	return ret, nil
+}
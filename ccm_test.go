@@ -0,0 +1,117 @@
+package mint
+
+import (
+	"crypto/aes"
+	"testing"
+)
+
+// Test vectors from RFC 3610 and NIST SP 800-38C, Appendix C
+var ccmTestVectors = []struct {
+	key, nonce, data, plaintext, ciphertext string
+	tagSize                                 int
+}{
+	// RFC 3610, Packet Vector #1
+	{
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000003020100a0a1a2a3a4a5",
+		data:       "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+		ciphertext: "588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0",
+		tagSize:    8,
+	},
+	// SP 800-38C, Example 1
+	{
+		key:        "404142434445464748494a4b4c4d4e4f",
+		nonce:      "10111213141516",
+		data:       "0001020304050607",
+		plaintext:  "20212223",
+		ciphertext: "7162015b4dac255d",
+		tagSize:    4,
+	},
+	// SP 800-38C, Example 2
+	{
+		key:        "404142434445464748494a4b4c4d4e4f",
+		nonce:      "1011121314151617",
+		data:       "000102030405060708090a0b0c0d0e0f",
+		plaintext:  "202122232425262728292a2b2c2d2e2f",
+		ciphertext: "d2a1f0e051ea5f62081a7792073d593d1fc64fbfaccd",
+		tagSize:    6,
+	},
+	// SP 800-38C, Example 3
+	{
+		key:        "404142434445464748494a4b4c4d4e4f",
+		nonce:      "101112131415161718191a1b",
+		data:       "000102030405060708090a0b0c0d0e0f10111213",
+		plaintext:  "202122232425262728292a2b2c2d2e2f3031323334353637",
+		ciphertext: "e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5484392fbc1b09951",
+		tagSize:    8,
+	},
+}
+
+func TestCCMVectors(t *testing.T) {
+	for _, tv := range ccmTestVectors {
+		block, err := aes.NewCipher(unhex(tv.key))
+		assertNotError(t, err, "Failed to create AES cipher")
+
+		nonce := unhex(tv.nonce)
+		aead, err := newCCM(block, len(nonce), tv.tagSize)
+		assertNotError(t, err, "Failed to create CCM")
+		assertEquals(t, aead.NonceSize(), len(nonce))
+		assertEquals(t, aead.Overhead(), tv.tagSize)
+
+		data := unhex(tv.data)
+		plaintext := unhex(tv.plaintext)
+		ciphertext := unhex(tv.ciphertext)
+
+		ct := aead.Seal(nil, nonce, plaintext, data)
+		assertByteEquals(t, ct, ciphertext)
+
+		pt, err := aead.Open(nil, nonce, ciphertext, data)
+		assertNotError(t, err, "Failed to open valid ciphertext")
+		assertByteEquals(t, pt, plaintext)
+
+		// Any modification to the ciphertext, tag, or data causes failure
+		ciphertext[0] ^= 0x01
+		_, err = aead.Open(nil, nonce, ciphertext, data)
+		assertError(t, err, "Opened modified ciphertext")
+		ciphertext[0] ^= 0x01
+
+		ciphertext[len(ciphertext)-1] ^= 0x01
+		_, err = aead.Open(nil, nonce, ciphertext, data)
+		assertError(t, err, "Opened modified tag")
+		ciphertext[len(ciphertext)-1] ^= 0x01
+
+		data[0] ^= 0x01
+		_, err = aead.Open(nil, nonce, ciphertext, data)
+		assertError(t, err, "Opened with modified data")
+		data[0] ^= 0x01
+
+		// In-place operation
+		buf := append([]byte{}, plaintext...)
+		ct = aead.Seal(buf[:0], nonce, buf, data)
+		assertByteEquals(t, ct, ciphertext)
+		pt, err = aead.Open(ct[:0], nonce, ct, data)
+		assertNotError(t, err, "Failed to open in place")
+		assertByteEquals(t, pt, plaintext)
+
+	}
+}
+
+func TestCCMParameters(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	assertNotError(t, err, "Failed to create AES cipher")
+
+	_, err = newCCM(block, 6, 16)
+	assertError(t, err, "Allowed a nonce that was too short")
+	_, err = newCCM(block, 14, 16)
+	assertError(t, err, "Allowed a nonce that was too long")
+	_, err = newCCM(block, 12, 5)
+	assertError(t, err, "Allowed an odd tag size")
+	_, err = newCCM(block, 12, 18)
+	assertError(t, err, "Allowed a tag that was too long")
+
+	aead, err := newCCM(block, 12, 16)
+	assertNotError(t, err, "Failed to create CCM")
+	_, err = aead.Open(nil, make([]byte, 12), make([]byte, 15), nil)
+	assertError(t, err, "Opened a ciphertext shorter than the tag")
+}
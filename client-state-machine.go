@@ -2,7 +2,7 @@ package mint
 
 import (
 	"bytes"
-	"crypto"
+	"crypto/x509"
 	"hash"
 	"time"
 )
@@ -55,10 +55,53 @@ type ClientStateStart struct {
 	Params ConnectionParameters
 
 	cookie            []byte
+	requestedGroup    NamedGroup
+	offeredPSKs       []PreSharedKey
+	havePSKs          bool // offeredPSKs are set, rather than taken from Caps.PSKs
+	random            [32]byte
+	cipherSuites      []CipherSuite
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 }
 
+// pskOffers returns the PSKs to offer to a server.  A ClientPSKCache can
+// offer several, and any other cache offers the one under the server name.
+func pskOffers(psks PreSharedKeyCache, serverName string) []PreSharedKey {
+	if cache, ok := psks.(ClientPSKCache); ok {
+		return cache.Take(serverName)
+	}
+	if psk, ok := psks.Get(serverName); ok {
+		return []PreSharedKey{psk}
+	}
+	return nil
+}
+
+// putBackUnsentPSKs gives tickets that were taken from a ClientPSKCache back
+// to it, unless they were offered in the ClientHello that state has sent.
+// Offered tickets are thrown away, so that they cannot be used to link
+// connections (RFC 8446, Appendix C.4).
+func putBackUnsentPSKs(psks PreSharedKeyCache, serverName string, taken []PreSharedKey, state HandshakeState) {
+	cache, ok := psks.(ClientPSKCache)
+	if !ok {
+		return
+	}
+
+	var offered []PreSharedKey
+	if waitSH, ok := state.(ClientStateWaitSH); ok {
+		offered = waitSH.OfferedPSKs
+	}
+
+	unsent := []PreSharedKey{}
+	for _, psk := range taken {
+		if !hasPSK(offered, psk.Identity) {
+			unsent = append(unsent, psk)
+		}
+	}
+	if len(unsent) > 0 {
+		cache.PutBack(serverName, unsent)
+	}
+}
+
 func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
 	if hm != nil {
 		logf(logTypeHandshake, "[ClientStateStart] Unexpected non-nil message")
@@ -66,12 +109,22 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	}
 
 	// key_shares
+	// If the server asked for a specific group in a HelloRetryRequest, then
+	// that is the only share we send
+	shareGroups := state.Caps.KeyShareGroups
+	if len(shareGroups) == 0 {
+		shareGroups = state.Caps.Groups
+	}
+	if state.requestedGroup != 0 {
+		shareGroups = []NamedGroup{state.requestedGroup}
+	}
+
 	offeredDH := map[NamedGroup][]byte{}
 	ks := KeyShareExtension{
 		HandshakeType: HandshakeTypeClientHello,
-		Shares:        make([]KeyShareEntry, len(state.Caps.Groups)),
+		Shares:        make([]KeyShareEntry, len(shareGroups)),
 	}
-	for i, group := range state.Caps.Groups {
+	for i, group := range shareGroups {
 		pub, priv, err := newKeyShare(group)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error generating key share [%v]", err)
@@ -86,7 +139,10 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	logf(logTypeHandshake, "opts: %+v", state.Opts)
 
 	// supported_versions, supported_groups, signature_algorithms, server_name
-	sv := SupportedVersionsExtension{Versions: []uint16{supportedVersion}}
+	sv := SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeClientHello,
+		Versions:      state.Caps.SupportedVersions,
+	}
 	sni := ServerNameExtension(state.Opts.ServerName)
 	sg := SupportedGroupsExtension{Groups: state.Caps.Groups}
 	sa := SignatureAlgorithmsExtension{Algorithms: state.Caps.SignatureSchemes}
@@ -99,16 +155,24 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		alpn = &ALPNExtension{Protocols: state.Opts.NextProtos}
 	}
 
-	// Construct base ClientHello
+	// Construct base ClientHello.  After a HelloRetryRequest, the random and
+	// the ciphersuites are the same as in the first ClientHello.
 	ch := &ClientHelloBody{
 		CipherSuites: state.Caps.CipherSuites,
 	}
-	_, err := prng.Read(ch.Random[:])
-	if err != nil {
-		logf(logTypeHandshake, "[ClientStateStart] Error creating ClientHello random [%v]", err)
-		return nil, nil, AlertInternalError
+	var err error
+	if state.helloRetryRequest != nil {
+		ch.Random = state.random
+		ch.CipherSuites = state.cipherSuites
+	} else {
+		_, err = prng.Read(ch.Random[:])
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error creating ClientHello random [%v]", err)
+			return nil, nil, AlertInternalError
+		}
 	}
-	for _, ext := range []ExtensionBody{&sv, &sni, &ks, &sg, &sa} {
+	keyLog := newKeyLogger(state.Caps.KeyLogWriter, ch.Random)
+	for _, ext := range []ExtensionBody{&sv, &ks, &sg, &sa} {
 		err := ch.Extensions.Add(ext)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error adding extension type=[%v] [%v]", ext.Type(), err)
@@ -117,6 +181,13 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	}
 	// XXX: These optional extensions can't be folded into the above because Go
 	// interface-typed values are never reported as nil
+	if len(sni) > 0 {
+		err := ch.Extensions.Add(&sni)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding SNI extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
 	if alpn != nil {
 		err := ch.Extensions.Add(alpn)
 		if err != nil {
@@ -127,22 +198,42 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	if state.cookie != nil {
 		err := ch.Extensions.Add(&CookieExtension{Cookie: state.cookie})
 		if err != nil {
-			logf(logTypeHandshake, "[ClientStateStart] Error adding ALPN extension [%v]", err)
+			logf(logTypeHandshake, "[ClientStateStart] Error adding cookie extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if len(state.Caps.Certificates) > 0 {
+		// Offer to authenticate later if the server asks
+		err := ch.Extensions.Add(&PostHandshakeAuthExtension{})
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding post-handshake auth extension [%v]", err)
 			return nil, nil, AlertInternalError
 		}
+		state.Params.PostHandshakeAuth = true
+	}
+	if state.Caps.ExtensionHandler != nil {
+		err := state.Caps.ExtensionHandler.Send(HandshakeTypeClientHello, &ch.Extensions)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding application extensions [%v]", err)
+			return nil, nil, extensionHandlerAlert(err, AlertInternalError)
+		}
 	}
 
 	// Handle PSK and EarlyData just before transmitting, so that we can
-	// calculate the PSK binder value
+	// calculate the PSK binder values.  The PSKs may already have been taken
+	// from the cache by the caller, and after a HelloRetryRequest, the PSKs
+	// offered in the first ClientHello are offered again.
+	offeredPSKs := state.offeredPSKs
+	if !state.havePSKs {
+		offeredPSKs = pskOffers(state.Caps.PSKs, state.Opts.ServerName)
+	}
+
 	var psk *PreSharedKeyExtension
 	var ed *EarlyDataExtension
-	var offeredPSK PreSharedKey
-	var earlyHash crypto.Hash
-	var earlySecret []byte
 	var clientEarlyTrafficKeys keySet
 	var clientHello *HandshakeMessage
-	if key, ok := state.Caps.PSKs.Get(state.Opts.ServerName); ok {
-		offeredPSK = key
+	if len(offeredPSKs) > 0 {
+		key := offeredPSKs[0]
 
 		// Narrow ciphersuites to ones that match PSK hash
 		params, ok := cipherSuiteMap[key.CipherSuite]
@@ -159,8 +250,25 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		}
 		ch.CipherSuites = compatibleSuites
 
-		// Signal early data if we're going to do it
-		if len(state.Opts.EarlyData) > 0 {
+		// Only the PSKs that match the same hash can be offered with them
+		compatiblePSKs := []PreSharedKey{}
+		for _, other := range offeredPSKs {
+			otherParams, ok := cipherSuiteMap[other.CipherSuite]
+			if ok && otherParams.Hash == params.Hash {
+				compatiblePSKs = append(compatiblePSKs, other)
+			}
+		}
+		offeredPSKs = compatiblePSKs
+
+		// Signal early data if we're going to do it.  Early data is not allowed
+		// after a HelloRetryRequest, or if there is more of it than a ticket
+		// allows.  It is always sent with the first PSK.
+		earlyDataAllowed := !key.IsResumption || len(state.Opts.EarlyData) <= int(key.MaxEarlyDataSize)
+		if !earlyDataAllowed {
+			logf(logTypeHandshake, "[ClientStateStart] Early data exceeds ticket maximum [%d] > [%d]",
+				len(state.Opts.EarlyData), key.MaxEarlyDataSize)
+		}
+		if len(state.Opts.EarlyData) > 0 && state.helloRetryRequest == nil && earlyDataAllowed {
 			state.Params.ClientSendingEarlyData = true
 			ed = &EarlyDataExtension{}
 			err = ch.Extensions.Add(ed)
@@ -183,51 +291,48 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		}
 
 		// Add the shim PSK extension to the ClientHello
-		logf(logTypeHandshake, "Adding PSK extension with id = %x", key.Identity)
 		psk = &PreSharedKeyExtension{
 			HandshakeType: HandshakeTypeClientHello,
-			Identities: []PSKIdentity{
-				{
-					Identity:            key.Identity,
-					ObfuscatedTicketAge: uint32(time.Since(key.ReceivedAt)/time.Millisecond) + key.TicketAgeAdd,
-				},
-			},
-			Binders: []PSKBinderEntry{
-				// Note: Stub to get the length fields right
-				{Binder: bytes.Repeat([]byte{0x00}, params.Hash.Size())},
-			},
+			Identities:    make([]PSKIdentity, len(offeredPSKs)),
+			Binders:       make([]PSKBinderEntry, len(offeredPSKs)),
 		}
-		ch.Extensions.Add(psk)
-
-		// Compute the binder key
-		h0 := params.Hash.New().Sum(nil)
-		zero := bytes.Repeat([]byte{0}, params.Hash.Size())
-
-		earlyHash = params.Hash
-		earlySecret = HkdfExtract(params.Hash, zero, key.Key)
-		logf(logTypeCrypto, "early secret: [%d] %x", len(earlySecret), earlySecret)
+		for i, offered := range offeredPSKs {
+			logf(logTypeHandshake, "Adding PSK extension with id = %x", offered.Identity)
+			psk.Identities[i] = PSKIdentity{Identity: offered.Identity}
+
+			// External PSKs have no ticket age, so zero is sent for them
+			if offered.IsResumption {
+				ticketAge := uint32(time.Since(offered.ReceivedAt) / time.Millisecond)
+				psk.Identities[i].ObfuscatedTicketAge = ticketAge + offered.TicketAgeAdd
+			}
 
-		binderLabel := labelExternalBinder
-		if key.IsResumption {
-			binderLabel = labelResumptionBinder
+			// Note: Stub to get the length fields right
+			psk.Binders[i] = PSKBinderEntry{Binder: bytes.Repeat([]byte{0x00}, params.Hash.Size())}
 		}
-		binderKey := deriveSecret(params, earlySecret, binderLabel, h0)
-		logf(logTypeCrypto, "binder key: [%d] %x", len(binderKey), binderKey)
+		ch.Extensions.Add(psk)
 
-		// Compute the binder value
+		// Compute the binder values
 		trunc, err := ch.Truncated()
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error marshaling truncated ClientHello [%v]", err)
 			return nil, nil, AlertInternalError
 		}
 
+		// After a HelloRetryRequest, the binder covers the whole transcript
 		truncHash := params.Hash.New()
+		if state.helloRetryRequest != nil {
+			truncHash.Write(state.firstClientHello.Marshal())
+			truncHash.Write(state.helloRetryRequest.Marshal())
+		}
 		truncHash.Write(trunc)
 
-		binder := computeFinishedData(params, binderKey, truncHash.Sum(nil))
+		for i, offered := range offeredPSKs {
+			binderKey := pskBinderKey(params, offered)
+			logf(logTypeCrypto, "binder key: [%d] %x", len(binderKey), binderKey)
+			psk.Binders[i].Binder = computeFinishedData(params, binderKey, truncHash.Sum(nil))
+		}
 
 		// Replace the PSK extension
-		psk.Binders[0].Binder = binder
 		ch.Extensions.Add(psk)
 
 		// If we got here, the earlier marshal succeeded (in ch.Truncated()), so
@@ -239,8 +344,13 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		h.Write(clientHello.Marshal())
 		chHash := h.Sum(nil)
 
+		zero := bytes.Repeat([]byte{0}, params.Hash.Size())
+		earlySecret := HkdfExtract(params.Hash, zero, key.Key)
+		logf(logTypeCrypto, "early secret: [%d] %x", len(earlySecret), earlySecret)
+
 		earlyTrafficSecret := deriveSecret(params, earlySecret, labelEarlyTrafficSecret, chHash)
 		logf(logTypeCrypto, "early traffic secret: [%d] %x", len(earlyTrafficSecret), earlyTrafficSecret)
+		keyLog.log(keyLogLabelClientEarlyTraffic, earlyTrafficSecret)
 		clientEarlyTrafficKeys = makeTrafficKeys(params, earlyTrafficSecret)
 	} else if len(state.Opts.EarlyData) > 0 {
 		logf(logTypeHandshake, "[ClientStateWaitSH] Early data without PSK")
@@ -255,18 +365,18 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 
 	logf(logTypeHandshake, "[ClientStateStart] -> [ClientStateWaitSH]")
 	nextState := ClientStateWaitSH{
-		Caps:       state.Caps,
-		Opts:       state.Opts,
-		Params:     state.Params,
-		OfferedDH:  offeredDH,
-		OfferedPSK: offeredPSK,
-
-		earlySecret: earlySecret,
-		earlyHash:   earlyHash,
-
+		Caps:        state.Caps,
+		Opts:        state.Opts,
+		Params:      state.Params,
+		OfferedDH:   offeredDH,
+		OfferedPSKs: offeredPSKs,
+
+		random:            ch.Random,
+		cipherSuites:      ch.CipherSuites,
 		firstClientHello:  state.firstClientHello,
 		helloRetryRequest: state.helloRetryRequest,
 		clientHello:       clientHello,
+		keyLog:            keyLog,
 	}
 
 	toSend := []HandshakeAction{
@@ -283,19 +393,28 @@ func (state ClientStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 }
 
 type ClientStateWaitSH struct {
-	Caps       Capabilities
-	Opts       ConnectionOptions
-	Params     ConnectionParameters
-	OfferedDH  map[NamedGroup][]byte
-	OfferedPSK PreSharedKey
-	PSK        []byte
-
-	earlySecret []byte
-	earlyHash   crypto.Hash
-
+	Caps        Capabilities
+	Opts        ConnectionOptions
+	Params      ConnectionParameters
+	OfferedDH   map[NamedGroup][]byte
+	OfferedPSKs []PreSharedKey
+	PSK         []byte
+
+	random            [32]byte
+	cipherSuites      []CipherSuite
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 	clientHello       *HandshakeMessage
+	keyLog            keyLogger
+}
+
+func (state ClientStateWaitSH) offeredVersion(version uint16) bool {
+	for _, offered := range state.Caps.SupportedVersions {
+		if offered == version {
+			return true
+		}
+	}
+	return false
 }
 
 func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -319,15 +438,26 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			return nil, nil, AlertUnexpectedMessage
 		}
 
-		// Check that the version sent by the server is the one we support
-		if hrr.Version != supportedVersion {
-			logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported version [%v]", hrr.Version)
-			return nil, nil, AlertProtocolVersion
+		// Check the legacy fields, then the version the server selected
+		if hrr.Version != tls12Version || len(hrr.LegacySessionID) != 0 {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Invalid legacy fields in HelloRetryRequest")
+			return nil, nil, AlertIllegalParameter
 		}
 
-		// Check that the server provided a supported ciphersuite
+		serverVersion := SupportedVersionsExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+		if !hrr.Extensions.Find(&serverVersion) {
+			logf(logTypeHandshake, "[ClientStateWaitSH] No supported_versions in HelloRetryRequest")
+			return nil, nil, AlertMissingExtension
+		}
+
+		if !state.offeredVersion(serverVersion.Versions[0]) {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported version [%04x]", serverVersion.Versions[0])
+			return nil, nil, AlertIllegalParameter
+		}
+
+		// Check that the server provided a ciphersuite that we offered
 		supportedCipherSuite := false
-		for _, suite := range state.Caps.CipherSuites {
+		for _, suite := range state.cipherSuites {
 			supportedCipherSuite = supportedCipherSuite || (suite == hrr.CipherSuite)
 		}
 		if !supportedCipherSuite {
@@ -335,19 +465,51 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			return nil, nil, AlertHandshakeFailure
 		}
 
-		// Narrow the supported ciphersuites to the server-provided one
+		// The second ClientHello offers the same ciphersuites as the first, but
+		// the ServerHello has to select the one in the HelloRetryRequest
 		state.Caps.CipherSuites = []CipherSuite{hrr.CipherSuite}
 
-		// The only thing we know how to respond to in an HRR is the Cookie
-		// extension, so if there is either no Cookie extension or anything other
-		// than a Cookie extension, we have to fail.
+		// We know how to respond to a Cookie and a KeyShare in an HRR.  Anything
+		// else (besides supported_versions) is an error, as is an HRR that
+		// wouldn't change the ClientHello.
 		serverCookie := new(CookieExtension)
+		serverKeyShare := &KeyShareExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
 		foundCookie := hrr.Extensions.Find(serverCookie)
-		if !foundCookie || len(hrr.Extensions) != 1 {
-			logf(logTypeHandshake, "[ClientStateWaitSH] No Cookie or extra extensions [%v] [%d]", foundCookie, len(hrr.Extensions))
+		foundKeyShare := hrr.Extensions.Find(serverKeyShare)
+
+		knownExtensions := 1
+		if foundCookie {
+			knownExtensions++
+		}
+		if foundKeyShare {
+			knownExtensions++
+		}
+		if len(hrr.Extensions) != knownExtensions {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported extensions in HRR [%d]", len(hrr.Extensions))
+			return nil, nil, AlertUnsupportedExtension
+		}
+		if !foundCookie && !foundKeyShare {
+			logf(logTypeHandshake, "[ClientStateWaitSH] HRR would not change the ClientHello")
 			return nil, nil, AlertIllegalParameter
 		}
 
+		// The server must select a group that we support, but haven't already
+		// sent a key share for
+		var requestedGroup NamedGroup
+		if foundKeyShare {
+			requestedGroup = serverKeyShare.SelectedGroup
+
+			supportedGroup := false
+			for _, group := range state.Caps.Groups {
+				supportedGroup = supportedGroup || (group == requestedGroup)
+			}
+			_, alreadyOffered := state.OfferedDH[requestedGroup]
+			if !supportedGroup || alreadyOffered {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Invalid group requested in HRR [%04x]", requestedGroup)
+				return nil, nil, AlertIllegalParameter
+			}
+		}
+
 		// Hash the body into a pseudo-message
 		// XXX: Ignoring some errors here
 		params := cipherSuiteMap[hrr.CipherSuite]
@@ -363,6 +525,11 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			Caps:              state.Caps,
 			Opts:              state.Opts,
 			cookie:            serverCookie.Cookie,
+			requestedGroup:    requestedGroup,
+			offeredPSKs:       state.OfferedPSKs,
+			havePSKs:          true,
+			random:            state.random,
+			cipherSuites:      state.cipherSuites,
 			firstClientHello:  firstClientHello,
 			helloRetryRequest: hm,
 		}.Next(nil)
@@ -370,12 +537,46 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	case *ServerHelloBody:
 		sh := body
 
-		// Check that the version sent by the server is the one we support
-		if sh.Version != supportedVersion {
-			logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported version [%v]", sh.Version)
+		// A ServerHello without supported_versions negotiates TLS 1.2 or below,
+		// which we don't support.  If the server is a TLS 1.3 server, then it
+		// will have marked the random value to show that a downgrade happened.
+		serverVersion := SupportedVersionsExtension{HandshakeType: HandshakeTypeServerHello}
+		if !sh.Extensions.Find(&serverVersion) {
+			downgradeMarker := sh.Random[len(sh.Random)-len(downgradeSentinelTLS12):]
+			if bytes.Equal(downgradeMarker, downgradeSentinelTLS12) ||
+				bytes.Equal(downgradeMarker, downgradeSentinelTLS11) {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Downgrade detected")
+				return nil, nil, AlertIllegalParameter
+			}
+
+			logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported version [%04x]", sh.Version)
 			return nil, nil, AlertProtocolVersion
 		}
 
+		// Check the legacy fields, then the version the server selected
+		if sh.Version != tls12Version || len(sh.LegacySessionID) != 0 {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Invalid legacy fields in ServerHello")
+			return nil, nil, AlertIllegalParameter
+		}
+
+		version := serverVersion.Versions[0]
+		if !state.offeredVersion(version) {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported version [%04x]", version)
+			return nil, nil, AlertIllegalParameter
+		}
+
+		// The server can't change its mind about the version after an HRR
+		if state.helloRetryRequest != nil {
+			hrr := HelloRetryRequestBody{}
+			hrrVersion := SupportedVersionsExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+			_, err := hrr.Unmarshal(state.helloRetryRequest.body)
+			if err != nil || !hrr.Extensions.Find(&hrrVersion) || hrrVersion.Versions[0] != version {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Version changed after HelloRetryRequest")
+				return nil, nil, AlertIllegalParameter
+			}
+		}
+		state.Params.Version = version
+
 		// Check that the server provided a supported ciphersuite
 		supportedCipherSuite := false
 		for _, suite := range state.Caps.CipherSuites {
@@ -393,8 +594,16 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		foundPSK := sh.Extensions.Find(&serverPSK)
 		foundKeyShare := sh.Extensions.Find(&serverKeyShare)
 
-		if foundPSK && (serverPSK.SelectedIdentity == 0) {
+		var selectedPSK PreSharedKey
+		if foundPSK {
+			if int(serverPSK.SelectedIdentity) >= len(state.OfferedPSKs) {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Selected PSK was not offered [%d]", serverPSK.SelectedIdentity)
+				return nil, nil, AlertIllegalParameter
+			}
+
+			selectedPSK = state.OfferedPSKs[serverPSK.SelectedIdentity]
 			state.Params.UsingPSK = true
+			state.Params.UsingResumption = selectedPSK.IsResumption
 		}
 
 		var dhSecret []byte
@@ -407,7 +616,13 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			}
 
 			state.Params.UsingDH = true
-			dhSecret, _ = keyAgreement(sks.Group, sks.KeyExchange, priv)
+			state.Params.Group = sks.Group
+			var err error
+			dhSecret, err = keyAgreement(sks.Group, sks.KeyExchange, priv)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Key agreement failed: %v", err)
+				return nil, nil, AlertIllegalParameter
+			}
 		}
 
 		suite := sh.CipherSuite
@@ -431,12 +646,12 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 
 		var earlySecret []byte
 		if state.Params.UsingPSK {
-			if params.Hash != state.earlyHash {
-				logf(logTypeCrypto, "Change of hash between early and normal init early=[%02x] suite=[%04x] hash=[%02x]",
-					state.earlyHash, suite, params.Hash)
+			if cipherSuiteMap[selectedPSK.CipherSuite].Hash != params.Hash {
+				logf(logTypeCrypto, "[ClientStateWaitSH] Selected PSK does not match ciphersuite [%04x]", suite)
+				return nil, nil, AlertIllegalParameter
 			}
 
-			earlySecret = state.earlySecret
+			earlySecret = HkdfExtract(params.Hash, zero, selectedPSK.Key)
 		} else {
 			earlySecret = HkdfExtract(params.Hash, zero, zero)
 		}
@@ -459,11 +674,18 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		logf(logTypeCrypto, "client handshake traffic secret: [%d] %x", len(clientHandshakeTrafficSecret), clientHandshakeTrafficSecret)
 		logf(logTypeCrypto, "server handshake traffic secret: [%d] %x", len(serverHandshakeTrafficSecret), serverHandshakeTrafficSecret)
 		logf(logTypeCrypto, "master secret: [%d] %x", len(masterSecret), masterSecret)
+		state.keyLog.log(keyLogLabelClientHandshakeTraffic, clientHandshakeTrafficSecret)
+		state.keyLog.log(keyLogLabelServerHandshakeTraffic, serverHandshakeTrafficSecret)
 
 		serverHandshakeKeys := makeTrafficKeys(params, serverHandshakeTrafficSecret)
 
 		logf(logTypeHandshake, "[ClientStateWaitSH] -> [ClientStateWaitEE]")
 		nextState := ClientStateWaitEE{
+			AuthCertificate:              state.Caps.AuthCertificate,
+			reportVerifyError:            state.Caps.reportVerifyError,
+			ExtensionHandler:             state.Caps.ExtensionHandler,
+			RootCAs:                      state.Caps.RootCAs,
+			InsecureSkipVerify:           state.Caps.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 params,
 			handshakeHash:                handshakeHash,
@@ -471,6 +693,7 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			masterSecret:                 masterSecret,
 			clientHandshakeTrafficSecret: clientHandshakeTrafficSecret,
 			serverHandshakeTrafficSecret: serverHandshakeTrafficSecret,
+			keyLog:                       state.keyLog,
 		}
 		toSend := []HandshakeAction{
 			RekeyIn{Label: "handshake", KeySet: serverHandshakeKeys},
@@ -484,6 +707,10 @@ func (state ClientStateWaitSH) Next(hm *HandshakeMessage) (HandshakeState, []Han
 
 type ClientStateWaitEE struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	reportVerifyError            func(err error)
+	ExtensionHandler             AppExtensionHandler
+	RootCAs                      *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 CipherSuiteParams
 	handshakeHash                hash.Hash
@@ -491,6 +718,7 @@ type ClientStateWaitEE struct {
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 	serverHandshakeTrafficSecret []byte
+	keyLog                       keyLogger
 }
 
 func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -516,6 +744,14 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		state.Params.NextProto = serverALPN.Protocols[0]
 	}
 
+	if state.ExtensionHandler != nil {
+		err := state.ExtensionHandler.Receive(HandshakeTypeEncryptedExtensions, &ee.Extensions)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitEE] Error processing application extensions [%v]", err)
+			return nil, nil, extensionHandlerAlert(err, AlertIllegalParameter)
+		}
+	}
+
 	state.handshakeHash.Write(hm.Marshal())
 
 	if state.Params.UsingPSK {
@@ -528,6 +764,7 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 			masterSecret:                 state.masterSecret,
 			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 			serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+			keyLog:                       state.keyLog,
 		}
 		return nextState, nil, AlertNoAlert
 	}
@@ -535,6 +772,9 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	logf(logTypeHandshake, "[ClientStateWaitEE] -> [ClientStateWaitCertCR]")
 	nextState := ClientStateWaitCertCR{
 		AuthCertificate:              state.AuthCertificate,
+		reportVerifyError:            state.reportVerifyError,
+		RootCAs:                      state.RootCAs,
+		InsecureSkipVerify:           state.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		handshakeHash:                state.handshakeHash,
@@ -542,12 +782,16 @@ func (state ClientStateWaitEE) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		masterSecret:                 state.masterSecret,
 		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 		serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+		keyLog:                       state.keyLog,
 	}
 	return nextState, nil, AlertNoAlert
 }
 
 type ClientStateWaitCertCR struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	reportVerifyError            func(err error)
+	RootCAs                      *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 CipherSuiteParams
 	handshakeHash                hash.Hash
@@ -555,6 +799,7 @@ type ClientStateWaitCertCR struct {
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 	serverHandshakeTrafficSecret []byte
+	keyLog                       keyLogger
 }
 
 func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -576,6 +821,9 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 		logf(logTypeHandshake, "[ClientStateWaitCertCR] -> [ClientStateWaitCV]")
 		nextState := ClientStateWaitCV{
 			AuthCertificate:              state.AuthCertificate,
+			reportVerifyError:            state.reportVerifyError,
+			RootCAs:                      state.RootCAs,
+			InsecureSkipVerify:           state.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
@@ -584,6 +832,7 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 			masterSecret:                 state.masterSecret,
 			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 			serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+			keyLog:                       state.keyLog,
 		}
 		return nextState, nil, AlertNoAlert
 
@@ -599,6 +848,9 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 		logf(logTypeHandshake, "[ClientStateWaitCertCR] -> [ClientStateWaitCert]")
 		nextState := ClientStateWaitCert{
 			AuthCertificate:              state.AuthCertificate,
+			reportVerifyError:            state.reportVerifyError,
+			RootCAs:                      state.RootCAs,
+			InsecureSkipVerify:           state.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
@@ -607,6 +859,7 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 			masterSecret:                 state.masterSecret,
 			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 			serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+			keyLog:                       state.keyLog,
 		}
 		return nextState, nil, AlertNoAlert
 	}
@@ -615,10 +868,13 @@ func (state ClientStateWaitCertCR) Next(hm *HandshakeMessage) (HandshakeState, [
 }
 
 type ClientStateWaitCert struct {
-	AuthCertificate func(chain []CertificateEntry) error
-	Params          ConnectionParameters
-	cryptoParams    CipherSuiteParams
-	handshakeHash   hash.Hash
+	AuthCertificate    func(chain []CertificateEntry) error
+	reportVerifyError  func(err error)
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+	Params             ConnectionParameters
+	cryptoParams       CipherSuiteParams
+	handshakeHash      hash.Hash
 
 	certificates             []*Certificate
 	serverCertificateRequest *CertificateRequestBody
@@ -626,6 +882,7 @@ type ClientStateWaitCert struct {
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 	serverHandshakeTrafficSecret []byte
+	keyLog                       keyLogger
 }
 
 func (state ClientStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -646,6 +903,9 @@ func (state ClientStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 	logf(logTypeHandshake, "[ClientStateWaitCert] -> [ClientStateWaitCV]")
 	nextState := ClientStateWaitCV{
 		AuthCertificate:              state.AuthCertificate,
+		reportVerifyError:            state.reportVerifyError,
+		RootCAs:                      state.RootCAs,
+		InsecureSkipVerify:           state.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		handshakeHash:                state.handshakeHash,
@@ -655,15 +915,19 @@ func (state ClientStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 		masterSecret:                 state.masterSecret,
 		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 		serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+		keyLog:                       state.keyLog,
 	}
 	return nextState, nil, AlertNoAlert
 }
 
 type ClientStateWaitCV struct {
-	AuthCertificate func(chain []CertificateEntry) error
-	Params          ConnectionParameters
-	cryptoParams    CipherSuiteParams
-	handshakeHash   hash.Hash
+	AuthCertificate    func(chain []CertificateEntry) error
+	reportVerifyError  func(err error)
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+	Params             ConnectionParameters
+	cryptoParams       CipherSuiteParams
+	handshakeHash      hash.Hash
 
 	certificates             []*Certificate
 	serverCertificate        *CertificateBody
@@ -672,6 +936,7 @@ type ClientStateWaitCV struct {
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 	serverHandshakeTrafficSecret []byte
+	keyLog                       keyLogger
 }
 
 func (state ClientStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -690,22 +955,37 @@ func (state ClientStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	hcv := state.handshakeHash.Sum(nil)
 	logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
-	serverPublicKey := state.serverCertificate.CertificateList[0].CertData.PublicKey
-	if err := certVerify.Verify(serverPublicKey, hcv); err != nil {
+	serverPublicKey := certificatePublicKey(state.serverCertificate.CertificateList[0].CertData)
+	if err := certVerify.Verify(serverPublicKey, serverSignatureContext, hcv); err != nil {
 		logf(logTypeHandshake, "[ClientStateWaitCV] Server signature failed to verify")
 		return nil, nil, AlertHandshakeFailure
 	}
 
+	peerCertificates := make([]*x509.Certificate, len(state.serverCertificate.CertificateList))
+	for i, entry := range state.serverCertificate.CertificateList {
+		peerCertificates[i] = entry.CertData
+	}
+
+	var verifiedChains [][]*x509.Certificate
+	if !state.InsecureSkipVerify {
+		verifiedChains, err = verifyCertificateChain(peerCertificates, state.RootCAs, state.Params.ServerName, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitCV] Server certificate failed to verify [%v]", err)
+			return nil, nil, verifyFailure(state.reportVerifyError, peerCertificates, err)
+		}
+	} else {
+		logf(logTypeHandshake, "[ClientStateWaitCV] WARNING: No verification of server certificate")
+	}
+
 	if state.AuthCertificate != nil {
 		err := state.AuthCertificate(state.serverCertificate.CertificateList)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateWaitCV] Application rejected server certificate")
-			return nil, nil, AlertBadCertificate
+			return nil, nil, verifyFailure(state.reportVerifyError, peerCertificates, err)
 		}
-	} else {
-		logf(logTypeHandshake, "[ClientStateWaitCV] WARNING: No verification of server certificate")
 	}
 
+	state.Params.SignatureScheme = certVerify.Algorithm
 	state.handshakeHash.Write(hm.Marshal())
 
 	logf(logTypeHandshake, "[ClientStateWaitCV] -> [ClientStateWaitFinished]")
@@ -715,9 +995,12 @@ func (state ClientStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 		handshakeHash:                state.handshakeHash,
 		certificates:                 state.certificates,
 		serverCertificateRequest:     state.serverCertificateRequest,
+		peerCertificates:             peerCertificates,
+		verifiedChains:               verifiedChains,
 		masterSecret:                 state.masterSecret,
 		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 		serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+		keyLog:                       state.keyLog,
 	}
 	return nextState, nil, AlertNoAlert
 }
@@ -729,10 +1012,13 @@ type ClientStateWaitFinished struct {
 
 	certificates             []*Certificate
 	serverCertificateRequest *CertificateRequestBody
+	peerCertificates         []*x509.Certificate
+	verifiedChains           [][]*x509.Certificate
 
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 	serverHandshakeTrafficSecret []byte
+	keyLog                       keyLogger
 }
 
 func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -780,6 +1066,10 @@ func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 	exporterSecret := deriveSecret(state.cryptoParams, state.masterSecret, labelExporterSecret, h4)
 	logf(logTypeCrypto, "client exporter secret: [%d] %x", len(exporterSecret), exporterSecret)
 
+	state.keyLog.logTraffic(keyLogLabelClientTraffic, 0, clientTrafficSecret)
+	state.keyLog.logTraffic(keyLogLabelServerTraffic, 0, serverTrafficSecret)
+	state.keyLog.log(keyLogLabelExporter, exporterSecret)
+
 	// Assemble client's second flight
 	toSend := []HandshakeAction{}
 
@@ -844,7 +1134,7 @@ func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 			certificateVerify := &CertificateVerifyBody{Algorithm: certScheme}
 			logf(logTypeHandshake, "Creating CertVerify: %04x %v", certScheme, state.cryptoParams.Hash)
 
-			err = certificateVerify.Sign(cert.PrivateKey, hcv)
+			err = certificateVerify.Sign(cert.PrivateKey, clientSignatureContext, hcv)
 			if err != nil {
 				logf(logTypeHandshake, "[ClientStateWaitFinished] Error signing CertificateVerify [%v]", err)
 				return nil, nil, AlertInternalError
@@ -895,10 +1185,15 @@ func (state ClientStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 		Params:              state.Params,
 		isClient:            true,
 		cryptoParams:        state.cryptoParams,
+		peerCertificates:    state.peerCertificates,
+		verifiedChains:      state.verifiedChains,
 		resumptionSecret:    resumptionSecret,
 		clientTrafficSecret: clientTrafficSecret,
 		serverTrafficSecret: serverTrafficSecret,
 		exporterSecret:      exporterSecret,
+		keyLog:              state.keyLog,
+		handshakeHash:       state.handshakeHash,
+		certificates:        state.certificates,
 	}
 	return nextState, toSend, AlertNoAlert
 }
@@ -1,7 +1,28 @@
 package mint
 
 var (
-	supportedVersion uint16 = 0x7f15 // draft-21
+	supportedVersion uint16 = 0x0304 // RFC 8446
+	tls12Version     uint16 = 0x0303 // Sent as legacy_version
+
+	// Draft versions that are wire-compatible with RFC 8446, and which can be
+	// enabled for interop testing.  Earlier drafts did not authenticate the
+	// record header as additional data.
+	minDraftVersion uint16 = 0x7f19 // draft-25
+	maxDraftVersion uint16 = 0x7f1c // draft-28
+
+	// HelloRetryRequest is a ServerHello with this random value, which is
+	// SHA-256("HelloRetryRequest")
+	helloRetryRequestRandom = [32]byte{
+		0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+		0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+		0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+		0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+	}
+
+	// A TLS 1.3 server that negotiates TLS 1.2 or below puts one of these in
+	// the last eight bytes of ServerHello.random
+	downgradeSentinelTLS12 = []byte{0x44, 0x4F, 0x57, 0x4E, 0x47, 0x52, 0x44, 0x01}
+	downgradeSentinelTLS11 = []byte{0x44, 0x4F, 0x57, 0x4E, 0x47, 0x52, 0x44, 0x00}
 
 	// Flags for some minor compat issues
 	allowWrongVersionNumber = true
@@ -12,9 +33,10 @@ var (
 type RecordType byte
 
 const (
-	RecordTypeAlert           RecordType = 21
-	RecordTypeHandshake       RecordType = 22
-	RecordTypeApplicationData RecordType = 23
+	RecordTypeChangeCipherSpec RecordType = 20
+	RecordTypeAlert            RecordType = 21
+	RecordTypeHandshake        RecordType = 22
+	RecordTypeApplicationData  RecordType = 23
 )
 
 // enum {...} HandshakeType;
@@ -26,7 +48,7 @@ const (
 	HandshakeTypeServerHello         HandshakeType = 2
 	HandshakeTypeNewSessionTicket    HandshakeType = 4
 	HandshakeTypeEndOfEarlyData      HandshakeType = 5
-	HandshakeTypeHelloRetryRequest   HandshakeType = 6
+	HandshakeTypeHelloRetryRequest   HandshakeType = 6 // Only used to select extension formats
 	HandshakeTypeEncryptedExtensions HandshakeType = 8
 	HandshakeTypeCertificate         HandshakeType = 11
 	HandshakeTypeCertificateRequest  HandshakeType = 13
@@ -48,7 +70,10 @@ const (
 	TLS_AES_256_GCM_SHA384       CipherSuite = 0x1302
 	TLS_CHACHA20_POLY1305_SHA256 CipherSuite = 0x1303
 	TLS_AES_128_CCM_SHA256       CipherSuite = 0x1304
-	TLS_AES_256_CCM_8_SHA256     CipherSuite = 0x1305
+	TLS_AES_128_CCM_8_SHA256     CipherSuite = 0x1305
+
+	// Deprecated: 0x1305 uses AES-128 (RFC 8446); use TLS_AES_128_CCM_8_SHA256.
+	TLS_AES_256_CCM_8_SHA256 = TLS_AES_128_CCM_8_SHA256
 )
 
 // enum {...} SignatureScheme
@@ -77,17 +102,18 @@ const (
 type ExtensionType uint16
 
 const (
-	ExtensionTypeServerName          ExtensionType = 0
-	ExtensionTypeSupportedGroups     ExtensionType = 10
-	ExtensionTypeSignatureAlgorithms ExtensionType = 13
-	ExtensionTypeALPN                ExtensionType = 16
-	ExtensionTypeKeyShare            ExtensionType = 40
-	ExtensionTypePreSharedKey        ExtensionType = 41
-	ExtensionTypeEarlyData           ExtensionType = 42
-	ExtensionTypeSupportedVersions   ExtensionType = 43
-	ExtensionTypeCookie              ExtensionType = 44
-	ExtensionTypePSKKeyExchangeModes ExtensionType = 45
-	ExtensionTypeTicketEarlyDataInfo ExtensionType = 46
+	ExtensionTypeServerName              ExtensionType = 0
+	ExtensionTypeSupportedGroups         ExtensionType = 10
+	ExtensionTypeSignatureAlgorithms     ExtensionType = 13
+	ExtensionTypeALPN                    ExtensionType = 16
+	ExtensionTypePreSharedKey            ExtensionType = 41
+	ExtensionTypeEarlyData               ExtensionType = 42
+	ExtensionTypeSupportedVersions       ExtensionType = 43
+	ExtensionTypeCookie                  ExtensionType = 44
+	ExtensionTypePSKKeyExchangeModes     ExtensionType = 45
+	ExtensionTypePostHandshakeAuth       ExtensionType = 49
+	ExtensionTypeKeyShare                ExtensionType = 51
+	ExtensionTypeQUICTransportParameters ExtensionType = 57
 )
 
 // enum {...} NamedGroup
@@ -1,19 +1,27 @@
 package mint
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var WouldBlock = fmt.Errorf("Would have blocked")
 
+// userCanceledTimeout bounds how long HandshakeContext tries to send the
+// user_canceled and close_notify alerts
+const userCanceledTimeout = 100 * time.Millisecond
+
 type Certificate struct {
 	Chain      []*x509.Certificate
 	PrivateKey crypto.Signer
@@ -28,6 +36,17 @@ type PreSharedKey struct {
 	ReceivedAt   time.Time
 	ExpiresAt    time.Time
 	TicketAgeAdd uint32
+
+	// MaxEarlyDataSize is the most early data that a client can send with a
+	// resumption ticket, as advertised by the server.  Zero means that the
+	// ticket does not allow early data.  Early data with external PSKs is
+	// limited by the server's Config.MaxEarlyDataSize.
+	MaxEarlyDataSize uint32
+}
+
+// expired reports whether a ticket has expired.  External PSKs don't expire.
+func (psk PreSharedKey) expired(now time.Time) bool {
+	return !psk.ExpiresAt.IsZero() && now.After(psk.ExpiresAt)
 }
 
 type PreSharedKeyCache interface {
@@ -51,32 +70,237 @@ func (cache PSKMapCache) Size() int {
 	return len(cache)
 }
 
+// ClientPSKCache is a PreSharedKeyCache that can hold several PSKs for each
+// server.  A client offers all of the PSKs that Take returns, in order.  Take
+// also forgets any resumption tickets that it returns, since a ticket should
+// only be used once.  Any tickets that are not offered in the end, e.g.,
+// because the ClientHello could not be built, are given back with PutBack.
+type ClientPSKCache interface {
+	PreSharedKeyCache
+	Take(string) []PreSharedKey
+	PutBack(string, []PreSharedKey)
+}
+
+const (
+	// maxTicketsPerServer is the number of resumption tickets that a
+	// PSKListCache keeps for each server
+	maxTicketsPerServer = 8
+
+	// maxOfferedTickets is the number of resumption tickets that a
+	// PSKListCache returns from Take, so that a ClientHello stays small
+	maxOfferedTickets = 4
+)
+
+// PSKListCache is a ClientPSKCache that keeps PSKs newest first, along with
+// up to maxTicketsPerServer tickets for each server.  Take returns external
+// PSKs and the newest maxOfferedTickets tickets that have not expired.
+type PSKListCache map[string][]PreSharedKey
+
+func (cache PSKListCache) Get(key string) (psk PreSharedKey, ok bool) {
+	psks := cache[key]
+	if len(psks) == 0 {
+		return PreSharedKey{}, false
+	}
+	return psks[0], true
+}
+
+func (cache *PSKListCache) Put(key string, psk PreSharedKey) {
+	psks := []PreSharedKey{psk}
+	tickets := 0
+	if psk.IsResumption {
+		tickets++
+	}
+
+	for _, old := range (*cache)[key] {
+		if bytes.Equal(old.Identity, psk.Identity) {
+			continue
+		}
+		if old.IsResumption {
+			if tickets == maxTicketsPerServer {
+				continue
+			}
+			tickets++
+		}
+		psks = append(psks, old)
+	}
+	(*cache)[key] = psks
+}
+
+func (cache PSKListCache) Size() int {
+	size := 0
+	for _, psks := range cache {
+		size += len(psks)
+	}
+	return size
+}
+
+func (cache *PSKListCache) Take(key string) []PreSharedKey {
+	now := time.Now()
+	taken := []PreSharedKey{}
+	kept := []PreSharedKey{}
+	tickets := 0
+	for _, psk := range (*cache)[key] {
+		switch {
+		case !psk.IsResumption:
+			taken = append(taken, psk)
+			kept = append(kept, psk)
+		case psk.expired(now):
+			logf(logTypeHandshake, "Dropping expired ticket [%x]", psk.Identity)
+		case tickets < maxOfferedTickets:
+			taken = append(taken, psk)
+			tickets++
+		default:
+			kept = append(kept, psk)
+		}
+	}
+
+	cache.set(key, kept)
+	return taken
+}
+
+// PutBack returns tickets that were never offered to the cache, in order of
+// when they were received, unless they have expired or newer tickets have
+// taken their place.
+func (cache *PSKListCache) PutBack(key string, psks []PreSharedKey) {
+	now := time.Now()
+	kept := (*cache)[key]
+	for _, psk := range psks {
+		if !psk.IsResumption || psk.expired(now) || hasPSK(kept, psk.Identity) {
+			continue
+		}
+
+		at := len(kept)
+		for i, old := range kept {
+			if old.IsResumption && old.ReceivedAt.Before(psk.ReceivedAt) {
+				at = i
+				break
+			}
+		}
+		kept = append(kept[:at:at], append([]PreSharedKey{psk}, kept[at:]...)...)
+	}
+
+	// Drop the oldest tickets if there are too many
+	trimmed := []PreSharedKey{}
+	tickets := 0
+	for _, psk := range kept {
+		if psk.IsResumption {
+			if tickets == maxTicketsPerServer {
+				continue
+			}
+			tickets++
+		}
+		trimmed = append(trimmed, psk)
+	}
+	cache.set(key, trimmed)
+}
+
+func hasPSK(psks []PreSharedKey, identity []byte) bool {
+	for _, psk := range psks {
+		if bytes.Equal(psk.Identity, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cache *PSKListCache) set(key string, psks []PreSharedKey) {
+	if len(psks) == 0 {
+		delete(*cache, key)
+	} else {
+		(*cache)[key] = psks
+	}
+}
+
+// ClientHelloInfo contains information from a ClientHello, for use by the
+// GetCertificate callback.
+type ClientHelloInfo struct {
+	ServerName       string            // SNI value, or empty if none was sent
+	SignatureSchemes []SignatureScheme // signature schemes the client supports
+	SupportedProtos  []string          // ALPN protocols offered by the client
+}
+
+// AppExtensionHandler lets an application send and receive extensions that
+// mint does not process itself.  Send is called with the extensions of each
+// outgoing ClientHello or EncryptedExtensions message, and Receive with those
+// of each incoming one.  Returning an Alert aborts the handshake with that
+// alert; any other error aborts it with a generic one.
+type AppExtensionHandler interface {
+	Send(hs HandshakeType, el *ExtensionList) error
+	Receive(hs HandshakeType, el *ExtensionList) error
+}
+
 // Config is the struct used to pass configuration settings to a TLS client or
 // server instance.  The settings for client and server are pretty different,
 // but we just throw them all in here.
 type Config struct {
 	// Client fields
-	ServerName string
+	ServerName     string
+	KeyShareGroups []NamedGroup   // Groups to send key shares for; defaults to Groups
+	RootCAs        *x509.CertPool // Roots for server certificates; nil means the system roots
 
 	// Server fields
 	SendSessionTickets bool
-	TicketLifetime     uint32
+	TicketLifetime     uint32 // In seconds; clients discard tickets after this, so zero means one day
 	TicketLen          int
-	EarlyDataLifetime  uint32
+	MaxEarlyDataSize   uint32 // Advertised in tickets, and limits early data without one; zero means 16 KiB
 	AllowEarlyData     bool
 	RequireCookie      bool
+	CookieKey          []byte // MAC key for stateless HelloRetryRequest cookies
 	RequireClientAuth  bool
+	ClientCAs          *x509.CertPool // Roots for client certificates; nil means the system roots
+
+	// SessionTicketKeys are used to encrypt the resumption state into session
+	// tickets, so that any server with the same keys can resume a session
+	// without storing anything.  The first key encrypts new tickets, and all
+	// of them are tried for decryption, so keys can be rotated by adding new
+	// ones at the front.  If empty, tickets are stored in PSKs instead.
+	SessionTicketKeys [][32]byte
+
+	// AntiReplay decides whether early data can be accepted, so that it is
+	// not accepted again when a ClientHello is replayed.  If nil, early data
+	// is only checked for freshness, with FreshTickets.  See
+	// NewSingleUseTickets and NewClientHelloRecorder.
+	AntiReplay AntiReplay
+
+	// GetCertificate returns a certificate for a ClientHello.  If it returns
+	// nil, then a certificate is selected from Certificates instead.
+	GetCertificate func(*ClientHelloInfo) (*Certificate, error)
+
+	// Listener fields
+	HandshakeTimeout        time.Duration // Zero means no timeout
+	MaxConcurrentHandshakes int           // Zero means the default limit
+	DeferHandshake          bool          // Accept returns before the handshake
 
 	// Shared fields
-	Certificates     []*Certificate
-	AuthCertificate  func(chain []CertificateEntry) error
-	CipherSuites     []CipherSuite
-	Groups           []NamedGroup
-	SignatureSchemes []SignatureScheme
-	NextProtos       []string
-	PSKs             PreSharedKeyCache
-	PSKModes         []PSKKeyExchangeMode
-	NonBlocking      bool
+	SupportedVersions []uint16
+	Certificates      []*Certificate
+	AuthCertificate   func(chain []CertificateEntry) error // Called after the chain is verified
+	CipherSuites      []CipherSuite
+	Groups            []NamedGroup
+	SignatureSchemes  []SignatureScheme
+	NextProtos        []string
+	PSKs              PreSharedKeyCache
+	PSKModes          []PSKKeyExchangeMode
+	NonBlocking       bool
+	ExtensionHandler  AppExtensionHandler
+
+	// KeyUpdateRecords and KeyUpdateBytes limit how many records, and how many
+	// bytes of data, are sent with a key before it is updated automatically
+	// with a KeyUpdate message.  Records are always limited to what the cipher
+	// suite can safely protect, e.g., 2^24.5 for AES-GCM (RFC 8446, Section
+	// 5.5), and by the sequence number, so KeyUpdateRecords only has an effect
+	// if it is lower.  Zero means no further limit.
+	KeyUpdateRecords uint64
+	KeyUpdateBytes   uint64
+
+	// KeyLogWriter receives the connection's secrets in the NSS key log
+	// format, for decrypting captures with tools like Wireshark.  Using it
+	// compromises security, so it should only be set for debugging.
+	KeyLogWriter io.Writer
+
+	// Skip verification of the peer's certificate chain and name.  This should
+	// only be used for testing.
+	InsecureSkipVerify bool
 
 	// The same config object can be shared among different connections, so it
 	// needs its own mutex
@@ -88,27 +312,59 @@ func (c *Config) Init(isClient bool) error {
 	defer c.mutex.Unlock()
 
 	// Set defaults
+	if len(c.SupportedVersions) == 0 {
+		c.SupportedVersions = defaultSupportedVersions
+	}
+	for _, version := range c.SupportedVersions {
+		isDraft := version >= minDraftVersion && version <= maxDraftVersion
+		if version != supportedVersion && !isDraft {
+			return fmt.Errorf("tls.config: Unsupported version [%04x]", version)
+		}
+	}
 	if len(c.CipherSuites) == 0 {
 		c.CipherSuites = defaultSupportedCipherSuites
 	}
 	if len(c.Groups) == 0 {
 		c.Groups = defaultSupportedGroups
 	}
+	for _, shareGroup := range c.KeyShareGroups {
+		supported := false
+		for _, group := range c.Groups {
+			supported = supported || (group == shareGroup)
+		}
+		if !supported {
+			return fmt.Errorf("tls.config: Key share group not in supported groups [%04x]", shareGroup)
+		}
+	}
 	if len(c.SignatureSchemes) == 0 {
 		c.SignatureSchemes = defaultSignatureSchemes
 	}
+	if len(c.CookieKey) > 0 && len(c.CookieKey) < minCookieKeySize {
+		return fmt.Errorf("tls.config: Cookie key too short [%d]", len(c.CookieKey))
+	}
 	if c.TicketLen == 0 {
 		c.TicketLen = defaultTicketLen
 	}
+	if c.TicketLifetime == 0 {
+		c.TicketLifetime = defaultTicketLifetime
+	}
+	if c.MaxEarlyDataSize == 0 {
+		c.MaxEarlyDataSize = defaultMaxEarlyDataSize
+	}
 	if !reflect.ValueOf(c.PSKs).IsValid() {
-		c.PSKs = &PSKMapCache{}
+		// Clients can keep several tickets for each server
+		if isClient {
+			c.PSKs = &PSKListCache{}
+		} else {
+			c.PSKs = &PSKMapCache{}
+		}
 	}
 	if len(c.PSKModes) == 0 {
 		c.PSKModes = defaultPSKModes
 	}
 
 	// If there is no certificate, generate one
-	if !isClient && len(c.Certificates) == 0 {
+	if !isClient && len(c.Certificates) == 0 && c.GetCertificate == nil {
 		logf(logTypeHandshake, "Generating key name=%v", c.ServerName)
 		priv, err := newSigningKey(RSA_PSS_SHA256)
 		if err != nil {
@@ -131,8 +387,51 @@ func (c *Config) Init(isClient bool) error {
 	return nil
 }
 
+// capabilities returns the negotiation inputs described by the config
+func (c *Config) capabilities() Capabilities {
+	psks := c.PSKs
+	if len(c.SessionTicketKeys) > 0 {
+		psks = ticketPSKCache{PreSharedKeyCache: c.PSKs, keys: c.SessionTicketKeys}
+	}
+
+	return Capabilities{
+		SupportedVersions:  c.SupportedVersions,
+		CipherSuites:       c.CipherSuites,
+		Groups:             c.Groups,
+		SignatureSchemes:   c.SignatureSchemes,
+		PSKs:               psks,
+		PSKModes:           c.PSKModes,
+		RootCAs:            c.RootCAs,
+		ClientCAs:          c.ClientCAs,
+		AuthCertificate:    c.AuthCertificate,
+		ExtensionHandler:   c.ExtensionHandler,
+		KeyLogWriter:       c.KeyLogWriter,
+		GetCertificate:     c.GetCertificate,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		KeyShareGroups:     c.KeyShareGroups,
+		AllowEarlyData:     c.AllowEarlyData,
+		MaxEarlyDataSize:   c.MaxEarlyDataSize,
+		AntiReplay:         c.AntiReplay,
+		RequireCookie:      c.RequireCookie,
+		CookieKey:          c.CookieKey,
+		RequireClientAuth:  c.RequireClientAuth,
+		NextProtos:         c.NextProtos,
+		Certificates:       c.Certificates,
+	}
+}
+
+// ticketMaxEarlyDataSize returns the max_early_data_size to advertise in
+// session tickets, or zero if early data is not allowed
+func (c *Config) ticketMaxEarlyDataSize() uint32 {
+	if !c.AllowEarlyData {
+		return 0
+	}
+	return c.MaxEarlyDataSize
+}
+
 func (c Config) ValidForServer() bool {
 	return (reflect.ValueOf(c.PSKs).IsValid() && c.PSKs.Size() > 0) ||
+		c.GetCertificate != nil ||
 		(len(c.Certificates) > 0 &&
 			len(c.Certificates[0].Chain) > 0 &&
 			c.Certificates[0].PrivateKey != nil)
@@ -143,9 +442,15 @@ func (c Config) ValidForClient() bool {
 }
 
 var (
+	defaultSupportedVersions = []uint16{supportedVersion}
+
 	defaultSupportedCipherSuites = []CipherSuite{
 		TLS_AES_128_GCM_SHA256,
 		TLS_AES_256_GCM_SHA384,
+		TLS_CHACHA20_POLY1305_SHA256,
+		TLS_AES_128_CCM_SHA256,
+		// TLS_AES_128_CCM_8_SHA256 has a truncated tag and is not recommended
+		// for general use, so it has to be configured explicitly
 	}
 
 	defaultSupportedGroups = []NamedGroup{
@@ -162,9 +467,17 @@ var (
 		ECDSA_P256_SHA256,
 		ECDSA_P384_SHA384,
 		ECDSA_P521_SHA512,
+		Ed25519,
+		// Ed448 certificates cannot be verified by crypto/x509, so Ed448 has
+		// to be configured explicitly
 	}
 
-	defaultTicketLen = 16
+	defaultTicketLen             = 16
+	defaultTicketLifetime uint32 = 24 * 60 * 60 // One day
+
+	defaultMaxEarlyDataSize uint32 = 1 << 14
+
+	defaultMaxConcurrentHandshakes = 64
 
 	defaultPSKModes = []PSKKeyExchangeMode{
 		PSKModeKE,
@@ -173,27 +486,67 @@ var (
 )
 
 type ConnectionState struct {
-	HandshakeState   string              // string representation of the handshake state.
-	CipherSuite      CipherSuiteParams   // cipher suite in use (TLS_RSA_WITH_RC4_128_SHA, ...)
-	PeerCertificates []*x509.Certificate // certificate chain presented by remote peer TODO(ekr@rtfm.com): implement
-	NextProto        string              // Selected ALPN proto
+	HandshakeState   string                // string representation of the handshake state.
+	Version          uint16                // TLS version in use
+	CipherSuite      CipherSuiteParams     // cipher suite in use (TLS_RSA_WITH_RC4_128_SHA, ...)
+	Group            NamedGroup            // key exchange group, or zero if DH was not used
+	SignatureScheme  SignatureScheme       // server signature scheme, or zero if a PSK was used
+	PeerCertificates []*x509.Certificate   // certificate chain presented by remote peer
+	VerifiedChains   [][]*x509.Certificate // verified chains built from PeerCertificates
+	ServerName       string                // server name requested by the client
+	NextProto        string                // Selected ALPN proto
+	UsingPSK         bool                  // a PSK was used to authenticate the handshake
+	DidResume        bool                  // the PSK was a resumption ticket
+	UsingEarlyData   bool                  // the server accepted 0-RTT data
+	UsingClientAuth  bool                  // the client was asked for a certificate
 }
 
 // Conn implements the net.Conn interface, as with "crypto/tls"
 // * Read, Write, and Close are provided locally
 // * LocalAddr, RemoteAddr, and Set*Deadline are forwarded to the inner Conn
+//
+// Once the handshake is complete, one goroutine can read while another
+// writes.  The in lock is held while reading, and the out lock while writing.
+// Post-handshake messages are read with in held, but can change the outbound
+// keys or need a response, so they are processed with out held as well.  The
+// connected state is only changed with out and stateMutex held, so that it
+// stays in step with the outbound keys.  Locks are taken in the order
+// handshakeMutex, in, out, stateMutex.
 type Conn struct {
-	config   *Config
-	conn     net.Conn
-	isClient bool
+	config      *Config
+	conn        net.Conn
+	isClient    bool
+	nonblocking bool
 
 	EarlyData []byte
 
 	state             StateConnected
+	stateMutex        sync.Mutex
 	hState            HandshakeState
 	handshakeMutex    sync.Mutex
-	handshakeAlert    Alert
-	handshakeComplete bool
+	handshakeErr      error
+	handshakeComplete uint32 // set atomically, since Close can run concurrently
+
+	// Set when the peer's certificates fail verification, so that the
+	// verification error can be returned instead of the alert it causes
+	verifyErr error
+
+	// Early data that still needs to be consumed before the next handshake
+	// message.  These are set by handshake actions and cleared by
+	// consumeEarlyData, so that reading early data can be resumed.
+	skipEarlyData    bool
+	readingEarlyData bool
+	earlyDataSize    int
+	maxEarlyDataSize int // zero means no limit
+
+	closeNotifySent     bool // Guarded by out
+	closeNotifyReceived bool // Guarded by in
+
+	// Deadlines set with the Set*Deadline methods, which HandshakeContext
+	// restores after interrupting the handshake
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 
 	readBuffer []byte
 	in, out    *RecordLayer
@@ -201,11 +554,11 @@ type Conn struct {
 }
 
 func NewConn(conn net.Conn, config *Config, isClient bool) *Conn {
-	c := &Conn{conn: conn, config: config, isClient: isClient}
+	c := &Conn{conn: conn, config: config, isClient: isClient, nonblocking: config.NonBlocking}
 	c.in = NewRecordLayer(c.conn)
 	c.out = NewRecordLayer(c.conn)
 	c.hIn = NewHandshakeLayer(c.in)
-	c.hIn.nonblocking = c.config.NonBlocking
+	c.hIn.nonblocking = c.nonblocking
 	c.hOut = NewHandshakeLayer(c.out)
 	return c
 }
@@ -213,61 +566,47 @@ func NewConn(conn net.Conn, config *Config, isClient bool) *Conn {
 // Read up
 func (c *Conn) consumeRecord() error {
 	pt, err := c.in.ReadRecord()
+	if _, ok := err.(UnexpectedRecordError); ok {
+		logf(logTypeIO, "Unexpected record: %v", err)
+		return c.abort(AlertUnexpectedMessage)
+	}
 	if pt == nil {
 		logf(logTypeIO, "extendBuffer returns error %v", err)
+
+		// The peer is required to send close_notify before closing the
+		// connection, so an EOF before that means the data was truncated.
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
 		return err
 	}
 
 	switch pt.contentType {
 	case RecordTypeHandshake:
 		logf(logTypeHandshake, "Received post-handshake message")
-		// We do not support fragmentation of post-handshake handshake messages.
-		// TODO: Factor this more elegantly; coalesce with handshakeLayer.ReadMessage()
-		start := 0
-		for start < len(pt.fragment) {
-			if len(pt.fragment[start:]) < handshakeHeaderLen {
-				return fmt.Errorf("Post-handshake handshake message too short for header")
-			}
-
-			hm := &HandshakeMessage{}
-			hm.msgType = HandshakeType(pt.fragment[start])
-			hmLen := (int(pt.fragment[start+1]) << 16) + (int(pt.fragment[start+2]) << 8) + int(pt.fragment[start+3])
-
-			if len(pt.fragment[start+handshakeHeaderLen:]) < hmLen {
-				return fmt.Errorf("Post-handshake handshake message too short for body")
+		// Handshake messages can span records, so they are reassembled by the
+		// handshake layer, which buffers any partial message until its next
+		// record arrives
+		c.hIn.handleRecord(pt.fragment)
+		for {
+			hm, err := c.hIn.readBufferedMessage()
+			if err == WouldBlock {
+				break
 			}
-			hm.body = pt.fragment[start+handshakeHeaderLen : start+handshakeHeaderLen+hmLen]
-
-			// Advance state machine
-			state, actions, alert := c.state.Next(hm)
-
-			if alert != AlertNoAlert {
-				logf(logTypeHandshake, "Error in state transition: %v", alert)
-				c.sendAlert(alert)
-				return io.EOF
+			if err != nil {
+				return c.abort(AlertDecodeError)
 			}
 
-			for _, action := range actions {
-				alert = c.takeAction(action)
-				if alert != AlertNoAlert {
-					logf(logTypeHandshake, "Error during handshake actions: %v", alert)
-					c.sendAlert(alert)
-					return io.EOF
-				}
+			// A KeyUpdate changes the inbound keys, so it must end its record
+			if hm.msgType == HandshakeTypeKeyUpdate && c.hIn.partialMessage() {
+				logf(logTypeHandshake, "KeyUpdate does not end its record")
+				return c.abort(AlertUnexpectedMessage)
 			}
 
-			// XXX: If we want to support more advanced cases, e.g., post-handshake
-			// authentication, we'll need to allow transitions other than
-			// Connected -> Connected
-			var connected bool
-			c.state, connected = state.(StateConnected)
-			if !connected {
-				logf(logTypeHandshake, "Disconnected after state transition: %v", alert)
-				c.sendAlert(alert)
-				return io.EOF
+			alert := c.handlePostHandshakeMessage(hm)
+			if alert != AlertNoAlert {
+				return c.abort(alert)
 			}
-
-			start += handshakeHeaderLen + hmLen
 		}
 	case RecordTypeAlert:
 		logf(logTypeIO, "extended buffer (for alert): [%d] %x", len(c.readBuffer), c.readBuffer)
@@ -276,6 +615,8 @@ func (c *Conn) consumeRecord() error {
 			return io.EOF
 		}
 		if Alert(pt.fragment[1]) == AlertCloseNotify {
+			logf(logTypeIO, "Received close_notify")
+			c.closeNotifyReceived = true
 			return io.EOF
 		}
 
@@ -283,13 +624,19 @@ func (c *Conn) consumeRecord() error {
 		case AlertLevelWarning:
 			// drop on the floor
 		case AlertLevelError:
-			return Alert(pt.fragment[1])
+			return AlertError{Alert: Alert(pt.fragment[1]), Remote: true}
 		default:
 			c.sendAlert(AlertUnexpectedMessage)
 			return io.EOF
 		}
 
 	case RecordTypeApplicationData:
+		// Handshake messages cannot be interleaved with other records
+		if c.hIn.partialMessage() {
+			logf(logTypeHandshake, "Application data inside a handshake message")
+			return c.abort(AlertUnexpectedMessage)
+		}
+
 		c.readBuffer = append(c.readBuffer, pt.fragment...)
 		logf(logTypeIO, "extended buffer: [%d] %x", len(c.readBuffer), c.readBuffer)
 	}
@@ -297,12 +644,53 @@ func (c *Conn) consumeRecord() error {
 	return err
 }
 
+// handlePostHandshakeMessage advances the connected state with a handshake
+// message received after the handshake, and takes the resulting actions.
+// The in lock must be held.
+func (c *Conn) handlePostHandshakeMessage(hm *HandshakeMessage) Alert {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	c.stateMutex.Lock()
+	state, actions, alert := c.state.Next(hm)
+	if alert == AlertNoAlert {
+		// Post-handshake messages, including those for post-handshake
+		// authentication, are all handled in the connected state
+		var connected bool
+		c.state, connected = state.(StateConnected)
+		if !connected {
+			logf(logTypeHandshake, "Disconnected after state transition")
+			alert = AlertInternalError
+		}
+	}
+	c.stateMutex.Unlock()
+
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "Error in state transition: %v", alert)
+		return alert
+	}
+
+	for _, action := range actions {
+		alert = c.takeAction(action)
+		if alert != AlertNoAlert {
+			logf(logTypeHandshake, "Error during handshake actions: %v", alert)
+			return alert
+		}
+	}
+
+	return AlertNoAlert
+}
+
 // Read application data up to the size of buffer.  Handshake and alert records
 // are consumed by the Conn object directly.
+//
+// Once the peer has sent close_notify, Read returns io.EOF.  If the underlying
+// connection is closed without a close_notify, Read returns
+// io.ErrUnexpectedEOF, since the data may have been truncated.
 func (c *Conn) Read(buffer []byte) (int, error) {
 	logf(logTypeHandshake, "conn.Read with buffer = %d", len(buffer))
-	if alert := c.Handshake(); alert != AlertNoAlert {
-		return 0, alert
+	if err := c.Handshake(); err != nil {
+		return 0, err
 	}
 
 	if len(buffer) == 0 {
@@ -312,13 +700,17 @@ func (c *Conn) Read(buffer []byte) (int, error) {
 	// Lock the input channel
 	c.in.Lock()
 	defer c.in.Unlock()
+	if len(c.readBuffer) == 0 && c.closeNotifyReceived {
+		return 0, io.EOF
+	}
+
 	for len(c.readBuffer) == 0 {
 		err := c.consumeRecord()
 
 		// err can be nil if consumeRecord processed a non app-data
 		// record.
 		if err != nil {
-			if c.config.NonBlocking || err != WouldBlock {
+			if c.nonblocking || err != WouldBlock {
 				logf(logTypeIO, "conn.Read returns err=%v", err)
 				return 0, err
 			}
@@ -344,16 +736,33 @@ func (c *Conn) Read(buffer []byte) (int, error) {
 	return read, nil
 }
 
-// Write application data
+// Write application data.  If the handshake has not yet been done, Write
+// performs it first.
 func (c *Conn) Write(buffer []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.write(buffer)
+}
+
+func (c *Conn) write(buffer []byte) (int, error) {
 	// Lock the output channel
 	c.out.Lock()
 	defer c.out.Unlock()
 
+	if c.closeNotifySent {
+		return 0, fmt.Errorf("Cannot write after close_notify has been sent")
+	}
+
 	// Send full-size fragments
 	var start int
 	sent := 0
 	for start = 0; len(buffer)-start >= maxFragmentLen; start += maxFragmentLen {
+		if err := c.updateKeysIfDue(); err != nil {
+			return sent, err
+		}
+
 		err := c.out.WriteRecord(&TLSPlaintext{
 			contentType: RecordTypeApplicationData,
 			fragment:    buffer[start : start+maxFragmentLen],
@@ -367,6 +776,10 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 
 	// Send a final partial fragment if necessary
 	if start < len(buffer) {
+		if err := c.updateKeysIfDue(); err != nil {
+			return sent, err
+		}
+
 		err := c.out.WriteRecord(&TLSPlaintext{
 			contentType: RecordTypeApplicationData,
 			fragment:    buffer[start:],
@@ -381,38 +794,109 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 }
 
 // sendAlert sends a TLS alert message.
-// c.out.Mutex <= L.
 func (c *Conn) sendAlert(err Alert) error {
-	c.handshakeMutex.Lock()
-	defer c.handshakeMutex.Unlock()
+	c.out.Lock()
+	defer c.out.Unlock()
 
 	var level int
 	switch err {
-	case AlertNoRenegotiation, AlertCloseNotify:
+	case AlertNoRenegotiation, AlertCloseNotify, AlertUserCanceled:
 		level = AlertLevelWarning
 	default:
 		level = AlertLevelError
 	}
 
-	buf := []byte{byte(err), byte(level)}
+	buf := []byte{byte(level), byte(err)}
 	c.out.WriteRecord(&TLSPlaintext{
 		contentType: RecordTypeAlert,
 		fragment:    buf,
 	})
 
-	// close_notify and end_of_early_data are not actually errors
+	if err == AlertCloseNotify {
+		c.closeNotifySent = true
+	}
+
+	// close_notify, user_canceled, and end_of_early_data are not actually errors
 	if level == AlertLevelWarning {
 		return &net.OpError{Op: "local error", Err: err}
 	}
 
-	return c.Close()
+	// The out lock is held, so we can't go through Close here
+	return c.conn.Close()
+}
+
+// abort sends a fatal alert to the peer and returns the error that the
+// connection failed with.
+func (c *Conn) abort(alert Alert) error {
+	c.sendAlert(alert)
+	return c.alertError(alert)
+}
+
+// alertError returns the error for a local alert.  If the alert was caused by
+// the peer's certificates failing verification, that is the verification
+// error, and otherwise it is an AlertError.
+func (c *Conn) alertError(alert Alert) error {
+	if c.verifyErr != nil {
+		return c.verifyErr
+	}
+	return AlertError{Alert: alert}
+}
+
+// sendCloseNotify sends a close_notify alert, unless one has already been sent.
+func (c *Conn) sendCloseNotify() error {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.closeNotifySent {
+		return nil
+	}
+
+	c.closeNotifySent = true
+	return c.out.WriteRecord(&TLSPlaintext{
+		contentType: RecordTypeAlert,
+		fragment:    []byte{AlertLevelWarning, byte(AlertCloseNotify)},
+	})
+}
+
+// isHandshakeComplete reports whether the handshake has completed.  It can be
+// called without handshakeMutex, e.g., by Close while Read is handshaking.
+func (c *Conn) isHandshakeComplete() bool {
+	return atomic.LoadUint32(&c.handshakeComplete) == 1
 }
 
-// Close closes the connection.
+// Close sends a close_notify alert, if the handshake has completed, and then
+// closes the underlying connection.
 func (c *Conn) Close() error {
-	// XXX crypto/tls has an interlock with Write here.  Do we need that?
+	var alertErr error
+	if c.isHandshakeComplete() {
+		alertErr = c.sendCloseNotify()
+	}
 
-	return c.conn.Close()
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+// CloseWrite shuts down the writing side of the connection.  It sends a
+// close_notify alert and, if the underlying connection supports it (as
+// *net.TCPConn does), half-closes it.  The connection can still be read
+// until the peer sends its own close_notify.
+func (c *Conn) CloseWrite() error {
+	if !c.isHandshakeComplete() {
+		return fmt.Errorf("Cannot close for writing before handshake")
+	}
+
+	if err := c.sendCloseNotify(); err != nil {
+		return err
+	}
+
+	if cw, ok := c.conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
 }
 
 // LocalAddr returns the local network address.
@@ -429,12 +913,18 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means Read and Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
 	return c.conn.SetDeadline(t)
 }
 
 // SetReadDeadline sets the read deadline on the underlying connection.
 // A zero value for t means Read will not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
 	return c.conn.SetReadDeadline(t)
 }
 
@@ -442,9 +932,21 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetWriteDeadline(t)
 }
 
+// restoreDeadlines puts back the deadlines last set with the Set*Deadline
+// methods
+func (c *Conn) restoreDeadlines() {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.conn.SetReadDeadline(c.readDeadline)
+	c.conn.SetWriteDeadline(c.writeDeadline)
+}
+
 func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 	label := "[server]"
 	if c.isClient {
@@ -477,7 +979,7 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 
 	case SendEarlyData:
 		logf(logTypeHandshake, "%s Sending early data...", label)
-		_, err := c.Write(c.EarlyData)
+		_, err := c.write(c.EarlyData)
 		if err != nil {
 			logf(logTypeHandshake, "%s Error writing early data: %v", label, err)
 			return AlertInternalError
@@ -485,51 +987,13 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 
 	case ReadPastEarlyData:
 		logf(logTypeHandshake, "%s Reading past early data...", label)
-		// Scan past all records that fail to decrypt
-		_, err := c.in.PeekRecordType(!c.config.NonBlocking)
-		if err == nil {
-			break
-		}
-		_, ok := err.(DecryptError)
-
-		for ok {
-			_, err = c.in.PeekRecordType(!c.config.NonBlocking)
-			if err == nil {
-				break
-			}
-			_, ok = err.(DecryptError)
-		}
+		c.skipEarlyData = true
+		c.maxEarlyDataSize = int(action.MaxSize)
 
 	case ReadEarlyData:
 		logf(logTypeHandshake, "%s Reading early data...", label)
-		t, err := c.in.PeekRecordType(!c.config.NonBlocking)
-		if err != nil {
-			logf(logTypeHandshake, "%s Error reading record type (1): %v", label, err)
-			return AlertInternalError
-		}
-		logf(logTypeHandshake, "%s Got record type(1): %v", label, t)
-
-		for t == RecordTypeApplicationData {
-			// Read a record into the buffer. Note that this is safe
-			// in blocking mode because we read the record in in
-			// PeekRecordType.
-			pt, err := c.in.ReadRecord()
-			if err != nil {
-				logf(logTypeHandshake, "%s Error reading early data record: %v", label, err)
-				return AlertInternalError
-			}
-
-			logf(logTypeHandshake, "%s Read early data: %x", label, pt.fragment)
-			c.EarlyData = append(c.EarlyData, pt.fragment...)
-
-			t, err = c.in.PeekRecordType(!c.config.NonBlocking)
-			if err != nil {
-				logf(logTypeHandshake, "%s Error reading record type (2): %v", label, err)
-				return AlertInternalError
-			}
-			logf(logTypeHandshake, "%s Got record type (2): %v", label, t)
-		}
-		logf(logTypeHandshake, "%s Done reading early data", label)
+		c.readingEarlyData = true
+		c.maxEarlyDataSize = int(action.MaxSize)
 
 	case StorePSK:
 		logf(logTypeHandshake, "%s Storing new session ticket with identity [%x]", label, action.PSK.Identity)
@@ -549,29 +1013,147 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 	return AlertNoAlert
 }
 
-func (c *Conn) HandshakeSetup() Alert {
+// consumeEarlyData reads any early data that precedes the next handshake
+// message.  Rejected early data fails to decrypt and is skipped; accepted early
+// data is appended to EarlyData.  Either way, if the client sends more than the
+// PSK allows, the unexpected_message alert is returned.  In non-blocking mode,
+// WouldBlock is returned if more data is needed, and a later call picks up
+// where this one left off.
+func (c *Conn) consumeEarlyData() error {
+	for c.skipEarlyData {
+		_, err := c.in.PeekRecordType(!c.nonblocking)
+		if err == nil {
+			c.skipEarlyData = false
+			break
+		}
+		if _, ok := err.(DecryptError); !ok {
+			return err
+		}
+
+		skipped := c.in.droppedBytes
+		if c.maxEarlyDataSize > 0 && skipped > c.maxEarlyDataSize {
+			logf(logTypeHandshake, "Skipped early data exceeds the maximum size [%d] > [%d]", skipped, c.maxEarlyDataSize)
+			return AlertUnexpectedMessage
+		}
+	}
+
+	for c.readingEarlyData {
+		err := c.readEarlyDataRecord()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readEarlyDataRecord reads the next early data record and appends it to
+// EarlyData, or clears readingEarlyData if the client has finished sending
+// early data.  If the client has sent more than the PSK allows, the
+// unexpected_message alert is returned.
+func (c *Conn) readEarlyDataRecord() error {
+	t, err := c.in.PeekRecordType(!c.nonblocking)
+	if err != nil {
+		return err
+	}
+	logf(logTypeHandshake, "Got record type: %v", t)
+
+	if t != RecordTypeApplicationData {
+		logf(logTypeHandshake, "Done reading early data")
+		c.readingEarlyData = false
+		return nil
+	}
+
+	// This does not block, since PeekRecordType cached the record
+	pt, err := c.in.ReadRecord()
+	if err != nil {
+		return err
+	}
+
+	c.earlyDataSize += len(pt.fragment)
+	if c.maxEarlyDataSize > 0 && c.earlyDataSize > c.maxEarlyDataSize {
+		logf(logTypeHandshake, "Early data exceeds the maximum size [%d] > [%d]", c.earlyDataSize, c.maxEarlyDataSize)
+		return AlertUnexpectedMessage
+	}
+
+	logf(logTypeHandshake, "Read early data: %x", pt.fragment)
+	c.EarlyData = append(c.EarlyData, pt.fragment...)
+	return nil
+}
+
+// ReadEarlyData reads 0-RTT data from the client as it arrives, before the
+// handshake has completed.  It is only used on servers.
+//
+// Early data is not protected against replay the way data read with Read is,
+// so it should only be used for requests that are safe to repeat.  Once the
+// client has finished sending early data, or if there was none or it was
+// rejected, ReadEarlyData returns io.EOF, and the handshake can be completed
+// by calling Handshake or Read.  Any early data that Handshake has already
+// read into EarlyData is returned first.
+func (c *Conn) ReadEarlyData(buffer []byte) (int, error) {
+	if c.isClient {
+		return 0, fmt.Errorf("tls.earlydata: Only servers read early data")
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.handshakeErr != nil {
+		return 0, c.handshakeErr
+	}
+	if c.hState == nil {
+		logf(logTypeHandshake, "[server] First time through handshake, setting up")
+		if err := c.HandshakeSetup(); err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		if len(c.EarlyData) > 0 {
+			n := copy(buffer, c.EarlyData)
+			c.EarlyData = c.EarlyData[n:]
+			return n, nil
+		}
+
+		if c.readingEarlyData {
+			err := c.readEarlyDataRecord()
+			if alert, ok := err.(Alert); ok {
+				err = c.abort(alert)
+				c.handshakeErr = err
+			}
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		// Early data can only start with the ClientHello, so once the
+		// server is past that point, there is no more to come
+		if _, ok := c.hState.(ServerStateStart); !ok {
+			return 0, io.EOF
+		}
+
+		if err := c.handshakeStep("[server]"); err != nil {
+			if err != WouldBlock {
+				c.handshakeErr = err
+			}
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) HandshakeSetup() error {
 	var state HandshakeState
 	var actions []HandshakeAction
 	var alert Alert
 
 	if err := c.config.Init(c.isClient); err != nil {
 		logf(logTypeHandshake, "Error initializing config: %v", err)
-		return AlertInternalError
+		return err
 	}
 
 	// Set things up
-	caps := Capabilities{
-		CipherSuites:      c.config.CipherSuites,
-		Groups:            c.config.Groups,
-		SignatureSchemes:  c.config.SignatureSchemes,
-		PSKs:              c.config.PSKs,
-		PSKModes:          c.config.PSKModes,
-		AllowEarlyData:    c.config.AllowEarlyData,
-		RequireCookie:     c.config.RequireCookie,
-		RequireClientAuth: c.config.RequireClientAuth,
-		NextProtos:        c.config.NextProtos,
-		Certificates:      c.config.Certificates,
-	}
+	caps := c.capabilities()
 	opts := ConnectionOptions{
 		ServerName: c.config.ServerName,
 		NextProtos: c.config.NextProtos,
@@ -579,17 +1161,23 @@ func (c *Conn) HandshakeSetup() Alert {
 	}
 
 	if c.isClient {
-		state, actions, alert = ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
+		// The server may send change_cipher_spec once it has the ClientHello
+		c.in.allowChangeCipherSpec = true
+
+		// Tickets that don't make it into the ClientHello can be used again
+		psks := pskOffers(caps.PSKs, opts.ServerName)
+		state, actions, alert = ClientStateStart{Caps: caps, Opts: opts, offeredPSKs: psks, havePSKs: true}.Next(nil)
+		putBackUnsentPSKs(caps.PSKs, opts.ServerName, psks, state)
 		if alert != AlertNoAlert {
 			logf(logTypeHandshake, "Error initializing client state: %v", alert)
-			return alert
+			return AlertError{Alert: alert}
 		}
 
 		for _, action := range actions {
 			alert = c.takeAction(action)
 			if alert != AlertNoAlert {
 				logf(logTypeHandshake, "Error during handshake actions: %v", alert)
-				return alert
+				return AlertError{Alert: alert}
 			}
 		}
 	} else {
@@ -598,107 +1186,217 @@ func (c *Conn) HandshakeSetup() Alert {
 
 	c.hState = state
 
-	return AlertNoAlert
+	return nil
+}
+
+// capabilities returns the capabilities of the connection's configuration,
+// arranging for certificate verification errors to be recorded
+func (c *Conn) capabilities() Capabilities {
+	caps := c.config.capabilities()
+	caps.reportVerifyError = func(err error) {
+		c.verifyErr = err
+	}
+	return caps
 }
 
 // Handshake causes a TLS handshake on the connection.  The `isClient` member
 // determines whether a client or server handshake is performed.  If a
 // handshake has already been performed, then its result will be returned.
-func (c *Conn) Handshake() Alert {
-	label := "[server]"
-	if c.isClient {
-		label = "[client]"
+//
+// If the handshake fails because of an alert, the error is an AlertError,
+// unless the peer's certificates were rejected, in which case it is a
+// CertificateVerificationError.  Errors from the underlying connection are
+// returned as they are.  In non-blocking mode, WouldBlock is returned until
+// the handshake can be completed.
+func (c *Conn) Handshake() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.handshakeErr != nil {
+		logf(logTypeHandshake, "Pre-existing handshake error: %v", c.handshakeErr)
+		return c.handshakeErr
+	}
+	if c.isHandshakeComplete() {
+		return nil
 	}
 
-	// TODO Lock handshakeMutex
-	// TODO Remove CloseNotify hack
-	if c.handshakeAlert != AlertNoAlert && c.handshakeAlert != AlertCloseNotify {
-		logf(logTypeHandshake, "Pre-existing handshake error: %v", c.handshakeAlert)
-		return c.handshakeAlert
+	err := c.handshake()
+	if err != nil && err != WouldBlock {
+		c.handshakeErr = err
 	}
-	if c.handshakeComplete {
-		return AlertNoAlert
+	return err
+}
+
+func (c *Conn) handshake() error {
+	label := "[server]"
+	if c.isClient {
+		label = "[client]"
 	}
 
-	var alert Alert
 	if c.hState == nil {
 		logf(logTypeHandshake, "%s First time through handshake, setting up", label)
-		alert = c.HandshakeSetup()
-		if alert != AlertNoAlert {
-			return alert
+		if err := c.HandshakeSetup(); err != nil {
+			return err
 		}
 	} else {
 		logf(logTypeHandshake, "Re-entering handshake, state=%v", c.hState)
 	}
 
-	state := c.hState
-	_, connected := state.(StateConnected)
-
-	var actions []HandshakeAction
-
+	_, connected := c.hState.(StateConnected)
 	for !connected {
-		// Read a handshake message
-		hm, err := c.hIn.ReadMessage()
-		if err == WouldBlock {
-			logf(logTypeHandshake, "%s Would block reading message: %v", label, err)
-			return AlertWouldBlock
-		}
-		if err != nil {
-			logf(logTypeHandshake, "%s Error reading message: %v", label, err)
-			c.sendAlert(AlertCloseNotify)
-			return AlertCloseNotify
-		}
-		logf(logTypeHandshake, "Read message with type: %v", hm.msgType)
-
-		// Advance the state machine
-		state, actions, alert = state.Next(hm)
-
-		if alert != AlertNoAlert {
-			logf(logTypeHandshake, "Error in state transition: %v", alert)
-			return alert
-		}
-
-		for index, action := range actions {
-			logf(logTypeHandshake, "%s taking next action (%d)", label, index)
-			alert = c.takeAction(action)
-			if alert != AlertNoAlert {
-				logf(logTypeHandshake, "Error during handshake actions: %v", alert)
-				c.sendAlert(alert)
-				return alert
-			}
+		if err := c.handshakeStep(label); err != nil {
+			return err
 		}
 
-		c.hState = state
-		logf(logTypeHandshake, "%s state is now %s", c.GetHsState())
-
-		_, connected = state.(StateConnected)
+		_, connected = c.hState.(StateConnected)
 	}
 
-	c.state = state.(StateConnected)
+	c.state = c.hState.(StateConnected)
 
 	// Send NewSessionTicket if acting as server
 	if !c.isClient && c.config.SendSessionTickets {
 		actions, alert := c.state.NewSessionTicket(
 			c.config.TicketLen,
 			c.config.TicketLifetime,
-			c.config.EarlyDataLifetime)
+			c.config.ticketMaxEarlyDataSize(),
+			c.config.SessionTicketKeys)
 
 		for _, action := range actions {
 			alert = c.takeAction(action)
 			if alert != AlertNoAlert {
 				logf(logTypeHandshake, "Error during handshake actions: %v", alert)
-				c.sendAlert(alert)
-				return alert
+				return c.abort(alert)
 			}
 		}
 	}
 
-	c.handshakeComplete = true
-	return AlertNoAlert
+	atomic.StoreUint32(&c.handshakeComplete, 1)
+	return nil
+}
+
+// HandshakeContext performs the handshake like Handshake, but gives up if ctx
+// is done first.  Any I/O that the handshake is blocked on is interrupted by
+// setting a deadline in the past on the underlying connection.  The peer is
+// then sent a user_canceled alert followed by close_notify, the connection is
+// closed, and the context's error is returned.  Otherwise, the result of the
+// handshake is as Handshake would return it, and any deadlines set with the
+// Set*Deadline methods are kept.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		return c.Handshake()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	err := c.Handshake()
+	close(stop)
+	if !<-interrupted {
+		return err
+	}
+
+	// The deadline may have been set just as the handshake finished
+	c.restoreDeadlines()
+	if err == nil {
+		return nil
+	}
+
+	// user_canceled has to be followed by close_notify (RFC 8446, Section 6.1)
+	logf(logTypeHandshake, "Handshake canceled: %v", ctx.Err())
+	c.conn.SetWriteDeadline(time.Now().Add(userCanceledTimeout))
+	c.sendAlert(AlertUserCanceled)
+	c.sendAlert(AlertCloseNotify)
+	c.conn.Close()
+	return ctx.Err()
+}
+
+// handshakeStep consumes any early data, then reads one handshake message and
+// advances the state machine with it.  WouldBlock is returned if more input
+// is needed.
+func (c *Conn) handshakeStep(label string) error {
+	// Consume any early data, then read a handshake message
+	err := c.consumeEarlyData()
+	if err == WouldBlock {
+		logf(logTypeHandshake, "%s Would block reading early data: %v", label, err)
+		return WouldBlock
+	}
+	if alert, ok := err.(Alert); ok {
+		logf(logTypeHandshake, "%s Error reading early data: %v", label, err)
+		return c.abort(alert)
+	}
+	if _, ok := err.(UnexpectedRecordError); ok {
+		logf(logTypeHandshake, "%s Error reading early data: %v", label, err)
+		return c.abort(AlertUnexpectedMessage)
+	}
+	if err != nil {
+		logf(logTypeHandshake, "%s Error reading early data: %v", label, err)
+		return err
+	}
+
+	hm, err := c.hIn.ReadMessage()
+	if err == WouldBlock {
+		logf(logTypeHandshake, "%s Would block reading message: %v", label, err)
+		return WouldBlock
+	}
+	if alert, ok := err.(Alert); ok {
+		logf(logTypeHandshake, "%s Received alert: %v", label, alert)
+		return AlertError{Alert: alert, Remote: true}
+	}
+	if _, ok := err.(UnexpectedRecordError); ok {
+		logf(logTypeHandshake, "%s Error reading message: %v", label, err)
+		return c.abort(AlertUnexpectedMessage)
+	}
+	if err != nil {
+		logf(logTypeHandshake, "%s Error reading message: %v", label, err)
+		c.sendAlert(AlertCloseNotify)
+		return err
+	}
+	logf(logTypeHandshake, "Read message with type: %v", hm.msgType)
+
+	// Middlebox compatibility mode only allows change_cipher_spec records
+	// between the first ClientHello and the peer's Finished
+	switch hm.msgType {
+	case HandshakeTypeClientHello:
+		c.in.allowChangeCipherSpec = true
+	case HandshakeTypeFinished:
+		c.in.allowChangeCipherSpec = false
+	}
+
+	// Advance the state machine
+	state, actions, alert := c.hState.Next(hm)
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "Error in state transition: %v", alert)
+		return c.alertError(alert)
+	}
+
+	for index, action := range actions {
+		logf(logTypeHandshake, "%s taking next action (%d)", label, index)
+		alert = c.takeAction(action)
+		if alert != AlertNoAlert {
+			logf(logTypeHandshake, "Error during handshake actions: %v", alert)
+			return c.abort(alert)
+		}
+	}
+
+	c.hState = state
+	logf(logTypeHandshake, "%s state is now %s", c.GetHsState())
+	return nil
 }
 
 func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
-	if !c.handshakeComplete {
+	if !c.isHandshakeComplete() {
 		return fmt.Errorf("Cannot update keys until after handshake")
 	}
 
@@ -707,10 +1405,20 @@ func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 		request = KeyUpdateRequested
 	}
 
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	return c.updateKeys(request)
+}
+
+// updateKeys sends a KeyUpdate and switches to new outbound keys.  The out
+// lock must be held.
+func (c *Conn) updateKeys(request KeyUpdateRequest) error {
 	// Create the key update and update state
+	c.stateMutex.Lock()
 	actions, alert := c.state.KeyUpdate(request)
+	c.stateMutex.Unlock()
 	if alert != AlertNoAlert {
-		c.sendAlert(alert)
 		return fmt.Errorf("Alert while generating key update: %v", alert)
 	}
 
@@ -718,7 +1426,6 @@ func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 	for _, action := range actions {
 		alert = c.takeAction(action)
 		if alert != AlertNoAlert {
-			c.sendAlert(alert)
 			return fmt.Errorf("Alert during key update actions: %v", alert)
 		}
 	}
@@ -726,16 +1433,148 @@ func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 	return nil
 }
 
+// updateKeysIfDue updates the outbound keys if they have been used enough,
+// according to the cipher suite and the KeyUpdateRecords and KeyUpdateBytes
+// settings, that they should not be used for another record.  The out lock
+// must be held.
+func (c *Conn) updateKeysIfDue() error {
+	if !c.isHandshakeComplete() {
+		return nil
+	}
+
+	maxRecords := c.state.cryptoParams.RecordLimit
+	if maxRecords == 0 {
+		maxRecords = math.MaxUint64
+	}
+	if c.config.KeyUpdateRecords > 0 && c.config.KeyUpdateRecords < maxRecords {
+		maxRecords = c.config.KeyUpdateRecords
+	}
+	maxBytes := c.config.KeyUpdateBytes
+
+	// Leave room for the KeyUpdate itself under the old key
+	due := c.out.records+1 >= maxRecords
+	due = due || (maxBytes > 0 && c.out.bytes >= maxBytes)
+	if !due {
+		return nil
+	}
+
+	logf(logTypeHandshake, "Updating keys after [%d] records and [%d] bytes", c.out.records, c.out.bytes)
+	return c.updateKeys(KeyUpdateNotRequested)
+}
+
+// ClientAuthError is returned by RequestClientCertificate if the client does
+// not authenticate.  If the client declined, by answering without a
+// certificate, Err is nil and the connection can still be used without client
+// authentication.  Otherwise, Err is the reason that authentication failed.
+type ClientAuthError struct {
+	Err error
+}
+
+func (e *ClientAuthError) Error() string {
+	if e.Err == nil {
+		return "tls.postauth: Client did not provide a certificate"
+	}
+	return fmt.Sprintf("tls.postauth: Client authentication failed: %v", e.Err)
+}
+
+func (e *ClientAuthError) Unwrap() error {
+	return e.Err
+}
+
+// RequestClientCertificate asks the client to authenticate with a certificate
+// after the handshake, e.g., before serving a protected resource.  It is only
+// used on servers, and only if the client offered post-handshake
+// authentication, as mint clients do when they have Certificates.  The
+// client's answer is verified as it would be during the handshake.
+//
+// In blocking mode, this waits for the client to answer, buffering any
+// application data that arrives first, and returns a *ClientAuthError if the
+// client does not authenticate.  There is no time limit on the wait other
+// than the read deadline of the connection, so servers that don't trust the
+// client to answer should set one with SetReadDeadline.  In non-blocking
+// mode, it returns once the request is sent, and the answer is processed by
+// later calls to Read.  Either way, the client's certificates then appear in
+// State, and UsingClientAuth stays false if the client declined.
+func (c *Conn) RequestClientCertificate() error {
+	if c.isClient {
+		return fmt.Errorf("tls.postauth: Only servers can request client certificates")
+	}
+	if !c.isHandshakeComplete() {
+		return fmt.Errorf("Cannot request client certificate until after handshake")
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	if !c.state.Params.PostHandshakeAuth {
+		return fmt.Errorf("tls.postauth: Client does not support post-handshake authentication")
+	}
+	if c.state.pendingAuth != nil {
+		return fmt.Errorf("tls.postauth: Client certificate request already outstanding")
+	}
+
+	if alert := c.sendCertificateRequest(); alert != AlertNoAlert {
+		c.sendAlert(alert)
+		return fmt.Errorf("Alert while sending certificate request: %v", alert)
+	}
+
+	if c.nonblocking {
+		return nil
+	}
+
+	for c.state.pendingAuth != nil {
+		err := c.consumeRecord()
+		if err != nil && err != WouldBlock {
+			return &ClientAuthError{Err: err}
+		}
+	}
+
+	c.stateMutex.Lock()
+	declined := c.state.authDeclined
+	c.stateMutex.Unlock()
+	if declined {
+		return &ClientAuthError{}
+	}
+	return nil
+}
+
+// sendCertificateRequest records a new CertificateRequest in the connected
+// state and sends it.  The in lock must be held.
+func (c *Conn) sendCertificateRequest() Alert {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	c.stateMutex.Lock()
+	actions, alert := c.state.CertificateRequest(c.capabilities())
+	c.stateMutex.Unlock()
+	if alert != AlertNoAlert {
+		return alert
+	}
+
+	for _, action := range actions {
+		alert = c.takeAction(action)
+		if alert != AlertNoAlert {
+			return alert
+		}
+	}
+	return AlertNoAlert
+}
+
 func (c *Conn) GetHsState() string {
 	return reflect.TypeOf(c.hState).Name()
 }
 
 func (c *Conn) ComputeExporter(label string, context []byte, keyLength int) ([]byte, error) {
+	c.handshakeMutex.Lock()
 	_, connected := c.hState.(StateConnected)
+	c.handshakeMutex.Unlock()
 	if !connected {
 		return nil, fmt.Errorf("Cannot compute exporter when state is not connected")
 	}
 
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
 	if c.state.exporterSecret == nil {
 		return nil, fmt.Errorf("Internal error: no exporter secret")
 	}
@@ -748,14 +1587,35 @@ func (c *Conn) ComputeExporter(label string, context []byte, keyLength int) ([]b
 }
 
 func (c *Conn) State() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
 	state := ConnectionState{
 		HandshakeState: c.GetHsState(),
 	}
 
-	if c.handshakeComplete {
-		state.CipherSuite = cipherSuiteMap[c.state.Params.CipherSuite]
-		state.NextProto = c.state.Params.NextProto
+	if c.isHandshakeComplete() {
+		c.stateMutex.Lock()
+		c.state.fillConnectionState(&state)
+		c.stateMutex.Unlock()
 	}
 
 	return state
 }
+
+// fillConnectionState copies the negotiated parameters into a ConnectionState
+func (state StateConnected) fillConnectionState(cs *ConnectionState) {
+	params := state.Params
+	cs.Version = params.Version
+	cs.CipherSuite = cipherSuiteMap[params.CipherSuite]
+	cs.Group = params.Group
+	cs.SignatureScheme = params.SignatureScheme
+	cs.PeerCertificates = state.peerCertificates
+	cs.VerifiedChains = state.verifiedChains
+	cs.ServerName = params.ServerName
+	cs.NextProto = params.NextProto
+	cs.UsingPSK = params.UsingPSK
+	cs.DidResume = params.UsingResumption
+	cs.UsingEarlyData = params.UsingEarlyData
+	cs.UsingClientAuth = params.UsingClientAuth
+}
@@ -3,9 +3,14 @@ package mint
 import (
 	"bytes"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -45,9 +50,11 @@ func (p *pipeConn) Read(data []byte) (n int, err error) {
 	n, err = p.r.Read(data)
 	p.rLock.Unlock()
 
-	// Suppress bytes.Buffer's EOF on an empty buffer
+	// Suppress bytes.Buffer's EOF on an empty buffer, and let the other side
+	// run, since callers will poll until data arrives
 	if err == io.EOF {
 		err = nil
+		runtime.Gosched()
 	}
 	return
 }
@@ -197,74 +204,85 @@ var (
 	}
 
 	basicConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       certificates,
 	}
 
 	nbConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
-		NonBlocking:  true,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       certificates,
+		NonBlocking:        true,
 	}
 
 	hrrConfig = &Config{
-		ServerName:    serverName,
-		Certificates:  certificates,
-		RequireCookie: true,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       certificates,
+		RequireCookie:      true,
 	}
 
 	alpnConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
-		NextProtos:   []string{"http/1.1", "h2"},
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       certificates,
+		NextProtos:         []string{"http/1.1", "h2"},
 	}
 
 	clientAuthConfig = &Config{
-		ServerName:        serverName,
-		RequireClientAuth: true,
-		Certificates:      certificates,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		RequireClientAuth:  true,
+		Certificates:       certificates,
 	}
 
 	pskConfig = &Config{
-		ServerName:     serverName,
-		CipherSuites:   []CipherSuite{TLS_AES_128_GCM_SHA256},
-		PSKs:           psks,
-		AllowEarlyData: true,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
+		AllowEarlyData:     true,
 	}
 
 	pskECDHEConfig = &Config{
-		ServerName:   serverName,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		Certificates: certificates,
-		PSKs:         psks,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Certificates:       certificates,
+		PSKs:               psks,
 	}
 
 	pskDHEConfig = &Config{
-		ServerName:   serverName,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		Certificates: certificates,
-		PSKs:         psks,
-		Groups:       []NamedGroup{FFDHE2048},
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Certificates:       certificates,
+		PSKs:               psks,
+		Groups:             []NamedGroup{FFDHE2048},
 	}
 
 	resumptionConfig = &Config{
 		ServerName:         serverName,
+		InsecureSkipVerify: true,
 		Certificates:       certificates,
 		SendSessionTickets: true,
 	}
 
 	ffdhConfig = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		Groups:       []NamedGroup{FFDHE2048},
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       certificates,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{FFDHE2048},
 	}
 
 	x25519Config = &Config{
-		ServerName:   serverName,
-		Certificates: certificates,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		Groups:       []NamedGroup{X25519},
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       certificates,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{X25519},
 	}
 )
 
@@ -287,17 +305,17 @@ func TestBasicFlows(t *testing.T) {
 		client := Client(cConn, conf)
 		server := Server(sConn, conf)
 
-		var clientAlert, serverAlert Alert
+		var clientErr, serverErr error
 
 		done := make(chan bool)
 		go func(t *testing.T) {
-			serverAlert = server.Handshake()
-			assertEquals(t, serverAlert, AlertNoAlert)
+			serverErr = server.Handshake()
+			assertNotError(t, serverErr, "Server handshake failed")
 			done <- true
 		}(t)
 
-		clientAlert = client.Handshake()
-		assertEquals(t, clientAlert, AlertNoAlert)
+		clientErr = client.Handshake()
+		assertNotError(t, clientErr, "Client handshake failed")
 
 		<-done
 
@@ -319,23 +337,215 @@ func TestBasicFlows(t *testing.T) {
 	}
 }
 
+func TestDefaultCipherSuites(t *testing.T) {
+	conf := &Config{ServerName: serverName}
+	err := conf.Init(true)
+	assertNotError(t, err, "Failed to initialize config")
+	for _, suite := range conf.CipherSuites {
+		assert(t, suite != TLS_AES_128_CCM_8_SHA256, "CCM_8 is enabled by default")
+	}
+}
+
+func TestDefaultSignatureSchemes(t *testing.T) {
+	conf := &Config{ServerName: serverName}
+	err := conf.Init(true)
+	assertNotError(t, err, "Failed to initialize config")
+	for _, scheme := range conf.SignatureSchemes {
+		assert(t, scheme != Ed448, "Ed448 is enabled by default")
+	}
+}
+
+func TestCipherSuiteFlows(t *testing.T) {
+	for _, suite := range []CipherSuite{
+		TLS_AES_128_GCM_SHA256,
+		TLS_AES_256_GCM_SHA384,
+		TLS_CHACHA20_POLY1305_SHA256,
+		TLS_AES_128_CCM_SHA256,
+		TLS_AES_128_CCM_8_SHA256,
+	} {
+		conf := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			Certificates:       certificates,
+			CipherSuites:       []CipherSuite{suite},
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, conf)
+		server := Server(sConn, conf)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			err := server.Handshake()
+			assertNotError(t, err, "Handshake failed")
+			done <- true
+		}(t)
+
+		err := client.Handshake()
+		assertNotError(t, err, "Handshake failed")
+		<-done
+
+		assertEquals(t, client.state.Params.CipherSuite, suite)
+		assertEquals(t, server.state.Params.CipherSuite, suite)
+
+		_, err = client.Write([]byte("ping"))
+		assertNotError(t, err, "Client write failed")
+
+		buf := make([]byte, 4)
+		n, err := server.Read(buf)
+		assertNotError(t, err, "Server read failed")
+		assertEquals(t, string(buf[:n]), "ping")
+	}
+}
+
+func TestVersionFlows(t *testing.T) {
+	cases := []struct {
+		client, server []uint16
+		negotiated     uint16
+	}{
+		{nil, nil, supportedVersion},
+		{[]uint16{maxDraftVersion}, []uint16{supportedVersion, maxDraftVersion}, maxDraftVersion},
+		{[]uint16{maxDraftVersion, supportedVersion}, []uint16{supportedVersion, maxDraftVersion}, supportedVersion},
+		{[]uint16{supportedVersion, minDraftVersion}, []uint16{minDraftVersion, supportedVersion}, minDraftVersion},
+	}
+
+	for _, c := range cases {
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			SupportedVersions:  c.client,
+		}
+		serverConfig := &Config{
+			Certificates:      certificates,
+			SupportedVersions: c.server,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			err := server.Handshake()
+			assertNotError(t, err, "Handshake failed")
+			done <- true
+		}(t)
+
+		err := client.Handshake()
+		assertNotError(t, err, "Handshake failed")
+		<-done
+
+		assertEquals(t, client.state.Params.Version, c.negotiated)
+		assertEquals(t, server.state.Params.Version, c.negotiated)
+	}
+
+	// No common version
+	cConn, sConn := net.Pipe()
+	client := Client(cConn, &Config{ServerName: serverName, SupportedVersions: []uint16{maxDraftVersion}, InsecureSkipVerify: true})
+	server := Server(sConn, &Config{Certificates: certificates})
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		err := server.Handshake()
+		assertEquals(t, err, AlertError{Alert: AlertProtocolVersion})
+		sConn.Close()
+		done <- true
+	}(t)
+
+	client.Handshake()
+	<-done
+
+	// Versions other than RFC 8446 and compatible drafts are refused
+	for _, version := range []uint16{0x7f15, 0x7f17, 0x7f18} {
+		config := &Config{ServerName: serverName, SupportedVersions: []uint16{version}}
+		err := config.Init(true)
+		assertError(t, err, "Accepted an unsupported version")
+	}
+}
+
+func TestKeyShareHRRFlows(t *testing.T) {
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:             []NamedGroup{X25519, P256},
+		KeyShareGroups:     []NamedGroup{X25519},
+	}
+	serverConfig := &Config{
+		Certificates: certificates,
+		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Groups:       []NamedGroup{P256},
+	}
+
+	cookieConfig := *serverConfig
+	cookieConfig.RequireCookie = true
+
+	pskClientConfig := *clientConfig
+	pskClientConfig.PSKs = psks
+	pskClientConfig.PSKModes = []PSKKeyExchangeMode{PSKModeDHEKE}
+
+	pskServerConfig := *serverConfig
+	pskServerConfig.PSKs = psks
+
+	cases := []struct {
+		client, server *Config
+		usingPSK       bool
+	}{
+		{clientConfig, serverConfig, false},
+		{clientConfig, &cookieConfig, false},
+		{&pskClientConfig, &pskServerConfig, true},
+	}
+
+	for _, c := range cases {
+		cConn, sConn := pipe()
+		client := Client(cConn, c.client)
+		server := Server(sConn, c.server)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			err := server.Handshake()
+			assertNotError(t, err, "Handshake failed")
+			done <- true
+		}(t)
+
+		err := client.Handshake()
+		assertNotError(t, err, "Handshake failed")
+		<-done
+
+		assertDeepEquals(t, client.state.Params, server.state.Params)
+		assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
+		assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
+		assert(t, client.state.Params.UsingDH, "Session did not use DH after HelloRetryRequest")
+		assertEquals(t, client.state.Params.UsingPSK, c.usingPSK)
+	}
+
+	// A key share group has to be one of the supported groups
+	badConfig := &Config{
+		ServerName:     serverName,
+		Groups:         []NamedGroup{P256},
+		KeyShareGroups: []NamedGroup{X25519},
+	}
+	err := badConfig.Init(true)
+	assertError(t, err, "Accepted a key share group that is not supported")
+}
+
 func TestClientAuth(t *testing.T) {
 	cConn, sConn := pipe()
 
 	client := Client(cConn, clientAuthConfig)
 	server := Server(sConn, clientAuthConfig)
 
-	var clientAlert, serverAlert Alert
+	var clientErr, serverErr error
 
 	done := make(chan bool)
 	go func(t *testing.T) {
-		serverAlert = server.Handshake()
-		assertEquals(t, serverAlert, AlertNoAlert)
+		serverErr = server.Handshake()
+		assertNotError(t, serverErr, "Server handshake failed")
 		done <- true
 	}(t)
 
-	clientAlert = client.Handshake()
-	assertEquals(t, clientAlert, AlertNoAlert)
+	clientErr = client.Handshake()
+	assertNotError(t, clientErr, "Client handshake failed")
 
 	<-done
 
@@ -347,6 +557,483 @@ func TestClientAuth(t *testing.T) {
 	assert(t, client.state.Params.UsingClientAuth, "Session did not negotiate client auth")
 }
 
+func TestPostHandshakeAuth(t *testing.T) {
+	clientCAs, clientCert := newTestChain(t, "client", x509.ExtKeyUsageClientAuth)
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		Certificates:       []*Certificate{clientCert},
+	}
+	serverConfig := &Config{
+		Certificates: certificates,
+		ClientCAs:    clientCAs,
+	}
+
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, server.state.Params.PostHandshakeAuth, "Client did not offer post-handshake auth")
+	assert(t, !server.State().UsingClientAuth, "Client authenticated during the handshake")
+
+	// Test that the server waits while the client answers from Read
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(client, buf)
+		done <- err
+	}()
+
+	err := server.RequestClientCertificate()
+	assertNotError(t, err, "Failed to authenticate client after handshake")
+	state := server.State()
+	assert(t, state.UsingClientAuth, "Server did not report client auth")
+	assertEquals(t, len(state.PeerCertificates), 1)
+	assertEquals(t, len(state.VerifiedChains), 1)
+
+	_, err = server.Write([]byte("hello"))
+	assertNotError(t, err, "Failed to write after client auth")
+	assertNotError(t, <-done, "Failed to read after client auth")
+
+	// Test that only servers can ask
+	err = client.RequestClientCertificate()
+	assertError(t, err, "Client requested a certificate")
+
+	// Test that a client without a suitable certificate can decline, and the
+	// connection carries on without client auth
+	rsaOnlyConfig := &Config{
+		Certificates:     certificates,
+		ClientCAs:        clientCAs,
+		SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
+	}
+	client, server, clientErr, serverErr = handshakeOverPipe(clientConfig, rsaOnlyConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	go func() {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(client, buf)
+		done <- err
+	}()
+
+	err = server.RequestClientCertificate()
+	authErr, ok := err.(*ClientAuthError)
+	assert(t, ok, "Declined client auth did not return a ClientAuthError")
+	assertNotError(t, authErr.Err, "Declined client auth failed the connection")
+	assert(t, !server.State().UsingClientAuth, "Server reported client auth")
+
+	_, err = server.Write([]byte("hello"))
+	assertNotError(t, err, "Failed to write after declined client auth")
+	assertNotError(t, <-done, "Failed to read after declined client auth")
+
+	// Test that the client has to offer post-handshake auth
+	noCertConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}
+	_, server, clientErr, serverErr = handshakeOverPipe(noCertConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	err = server.RequestClientCertificate()
+	assertError(t, err, "Requested certificate without post-handshake auth")
+
+	// Test that non-blocking connections process the answer in Read
+	buf := make([]byte, 10)
+	clientEngine := NewEngine(clientConfig, true)
+	serverEngine := NewEngine(serverConfig, false)
+	clientErr, serverErr = runEngines(clientEngine, serverEngine)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+
+	assertNotError(t, serverEngine.RequestClientCertificate(), "Failed to request certificate")
+	clientEngine.Input(serverEngine.Output())
+	_, err = clientEngine.Read(buf)
+	assertEquals(t, err, WouldBlock)
+	serverEngine.Input(clientEngine.Output())
+	_, err = serverEngine.Read(buf)
+	assertEquals(t, err, WouldBlock)
+	assert(t, serverEngine.State().UsingClientAuth, "Server did not report client auth")
+
+	// Test that a certificate from an unknown issuer is rejected
+	otherCAs, _ := newTestChain(t, "other", x509.ExtKeyUsageClientAuth)
+	clientEngine = NewEngine(clientConfig, true)
+	serverEngine = NewEngine(&Config{
+		Certificates: certificates,
+		ClientCAs:    otherCAs,
+	}, false)
+	clientErr, serverErr = runEngines(clientEngine, serverEngine)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+
+	assertNotError(t, serverEngine.RequestClientCertificate(), "Failed to request certificate")
+	clientEngine.Input(serverEngine.Output())
+	_, err = clientEngine.Read(buf)
+	assertEquals(t, err, WouldBlock)
+	serverEngine.Input(clientEngine.Output())
+	_, err = serverEngine.Read(buf)
+	assert(t, err != nil && err != WouldBlock, "Server accepted an unknown client certificate")
+	assert(t, !serverEngine.State().UsingClientAuth, "Server reported client auth")
+}
+
+// newTestChain creates a root CA and a leaf certificate issued by it for the
+// given name and usage.  It returns a pool containing the root, and the leaf
+// as a Certificate that can be used in a Config.
+func newTestChain(t *testing.T, name string, usage x509.ExtKeyUsage) (*x509.CertPool, *Certificate) {
+	rootKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate root key")
+	leafKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate leaf key")
+
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(prng, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	assertNotError(t, err, "Failed to create root certificate")
+	root, err := x509.ParseCertificate(rootDER)
+	assertNotError(t, err, "Failed to parse root certificate")
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	leafDER, err := x509.CreateCertificate(prng, leafTemplate, root, leafKey.Public(), rootKey)
+	assertNotError(t, err, "Failed to create leaf certificate")
+	leaf, err := x509.ParseCertificate(leafDER)
+	assertNotError(t, err, "Failed to parse leaf certificate")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	return pool, &Certificate{Chain: []*x509.Certificate{leaf}, PrivateKey: leafKey}
+}
+
+// handshakeOverPipe runs a handshake between a client and a server, closing
+// the connection when either side fails so that the other side unblocks.
+func handshakeOverPipe(clientConfig, serverConfig *Config) (client, server *Conn, clientErr, serverErr error) {
+	cConn, sConn := net.Pipe()
+	client = Client(cConn, clientConfig)
+	server = Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func() {
+		serverErr = server.Handshake()
+		if serverErr != nil {
+			sConn.Close()
+		}
+		done <- true
+	}()
+
+	clientErr = client.Handshake()
+	if clientErr != nil {
+		cConn.Close()
+	}
+	<-done
+	return
+}
+
+func TestCertificateVerification(t *testing.T) {
+	roots, serverCert := newTestChain(t, serverName, x509.ExtKeyUsageServerAuth)
+	clientRoots, clientCert := newTestChain(t, "client", x509.ExtKeyUsageClientAuth)
+	otherRoots, _ := newTestChain(t, serverName, x509.ExtKeyUsageServerAuth)
+
+	serverConfig := &Config{Certificates: []*Certificate{serverCert}}
+
+	// Successful verification exposes the verified chain
+	clientConfig := &Config{ServerName: serverName, RootCAs: roots}
+	client, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+
+	state := client.State()
+	assertEquals(t, len(state.PeerCertificates), 1)
+	assert(t, state.PeerCertificates[0].Equal(serverCert.Chain[0]), "Wrong peer certificate")
+	assertEquals(t, len(state.VerifiedChains), 1)
+	assertEquals(t, len(state.VerifiedChains[0]), 2)
+
+	// Chains from an unknown CA are refused
+	clientConfig = &Config{ServerName: serverName, RootCAs: otherRoots}
+	_, _, clientErr, _ = handshakeOverPipe(clientConfig, serverConfig)
+	var verifyErr *CertificateVerificationError
+	assert(t, errors.As(clientErr, &verifyErr), "Client did not return a verification error")
+	assertEquals(t, len(verifyErr.UnverifiedCertificates), 1)
+	_, unknownAuthority := verifyErr.Err.(x509.UnknownAuthorityError)
+	assert(t, unknownAuthority, "Verification error does not give the cause")
+
+	// ... unless verification is disabled
+	clientConfig = &Config{ServerName: serverName, RootCAs: otherRoots, InsecureSkipVerify: true}
+	client, _, clientErr, _ = handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertEquals(t, len(client.State().PeerCertificates), 1)
+	assertEquals(t, len(client.State().VerifiedChains), 0)
+
+	// AuthCertificate still runs after verification
+	clientConfig = &Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+		AuthCertificate: func(chain []CertificateEntry) error {
+			return fmt.Errorf("Rejected")
+		},
+	}
+	_, _, clientErr, _ = handshakeOverPipe(clientConfig, serverConfig)
+	assert(t, errors.As(clientErr, &verifyErr), "Client did not return a verification error")
+	assertEquals(t, verifyErr.Err.Error(), "Rejected")
+
+	// Servers verify client certificates against ClientCAs
+	clientAuthServerConfig := &Config{
+		Certificates:      []*Certificate{serverCert},
+		RequireClientAuth: true,
+		ClientCAs:         clientRoots,
+	}
+	clientConfig = &Config{
+		ServerName:   serverName,
+		RootCAs:      roots,
+		Certificates: []*Certificate{clientCert},
+	}
+	_, server, clientErr, serverErr := handshakeOverPipe(clientConfig, clientAuthServerConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assertEquals(t, len(server.State().VerifiedChains), 1)
+
+	// A client certificate from another CA is refused
+	clientAuthServerConfig.ClientCAs = otherRoots
+	_, _, _, serverErr = handshakeOverPipe(clientConfig, clientAuthServerConfig)
+	assert(t, errors.As(serverErr, &verifyErr), "Server did not return a verification error")
+
+	// A client without a certificate is refused, even if certificates are
+	// not being verified
+	clientConfig = &Config{ServerName: serverName, RootCAs: roots}
+	_, _, _, serverErr = handshakeOverPipe(clientConfig, clientAuthServerConfig)
+	assertEquals(t, serverErr, AlertError{Alert: AlertCertificateRequired})
+	clientAuthServerConfig.InsecureSkipVerify = true
+	_, _, _, serverErr = handshakeOverPipe(clientConfig, clientAuthServerConfig)
+	assertEquals(t, serverErr, AlertError{Alert: AlertCertificateRequired})
+}
+
+func TestGetCertificate(t *testing.T) {
+	_, exampleCert := newTestChain(t, serverName, x509.ExtKeyUsageServerAuth)
+	_, defaultCert := newTestChain(t, "default.example", x509.ExtKeyUsageServerAuth)
+
+	// The callback sees the ClientHello and supplies the certificate
+	var hello *ClientHelloInfo
+	serverConfig := &Config{
+		NextProtos: []string{"h2"},
+		GetCertificate: func(info *ClientHelloInfo) (*Certificate, error) {
+			hello = info
+			if info.ServerName == serverName {
+				return exampleCert, nil
+			}
+			return nil, nil
+		},
+		Certificates: []*Certificate{defaultCert},
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+	}
+	client, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assertNotNil(t, hello, "GetCertificate was not called")
+	assertEquals(t, hello.ServerName, serverName)
+	assertDeepEquals(t, hello.SupportedProtos, clientConfig.NextProtos)
+	assert(t, len(hello.SignatureSchemes) > 0, "No signature schemes provided")
+	assert(t, client.State().PeerCertificates[0].Equal(exampleCert.Chain[0]), "Wrong certificate")
+
+	// A nil certificate falls back to the configured ones
+	clientConfig.ServerName = "other.example"
+	client, _, clientErr, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, client.State().PeerCertificates[0].Equal(defaultCert.Chain[0]), "Wrong certificate")
+
+	// Errors abort the handshake
+	serverConfig.GetCertificate = func(info *ClientHelloInfo) (*Certificate, error) {
+		return nil, fmt.Errorf("No certificate")
+	}
+	_, _, _, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertEquals(t, serverErr, AlertError{Alert: AlertInternalError})
+}
+
+func TestDefaultCertificate(t *testing.T) {
+	_, exampleCert := newTestChain(t, serverName, x509.ExtKeyUsageServerAuth)
+	_, defaultCert := newTestChain(t, "default.example", x509.ExtKeyUsageServerAuth)
+	serverConfig := &Config{Certificates: []*Certificate{defaultCert, exampleCert}}
+
+	cases := map[string]*Certificate{
+		serverName:      exampleCert,
+		"other.example": defaultCert,
+		"":              defaultCert,
+	}
+	for name, expected := range cases {
+		clientConfig := &Config{ServerName: name, InsecureSkipVerify: true}
+		client, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+		assert(t, client.State().PeerCertificates[0].Equal(expected.Chain[0]), "Wrong certificate for "+name)
+	}
+}
+
+func TestEdDSACertificates(t *testing.T) {
+	for _, alg := range []SignatureScheme{Ed25519, Ed448} {
+		priv, err := newSigningKey(alg)
+		assertNotError(t, err, "Failed to generate EdDSA key")
+		cert, err := newSelfSigned(serverName, alg, priv)
+		assertNotError(t, err, "Failed to create EdDSA certificate")
+
+		// Ed448 is not enabled by default
+		serverConfig := &Config{
+			Certificates:     []*Certificate{{Chain: []*x509.Certificate{cert}, PrivateKey: priv}},
+			SignatureSchemes: []SignatureScheme{alg},
+		}
+		clientConfig := &Config{
+			ServerName:       serverName,
+			SignatureSchemes: []SignatureScheme{alg},
+		}
+		if alg == Ed25519 {
+			clientConfig.RootCAs = x509.NewCertPool()
+			clientConfig.RootCAs.AddCert(cert)
+		} else {
+			// crypto/x509 cannot verify Ed448 signatures
+			clientConfig.InsecureSkipVerify = true
+		}
+
+		client, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+		assertEquals(t, client.State().SignatureScheme, alg)
+	}
+}
+
+func TestX448Handshake(t *testing.T) {
+	clientConfig := &Config{
+		ServerName:         serverName,
+		Groups:             []NamedGroup{X448, X25519},
+		KeyShareGroups:     []NamedGroup{X448},
+		InsecureSkipVerify: true,
+	}
+	serverConfig := &Config{
+		Certificates: certificates,
+		Groups:       []NamedGroup{X448},
+	}
+
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assertEquals(t, client.State().Group, X448)
+	assertEquals(t, server.State().Group, X448)
+}
+
+// testExtensionHandler sends an extension in each message it is given, and
+// records the contents of the ones it receives
+type testExtensionHandler struct {
+	value    []byte
+	received map[HandshakeType][]byte
+	fail     error
+}
+
+func (h *testExtensionHandler) Send(hs HandshakeType, el *ExtensionList) error {
+	*el = append(*el, Extension{ExtensionType: 0xff00, ExtensionData: h.value})
+	return nil
+}
+
+func (h *testExtensionHandler) Receive(hs HandshakeType, el *ExtensionList) error {
+	if h.fail != nil {
+		return h.fail
+	}
+
+	for _, ext := range *el {
+		if ext.ExtensionType == 0xff00 {
+			if h.received == nil {
+				h.received = map[HandshakeType][]byte{}
+			}
+			h.received[hs] = ext.ExtensionData
+		}
+	}
+	return nil
+}
+
+func TestExtensionHandler(t *testing.T) {
+	clientHandler := &testExtensionHandler{value: []byte("client")}
+	serverHandler := &testExtensionHandler{value: []byte("server")}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		ExtensionHandler:   clientHandler,
+	}
+	serverConfig := &Config{
+		Certificates:     certificates,
+		ExtensionHandler: serverHandler,
+	}
+
+	_, _, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assertByteEquals(t, serverHandler.received[HandshakeTypeClientHello], []byte("client"))
+	assertByteEquals(t, clientHandler.received[HandshakeTypeEncryptedExtensions], []byte("server"))
+
+	// Alerts returned by the handler end the handshake
+	serverHandler.fail = AlertUnsupportedExtension
+	_, _, _, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertEquals(t, serverErr, AlertError{Alert: AlertUnsupportedExtension})
+
+	serverHandler.fail = fmt.Errorf("bad extension")
+	_, _, _, serverErr = handshakeOverPipe(clientConfig, serverConfig)
+	assertEquals(t, serverErr, AlertError{Alert: AlertIllegalParameter})
+}
+
+func TestConnectionState(t *testing.T) {
+	roots, serverCert := newTestChain(t, serverName, x509.ExtKeyUsageServerAuth)
+	clientRoots, clientCert := newTestChain(t, "client", x509.ExtKeyUsageClientAuth)
+
+	clientConfig := &Config{
+		ServerName:   serverName,
+		RootCAs:      roots,
+		Certificates: []*Certificate{clientCert},
+		Groups:       []NamedGroup{X25519},
+		NextProtos:   []string{"h2"},
+	}
+	serverConfig := &Config{
+		Certificates:      []*Certificate{serverCert},
+		ClientCAs:         clientRoots,
+		RequireClientAuth: true,
+		Groups:            []NamedGroup{X25519},
+		NextProtos:        []string{"h2"},
+	}
+
+	client, server, clientErr, serverErr := handshakeOverPipe(clientConfig, serverConfig)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+
+	clientState := client.State()
+	serverState := server.State()
+	for _, state := range []ConnectionState{clientState, serverState} {
+		assertEquals(t, state.HandshakeState, "StateConnected")
+		assertEquals(t, state.Version, uint16(supportedVersion))
+		assertEquals(t, state.Group, X25519)
+		assertEquals(t, state.SignatureScheme, ECDSA_P256_SHA256)
+		assertEquals(t, state.ServerName, serverName)
+		assertEquals(t, state.NextProto, "h2")
+		assert(t, !state.UsingPSK, "Reported PSK without one")
+		assert(t, !state.DidResume, "Reported resumption without a PSK")
+		assert(t, !state.UsingEarlyData, "Reported early data without a PSK")
+		assert(t, state.UsingClientAuth, "Did not report client auth")
+		assertEquals(t, len(state.PeerCertificates), 1)
+		assertEquals(t, len(state.VerifiedChains), 1)
+	}
+	assertCipherSuiteParamsEquals(t, clientState.CipherSuite, serverState.CipherSuite)
+	assert(t, clientState.PeerCertificates[0].Equal(serverCert.Chain[0]), "Wrong server certificate")
+	assert(t, serverState.PeerCertificates[0].Equal(clientCert.Chain[0]), "Wrong client certificate")
+}
+
 func TestPSKFlows(t *testing.T) {
 	for _, conf := range []*Config{pskConfig, pskECDHEConfig, pskDHEConfig} {
 		cConn, sConn := pipe()
@@ -354,17 +1041,17 @@ func TestPSKFlows(t *testing.T) {
 		client := Client(cConn, conf)
 		server := Server(sConn, conf)
 
-		var clientAlert, serverAlert Alert
+		var clientErr, serverErr error
 
 		done := make(chan bool)
 		go func(t *testing.T) {
-			serverAlert = server.Handshake()
-			assertEquals(t, serverAlert, AlertNoAlert)
+			serverErr = server.Handshake()
+			assertNotError(t, serverErr, "Server handshake failed")
 			done <- true
 		}(t)
 
-		clientAlert = client.Handshake()
-		assertEquals(t, clientAlert, AlertNoAlert)
+		clientErr = client.Handshake()
+		assertNotError(t, clientErr, "Client handshake failed")
 
 		<-done
 
@@ -386,18 +1073,18 @@ func TestResumption(t *testing.T) {
 	client1 := Client(cConn1, &clientConfig)
 	server1 := Server(sConn1, &serverConfig)
 
-	var clientAlert, serverAlert Alert
+	var clientErr, serverErr error
 
 	done := make(chan bool)
 	go func(t *testing.T) {
-		serverAlert = server1.Handshake()
-		assertEquals(t, serverAlert, AlertNoAlert)
+		serverErr = server1.Handshake()
+		assertNotError(t, serverErr, "Server handshake failed")
 		server1.Write([]byte{'a'})
 		done <- true
 	}(t)
 
-	clientAlert = client1.Handshake()
-	assertEquals(t, clientAlert, AlertNoAlert)
+	clientErr = client1.Handshake()
+	assertNotError(t, clientErr, "Client handshake failed")
 
 	tmpBuf := make([]byte, 1)
 	n, err := client1.Read(tmpBuf)
@@ -413,17 +1100,14 @@ func TestResumption(t *testing.T) {
 	assertEquals(t, clientConfig.PSKs.Size(), 1)
 	assertEquals(t, serverConfig.PSKs.Size(), 1)
 
-	clientCache := clientConfig.PSKs.(*PSKMapCache)
+	clientPSK, ok := clientConfig.PSKs.Get(serverName)
+	assert(t, ok, "Client did not store ticket")
 	serverCache := serverConfig.PSKs.(*PSKMapCache)
 
 	var serverPSK PreSharedKey
 	for _, key := range *serverCache {
 		serverPSK = key
 	}
-	var clientPSK PreSharedKey
-	for _, key := range *clientCache {
-		clientPSK = key
-	}
 
 	// Ensure that the PSKs are the same, except with regard to the
 	// receivedAt/expiresAt times, which might differ by a little.
@@ -445,13 +1129,13 @@ func TestResumption(t *testing.T) {
 	server2 := Server(sConn2, &serverConfig)
 
 	go func(t *testing.T) {
-		serverAlert = server2.Handshake()
-		assertEquals(t, serverAlert, AlertNoAlert)
+		serverErr = server2.Handshake()
+		assertNotError(t, serverErr, "Server handshake failed")
 		done <- true
 	}(t)
 
-	clientAlert = client2.Handshake()
-	assertEquals(t, clientAlert, AlertNoAlert)
+	clientErr = client2.Handshake()
+	assertNotError(t, clientErr, "Client handshake failed")
 
 	client2.Read(nil)
 	<-done
@@ -462,6 +1146,179 @@ func TestResumption(t *testing.T) {
 	assertByteEquals(t, client2.state.clientTrafficSecret, server2.state.clientTrafficSecret)
 	assertByteEquals(t, client2.state.serverTrafficSecret, server2.state.serverTrafficSecret)
 	assert(t, client2.state.Params.UsingPSK, "Session did not use the provided PSK")
+	assert(t, client2.State().DidResume, "Client did not report resumption")
+	assert(t, server2.State().DidResume, "Server did not report resumption")
+}
+
+func TestPSKListCache(t *testing.T) {
+	external := PreSharedKey{Identity: []byte{0}, Key: []byte{1}}
+	cache := &PSKListCache{}
+	cache.Put(serverName, external)
+	for i := 1; i <= maxTicketsPerServer+1; i++ {
+		cache.Put(serverName, PreSharedKey{IsResumption: true, Identity: []byte{byte(i)}})
+	}
+
+	// Test that the newest PSK is found first, and old tickets are dropped
+	psk, ok := cache.Get(serverName)
+	assert(t, ok, "Failed to find PSK")
+	assertByteEquals(t, psk.Identity, []byte{maxTicketsPerServer + 1})
+	assertEquals(t, cache.Size(), maxTicketsPerServer+1)
+
+	// Test that a PSK with the same identity is replaced
+	cache.Put(serverName, external)
+	assertEquals(t, cache.Size(), maxTicketsPerServer+1)
+
+	// Test that only the newest tickets are taken, and only once, but
+	// external PSKs are kept
+	psks := cache.Take(serverName)
+	assertEquals(t, len(psks), maxOfferedTickets+1)
+	assertByteEquals(t, psks[0].Identity, external.Identity)
+	assertByteEquals(t, psks[1].Identity, []byte{maxTicketsPerServer + 1})
+	assertEquals(t, cache.Size(), maxTicketsPerServer+1-maxOfferedTickets)
+	rest := cache.Take(serverName)
+	assertEquals(t, len(rest), maxTicketsPerServer+1-maxOfferedTickets)
+	rest = cache.Take(serverName)
+	assertEquals(t, len(rest), 1)
+	assertByteEquals(t, rest[0].Identity, external.Identity)
+
+	// Test that unused tickets can be put back, but not twice
+	cache.PutBack(serverName, psks)
+	cache.PutBack(serverName, psks)
+	assertEquals(t, cache.Size(), maxOfferedTickets+1)
+	assertDeepEquals(t, cache.Take(serverName), psks)
+
+	// Test that expired tickets are neither taken nor put back
+	expired := PreSharedKey{
+		IsResumption: true,
+		Identity:     []byte{0xff},
+		ExpiresAt:    time.Now().Add(-time.Second),
+	}
+	cache.Put(serverName, expired)
+	assertEquals(t, len(cache.Take(serverName)), 1)
+	cache.PutBack(serverName, []PreSharedKey{expired})
+	assertEquals(t, cache.Size(), 1)
+
+	_, ok = cache.Get("other.example.com")
+	assert(t, !ok, "Found PSK for unknown server")
+}
+
+func TestMultiplePSKIdentities(t *testing.T) {
+	serverConfig := &Config{
+		Certificates:       certificates,
+		SendSessionTickets: true,
+		AllowEarlyData:     true,
+	}
+
+	// Get a ticket on each of two connections
+	tickets := []PreSharedKey{}
+	for i := 0; i < 2; i++ {
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		}
+		client := NewEngine(clientConfig, true)
+		server := NewEngine(serverConfig, false)
+		clientErr, serverErr := runEngines(client, server)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+
+		_, err := client.Read(make([]byte, 1))
+		assertEquals(t, err, WouldBlock)
+		ticket, ok := clientConfig.PSKs.Get(serverName)
+		assert(t, ok, "Client did not store ticket")
+		tickets = append(tickets, ticket)
+	}
+
+	// Offer an external PSK that the server does not know, then both tickets
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		PSKs:               &PSKListCache{},
+	}
+	unknown := PreSharedKey{
+		CipherSuite: TLS_AES_128_GCM_SHA256,
+		Identity:    []byte{9, 9, 9, 9},
+		Key:         []byte{4, 5, 6, 7},
+	}
+	clientConfig.PSKs.Put(serverName, tickets[0])
+	clientConfig.PSKs.Put(serverName, tickets[1])
+	clientConfig.PSKs.Put(serverName, unknown)
+
+	client := NewEngine(clientConfig, true)
+	client.EarlyData = []byte("hello 0xRTT world!")
+	server := NewEngine(serverConfig, false)
+	assertEquals(t, client.Handshake(), WouldBlock)
+
+	// The server selects the first ticket it knows, and so skips the early
+	// data, which was sent with the unknown PSK
+	clientHello := client.Output()
+	server.Input(clientHello)
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, client.State().DidResume, "Client did not report resumption")
+	assert(t, server.State().DidResume, "Server did not report resumption")
+	assert(t, !server.State().UsingEarlyData, "Server accepted early data with a later PSK")
+	assertByteEquals(t, client.state.resumptionSecret, server.state.resumptionSecret)
+
+	// The client offered every PSK, and has kept only the external one
+	hm, err := NewHandshakeLayer(NewRecordLayer(bytes.NewBuffer(clientHello))).ReadMessage()
+	assertNotError(t, err, "Failed to read ClientHello")
+	ch := ClientHelloBody{}
+	_, err = ch.Unmarshal(hm.body)
+	assertNotError(t, err, "Failed to unmarshal ClientHello")
+	offered := PreSharedKeyExtension{HandshakeType: HandshakeTypeClientHello}
+	assert(t, ch.Extensions.Find(&offered), "ClientHello did not offer PSKs")
+	assertEquals(t, len(offered.Identities), 3)
+	assertEquals(t, len(offered.Binders), 3)
+	assertByteEquals(t, offered.Identities[0].Identity, unknown.Identity)
+	assertByteEquals(t, offered.Identities[1].Identity, tickets[1].Identity)
+	assertByteEquals(t, offered.Identities[2].Identity, tickets[0].Identity)
+	assertEquals(t, offered.Identities[0].ObfuscatedTicketAge, uint32(0))
+	assertDeepEquals(t, clientConfig.PSKs.(*PSKListCache).Take(serverName), []PreSharedKey{unknown})
+}
+
+func TestUnsentTicketsPutBack(t *testing.T) {
+	newTicket := func(id byte, suite CipherSuite) PreSharedKey {
+		return PreSharedKey{
+			CipherSuite:  suite,
+			IsResumption: true,
+			Identity:     []byte{id},
+			Key:          []byte{0, 1, 2, 3},
+			ReceivedAt:   time.Now(),
+		}
+	}
+	newClient := func(tickets ...PreSharedKey) (*Engine, *Config) {
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			PSKs:               &PSKListCache{},
+		}
+		for _, ticket := range tickets {
+			clientConfig.PSKs.Put(serverName, ticket)
+		}
+		return NewEngine(clientConfig, true), clientConfig
+	}
+
+	// Offered tickets are thrown away, even if the handshake fails
+	offered := newTicket(1, TLS_AES_128_GCM_SHA256)
+	client, clientConfig := newClient(offered)
+	assertEquals(t, client.Handshake(), WouldBlock)
+	client.Input([]byte{byte(RecordTypeAlert), 0x03, 0x03, 0x00, 0x02, 0x02, byte(AlertHandshakeFailure)})
+	assertError(t, client.Handshake(), "Client handshake succeeded after an alert")
+	assertEquals(t, clientConfig.PSKs.Size(), 0)
+
+	// Tickets for a different hash than the first one are not offered
+	unsent := newTicket(2, TLS_AES_256_GCM_SHA384)
+	client, clientConfig = newClient(unsent, offered)
+	assertEquals(t, client.Handshake(), WouldBlock)
+	assertDeepEquals(t, clientConfig.PSKs.(*PSKListCache).Take(serverName), []PreSharedKey{unsent})
+
+	// No tickets are offered if the ClientHello cannot be built
+	broken := newTicket(3, CipherSuite(0))
+	client, clientConfig = newClient(offered, broken)
+	assertError(t, client.Handshake(), "Client handshake succeeded with a broken ticket")
+	assertEquals(t, clientConfig.PSKs.Size(), 2)
 }
 
 func Test0xRTT(t *testing.T) {
@@ -475,13 +1332,13 @@ func Test0xRTT(t *testing.T) {
 
 	done := make(chan bool)
 	go func(t *testing.T) {
-		alert := server.Handshake()
-		assertEquals(t, alert, AlertNoAlert)
+		err := server.Handshake()
+		assertNotError(t, err, "Handshake failed")
 		done <- true
 	}(t)
 
-	alert := client.Handshake()
-	assertEquals(t, alert, AlertNoAlert)
+	err := client.Handshake()
+	assertNotError(t, err, "Handshake failed")
 
 	<-done
 
@@ -491,21 +1348,26 @@ func Test0xRTT(t *testing.T) {
 	assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
 	assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
 	assert(t, client.state.Params.UsingEarlyData, "Session did not negotiate early data")
+	assert(t, client.State().UsingEarlyData, "Client did not report early data")
+	assert(t, server.State().UsingEarlyData, "Server did not report early data")
+	assert(t, !client.State().DidResume, "Client reported resumption with an external PSK")
 	assertByteEquals(t, client.EarlyData, server.EarlyData)
 }
 
 func Test0xRTTFailure(t *testing.T) {
 	// Client thinks it has a PSK
 	clientConfig := &Config{
-		ServerName:   serverName,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
-		PSKs:         psks,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
 	}
 
 	// Server doesn't
 	serverConfig := &Config{
-		ServerName:   serverName,
-		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
 	}
 
 	cConn, sConn := pipe()
@@ -517,13 +1379,13 @@ func Test0xRTTFailure(t *testing.T) {
 
 	done := make(chan bool)
 	go func(t *testing.T) {
-		alert := server.Handshake()
-		assertEquals(t, alert, AlertNoAlert)
+		err := server.Handshake()
+		assertNotError(t, err, "Handshake failed")
 		done <- true
 	}(t)
 
-	alert := client.Handshake()
-	assertEquals(t, alert, AlertNoAlert)
+	err := client.Handshake()
+	assertNotError(t, err, "Handshake failed")
 
 	<-done
 }
@@ -539,8 +1401,8 @@ func TestKeyUpdate(t *testing.T) {
 	c2s := make(chan bool)
 	s2c := make(chan bool)
 	go func(t *testing.T) {
-		alert := server.Handshake()
-		assertEquals(t, alert, AlertNoAlert)
+		err := server.Handshake()
+		assertNotError(t, err, "Handshake failed")
 
 		// Send a single byte so that the client can consume NST.
 		server.Write(oneBuf)
@@ -548,7 +1410,7 @@ func TestKeyUpdate(t *testing.T) {
 
 		// Test server-initiated KeyUpdate
 		<-c2s
-		err := server.SendKeyUpdate(false)
+		err = server.SendKeyUpdate(false)
 		assertNotError(t, err, "Key update send failed")
 
 		// Write a single byte so that the client can read it
@@ -568,11 +1430,11 @@ func TestKeyUpdate(t *testing.T) {
 		s2c <- true
 	}(t)
 
-	alert := client.Handshake()
+	err := client.Handshake()
 
 	// Read NST.
 	client.Read(oneBuf)
-	assertEquals(t, alert, AlertNoAlert)
+	assertNotError(t, err, "Handshake failed")
 	<-s2c
 
 	clientState0 := client.state
@@ -621,6 +1483,252 @@ func TestKeyUpdate(t *testing.T) {
 	assertNotByteEquals(t, clientState2.clientTrafficSecret, clientState3.clientTrafficSecret)
 }
 
+func TestFragmentedPostHandshakeMessages(t *testing.T) {
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}
+	serverConfig := &Config{
+		Certificates: certificates,
+	}
+
+	handshake := func(msg []byte) *TLSPlaintext {
+		return &TLSPlaintext{contentType: RecordTypeHandshake, fragment: msg}
+	}
+	appData := &TLSPlaintext{contentType: RecordTypeApplicationData, fragment: []byte{0}}
+
+	cases := []struct {
+		name    string
+		records func(msg []byte) []*TLSPlaintext
+		err     error
+	}{
+		{
+			name: "split",
+			records: func(msg []byte) []*TLSPlaintext {
+				return []*TLSPlaintext{handshake(msg[:2]), handshake(msg[2:3]), handshake(msg[3:])}
+			},
+		},
+		{
+			name: "not at the end of its record",
+			records: func(msg []byte) []*TLSPlaintext {
+				return []*TLSPlaintext{handshake(append(msg, msg[:2]...))}
+			},
+			err: AlertError{Alert: AlertUnexpectedMessage},
+		},
+		{
+			name: "interleaved with application data",
+			records: func(msg []byte) []*TLSPlaintext {
+				return []*TLSPlaintext{handshake(msg[:2]), appData, handshake(msg[2:])}
+			},
+			err: AlertError{Alert: AlertUnexpectedMessage},
+		},
+	}
+
+	for _, c := range cases {
+		client := NewEngine(clientConfig, true)
+		server := NewEngine(serverConfig, false)
+		clientErr, serverErr := runEngines(client, server)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+
+		// Have the server send a KeyUpdate in the given records, followed
+		// by some data under the new keys
+		actions, alert := server.state.KeyUpdate(KeyUpdateNotRequested)
+		assertEquals(t, alert, AlertNoAlert)
+		msg := actions[0].(SendHandshakeMessage).Message.Marshal()
+		for _, pt := range c.records(msg) {
+			err := server.out.WriteRecord(pt)
+			assertNotError(t, err, "Failed to write record")
+		}
+		for _, action := range actions[1:] {
+			assertEquals(t, server.takeAction(action), AlertNoAlert)
+		}
+		_, err := server.Write([]byte{1})
+		assertNotError(t, err, "Failed to write data")
+
+		client.Input(server.Output())
+		buf := make([]byte, 1)
+		_, err = client.Read(buf)
+		if c.err != nil {
+			assertEquals(t, err, c.err)
+			continue
+		}
+
+		assertNotError(t, err, "Failed to read data after "+c.name+" KeyUpdate")
+		assertByteEquals(t, buf, []byte{1})
+		assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
+	}
+}
+
+func TestAutomaticKeyUpdate(t *testing.T) {
+	message := []byte("ping")
+	configs := []*Config{
+		{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			KeyUpdateRecords:   4,
+		},
+		{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			KeyUpdateBytes:     uint64(3 * len(message)),
+		},
+	}
+
+	for _, clientConfig := range configs {
+		client := NewEngine(clientConfig, true)
+		server := NewEngine(basicConfig, false)
+		clientErr, serverErr := runEngines(client, server)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+		secret0 := client.state.clientTrafficSecret
+
+		// Each key protects three messages, then the next write updates it
+		buf := make([]byte, len(message))
+		for i := 0; i < 7; i++ {
+			_, err := client.Write(message)
+			assertNotError(t, err, "Failed to write")
+			server.Input(client.Output())
+			n, err := server.Read(buf)
+			assertNotError(t, err, "Failed to read")
+			assertByteEquals(t, buf[:n], message)
+		}
+
+		assertEquals(t, client.state.clientGeneration, 2)
+		assertNotByteEquals(t, client.state.clientTrafficSecret, secret0)
+		assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
+	}
+
+	// AES keys are updated before they reach their usage limit
+	limits := map[CipherSuite]uint64{
+		TLS_AES_128_GCM_SHA256: aesGCMRecordLimit,
+		TLS_AES_128_CCM_SHA256: aesCCMRecordLimit,
+	}
+	for suite, limit := range limits {
+		config := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			Certificates:       certificates,
+			CipherSuites:       []CipherSuite{suite},
+		}
+		client := NewEngine(config, true)
+		server := NewEngine(config, false)
+		clientErr, serverErr := runEngines(client, server)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+
+		client.out.records = limit - 2
+		client.Write(message)
+		assertEquals(t, client.state.clientGeneration, 0)
+		client.Write(message)
+		assertEquals(t, client.state.clientGeneration, 1)
+	}
+}
+
+// exchangeConcurrently has each end of a connection write messages from one
+// goroutine while reading the peer's from another, calling update after each
+// message is written.
+func exchangeConcurrently(t *testing.T, client, server *Conn, messages int, update func(c *Conn, i int) error) {
+	message := bytes.Repeat([]byte{0xA5}, 1000)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, conn := range []*Conn{client, server} {
+		wg.Add(2)
+		go func(c *Conn) {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				if _, err := c.Write(message); err != nil {
+					errs <- err
+					return
+				}
+				if err := update(c, i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(conn)
+		go func(c *Conn) {
+			defer wg.Done()
+			buf := make([]byte, len(message))
+			for i := 0; i < messages; i++ {
+				if _, err := io.ReadFull(c, buf); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf, message) {
+					errs <- fmt.Errorf("Corrupted message %d", i)
+					return
+				}
+			}
+		}(conn)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assertNotError(t, err, "Concurrent exchange failed")
+	}
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	serverConfig := &Config{
+		Certificates:       certificates,
+		SendSessionTickets: true,
+		TicketLifetime:     3600,
+		KeyUpdateRecords:   7,
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		KeyUpdateRecords:   5,
+	}
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- Server(conn, serverConfig)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assertNotError(t, err, "Failed to connect")
+	client := Client(conn, clientConfig)
+	server := <-accepted
+	assertNotNil(t, server, "Failed to accept")
+	defer client.Close()
+	defer server.Close()
+
+	// Both ends update their keys automatically, and also request updates
+	// from each other, while the client is reading the session ticket
+	exchangeConcurrently(t, client, server, 100, func(c *Conn, i int) error {
+		if i%10 == 0 {
+			return c.SendKeyUpdate(true)
+		}
+		return nil
+	})
+
+	assertEquals(t, clientConfig.PSKs.Size(), 1)
+
+	// Exchange one more message each way, so that each end has read every
+	// KeyUpdate sent by the other
+	buf := make([]byte, 1)
+	for _, pair := range [][2]*Conn{{server, client}, {client, server}} {
+		_, err = pair[0].Write([]byte{0})
+		assertNotError(t, err, "Final write failed")
+		_, err = io.ReadFull(pair[1], buf)
+		assertNotError(t, err, "Final read failed")
+	}
+	assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
+	assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
+}
+
 func TestNonblockingHandshakeAndDataFlow(t *testing.T) {
 	cConn, sConn := pipe()
 
@@ -631,36 +1739,36 @@ func TestNonblockingHandshakeAndDataFlow(t *testing.T) {
 	client := Client(cbConn, nbConfig)
 	server := Server(sbConn, nbConfig)
 
-	var clientAlert, serverAlert Alert
+	var clientErr, serverErr error
 
 	// Send ClientHello
-	clientAlert = client.Handshake()
-	assertEquals(t, clientAlert, AlertWouldBlock)
-	serverAlert = server.Handshake()
-	assertEquals(t, serverAlert, AlertWouldBlock)
+	clientErr = client.Handshake()
+	assertEquals(t, clientErr, WouldBlock)
+	serverErr = server.Handshake()
+	assertEquals(t, serverErr, WouldBlock)
 
 	// Release ClientHello
 	cbConn.Flush()
 
 	// Process ClientHello, send server first flight.
-	serverAlert = server.Handshake()
-	assertEquals(t, serverAlert, AlertWouldBlock)
+	serverErr = server.Handshake()
+	assertEquals(t, serverErr, WouldBlock)
 
-	clientAlert = client.Handshake()
-	assertEquals(t, clientAlert, AlertWouldBlock)
+	clientErr = client.Handshake()
+	assertEquals(t, clientErr, WouldBlock)
 
 	// Release server first flight
 	sbConn.Flush()
-	clientAlert = client.Handshake()
-	assertEquals(t, clientAlert, AlertNoAlert)
+	clientErr = client.Handshake()
+	assertNotError(t, clientErr, "Client handshake failed")
 
-	serverAlert = server.Handshake()
-	assertEquals(t, serverAlert, AlertWouldBlock)
+	serverErr = server.Handshake()
+	assertEquals(t, serverErr, WouldBlock)
 
 	// Release client's second flight.
 	cbConn.Flush()
-	serverAlert = server.Handshake()
-	assertEquals(t, serverAlert, AlertNoAlert)
+	serverErr = server.Handshake()
+	assertNotError(t, serverErr, "Server handshake failed")
 
 	assertDeepEquals(t, client.state.Params, server.state.Params)
 	assertCipherSuiteParamsEquals(t, client.state.cryptoParams, server.state.cryptoParams)
@@ -676,3 +1784,151 @@ func TestNonblockingHandshakeAndDataFlow(t *testing.T) {
 	// read := make([]byte, 5)
 	// n, err = server.Read(buf)
 }
+
+func TestCloseNotify(t *testing.T) {
+	cConn, sConn := pipe()
+
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, basicConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		err := server.Handshake()
+		assertNotError(t, err, "Handshake failed")
+
+		_, err = server.Write([]byte("hello"))
+		assertNotError(t, err, "Server write failed")
+
+		err = server.Close()
+		assertNotError(t, err, "Server close failed")
+
+		_, err = server.Write([]byte("goodbye"))
+		assertError(t, err, "Server allowed write after close")
+		done <- true
+	}(t)
+
+	err := client.Handshake()
+	assertNotError(t, err, "Handshake failed")
+	<-done
+
+	buf := make([]byte, 10)
+	n, err := client.Read(buf)
+	assertNotError(t, err, "Client read failed")
+	assertEquals(t, string(buf[:n]), "hello")
+
+	n, err = client.Read(buf)
+	assertEquals(t, n, 0)
+	assertEquals(t, err, io.EOF)
+
+	// Subsequent reads keep reporting a clean EOF
+	n, err = client.Read(buf)
+	assertEquals(t, n, 0)
+	assertEquals(t, err, io.EOF)
+}
+
+func TestCloseWrite(t *testing.T) {
+	cConn, sConn := pipe()
+
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, basicConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		err := server.Handshake()
+		assertNotError(t, err, "Handshake failed")
+		done <- true
+	}(t)
+
+	err := client.Handshake()
+	assertNotError(t, err, "Handshake failed")
+	<-done
+
+	_, err = client.Write([]byte("request"))
+	assertNotError(t, err, "Client write failed")
+
+	err = client.CloseWrite()
+	assertNotError(t, err, "CloseWrite failed")
+
+	_, err = client.Write([]byte("more"))
+	assertError(t, err, "Client allowed write after CloseWrite")
+
+	// The server sees the request followed by a clean EOF
+	buf := make([]byte, 10)
+	n, err := server.Read(buf)
+	assertNotError(t, err, "Server read failed")
+	assertEquals(t, string(buf[:n]), "request")
+
+	_, err = server.Read(buf)
+	assertEquals(t, err, io.EOF)
+
+	// ... and can still respond
+	_, err = server.Write([]byte("response"))
+	assertNotError(t, err, "Server write after peer CloseWrite failed")
+	err = server.Close()
+	assertNotError(t, err, "Server close failed")
+
+	n, err = client.Read(buf)
+	assertNotError(t, err, "Client read after CloseWrite failed")
+	assertEquals(t, string(buf[:n]), "response")
+
+	_, err = client.Read(buf)
+	assertEquals(t, err, io.EOF)
+}
+
+func TestCloseDuringHandshake(t *testing.T) {
+	cConn, sConn := net.Pipe()
+
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, basicConfig)
+
+	serverDone := make(chan bool)
+	go func() {
+		err := server.Handshake()
+		serverDone <- true
+		if err == nil {
+			io.Copy(ioutil.Discard, server)
+		}
+		server.Close()
+	}()
+
+	clientDone := make(chan bool)
+	go func() {
+		client.Read(make([]byte, 1))
+		clientDone <- true
+	}()
+
+	// Once the server is done, the client finishes its handshake in Read
+	// while Close runs
+	<-serverDone
+	err := client.Close()
+	assertNotError(t, err, "Close failed")
+	<-clientDone
+}
+
+func TestTruncation(t *testing.T) {
+	cConn, sConn := net.Pipe()
+
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, basicConfig)
+
+	go func(t *testing.T) {
+		err := server.Handshake()
+		assertNotError(t, err, "Handshake failed")
+
+		server.Write([]byte("hello"))
+
+		// Close the socket without sending close_notify
+		sConn.Close()
+	}(t)
+
+	err := client.Handshake()
+	assertNotError(t, err, "Handshake failed")
+
+	buf := make([]byte, 10)
+	n, err := client.Read(buf)
+	assertNotError(t, err, "Client read failed")
+	assertEquals(t, string(buf[:n]), "hello")
+
+	_, err = client.Read(buf)
+	assertEquals(t, err, io.ErrUnexpectedEOF)
+}
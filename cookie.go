@@ -0,0 +1,80 @@
+package mint
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Stateless HelloRetryRequest cookies.  Instead of remembering what it sent
+// in a HelloRetryRequest, a server can put that state in the cookie, under a
+// MAC so that the client cannot change it:
+//
+//   cookieState || HMAC-SHA256(key, cookieState)
+//
+// When the cookie comes back in the second ClientHello, the server rebuilds
+// the HelloRetryRequest from it and carries on.  Cookies carry the time they
+// were issued, so that they can't be replayed indefinitely.
+
+const (
+	// Cookies are only meant to last for one round trip, but servers sharing
+	// a key may not have exactly the same clock
+	cookieLifetime = 60 * time.Second
+
+	minCookieKeySize = sha256.Size
+)
+
+// struct {
+//     uint64 issued_at;             /* seconds since the epoch */
+//     CipherSuite cipher_suite;
+//     uint16 version;
+//     NamedGroup requested_group;   /* zero if none was requested */
+//     opaque client_hello_hash<1..255>;
+// } CookieState;
+type cookieState struct {
+	IssuedAt        uint64
+	CipherSuite     CipherSuite
+	Version         uint16
+	RequestedGroup  NamedGroup
+	ClientHelloHash []byte `tls:"head=1,min=1"`
+}
+
+func cookieMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func sealCookie(key []byte, state cookieState) ([]byte, error) {
+	data, err := syntax.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, cookieMAC(key, data)...), nil
+}
+
+func openCookie(key, cookie []byte) (cookieState, bool) {
+	if len(cookie) < sha256.Size {
+		return cookieState{}, false
+	}
+
+	data := cookie[:len(cookie)-sha256.Size]
+	if !hmac.Equal(cookie[len(data):], cookieMAC(key, data)) {
+		return cookieState{}, false
+	}
+
+	var state cookieState
+	read, err := syntax.Unmarshal(data, &state)
+	if err != nil || read != len(data) {
+		return cookieState{}, false
+	}
+
+	issuedAt := time.Unix(int64(state.IssuedAt), 0)
+	age := time.Since(issuedAt)
+	if age > cookieLifetime || age < -cookieLifetime {
+		return cookieState{}, false
+	}
+	return state, true
+}
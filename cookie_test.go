@@ -0,0 +1,143 @@
+package mint
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var cookieKey = bytes.Repeat([]byte{0xc0}, minCookieKeySize)
+
+func TestCookieSealOpen(t *testing.T) {
+	state := cookieState{
+		IssuedAt:        uint64(time.Now().Unix()),
+		CipherSuite:     TLS_AES_128_GCM_SHA256,
+		Version:         supportedVersion,
+		RequestedGroup:  X25519,
+		ClientHelloHash: []byte{0, 1, 2, 3},
+	}
+
+	// Test successful seal and open
+	cookie, err := sealCookie(cookieKey, state)
+	assertNotError(t, err, "Failed to seal cookie")
+	opened, ok := openCookie(cookieKey, cookie)
+	assert(t, ok, "Failed to open cookie")
+	assertDeepEquals(t, opened, state)
+
+	// Test failure on the wrong key
+	_, ok = openCookie(bytes.Repeat([]byte{0xc1}, minCookieKeySize), cookie)
+	assert(t, !ok, "Opened cookie with the wrong key")
+
+	// Test failure on stale cookies, and on cookies from the future
+	for _, offset := range []time.Duration{-2 * cookieLifetime, 2 * cookieLifetime} {
+		stale := state
+		stale.IssuedAt = uint64(time.Now().Add(offset).Unix())
+		cookie, err := sealCookie(cookieKey, stale)
+		assertNotError(t, err, "Failed to seal cookie")
+		_, ok = openCookie(cookieKey, cookie)
+		assert(t, !ok, "Opened stale cookie")
+	}
+
+	// Test failure on a modified cookie
+	cookie[0] ^= 0xff
+	_, ok = openCookie(cookieKey, cookie)
+	assert(t, !ok, "Opened modified cookie")
+
+	// Test failure on a short cookie
+	_, ok = openCookie(cookieKey, cookie[:10])
+	assert(t, !ok, "Opened short cookie")
+}
+
+func TestStatelessCookie(t *testing.T) {
+	clientConfigs := []*Config{
+		{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		},
+		{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			Groups:             []NamedGroup{P256, X25519},
+			KeyShareGroups:     []NamedGroup{P256},
+		},
+	}
+	serverConfigs := []*Config{
+		{
+			Certificates:  certificates,
+			RequireCookie: true,
+			CookieKey:     cookieKey,
+		},
+		{
+			Certificates: certificates,
+			Groups:       []NamedGroup{X25519},
+			CookieKey:    cookieKey,
+		},
+	}
+
+	for i := range clientConfigs {
+		client := NewEngine(clientConfigs[i], true)
+		server1 := NewEngine(serverConfigs[i], false)
+
+		// The first server sends a HelloRetryRequest and forgets about it
+		assertEquals(t, client.Handshake(), WouldBlock)
+		server1.Input(client.Output())
+		assertEquals(t, server1.Handshake(), WouldBlock)
+		start, ok := server1.hState.(ServerStateStart)
+		assert(t, ok, "Server did not return to the start state")
+		assert(t, start.helloRetryRequest == nil, "Server kept HelloRetryRequest state")
+
+		// A second server picks up the handshake from the cookie
+		server2 := NewEngine(serverConfigs[i], false)
+		client.Input(server1.Output())
+		clientErr, serverErr := runEngines(client, server2)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+		assertDeepEquals(t, client.state.Params, server2.state.Params)
+		assertByteEquals(t, client.state.clientTrafficSecret, server2.state.clientTrafficSecret)
+	}
+
+	// A server with a different key rejects the cookie
+	client := NewEngine(clientConfigs[0], true)
+	server1 := NewEngine(serverConfigs[0], false)
+	assertEquals(t, client.Handshake(), WouldBlock)
+	server1.Input(client.Output())
+	assertEquals(t, server1.Handshake(), WouldBlock)
+	client.Input(server1.Output())
+	assertEquals(t, client.Handshake(), WouldBlock)
+
+	server2 := NewEngine(&Config{
+		Certificates:  certificates,
+		RequireCookie: true,
+		CookieKey:     bytes.Repeat([]byte{0xc1}, minCookieKeySize),
+	}, false)
+	server2.Input(client.Output())
+	assertEquals(t, server2.Handshake(), AlertError{Alert: AlertAccessDenied})
+
+	// A server that would pick a different ciphersuite than the one in the
+	// cookie rejects the second ClientHello
+	client = NewEngine(clientConfigs[0], true)
+	server1 = NewEngine(serverConfigs[0], false)
+	assertEquals(t, client.Handshake(), WouldBlock)
+	server1.Input(client.Output())
+	assertEquals(t, server1.Handshake(), WouldBlock)
+	client.Input(server1.Output())
+	assertEquals(t, client.Handshake(), WouldBlock)
+
+	server2 = NewEngine(&Config{
+		Certificates:  certificates,
+		RequireCookie: true,
+		CookieKey:     cookieKey,
+		CipherSuites:  []CipherSuite{TLS_CHACHA20_POLY1305_SHA256},
+	}, false)
+	server2.Input(client.Output())
+	assertEquals(t, server2.Handshake(), AlertError{Alert: AlertIllegalParameter})
+}
+
+func TestCookieKeySize(t *testing.T) {
+	config := &Config{
+		RequireCookie: true,
+		CookieKey:     []byte("too short"),
+	}
+	err := config.Init(false)
+	assertError(t, err, "Accepted a short cookie key")
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/rand"
@@ -17,6 +18,7 @@ import (
 	"math/big"
 	"time"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 
 	// Blank includes to ensure hash support
@@ -30,11 +32,12 @@ var prng = rand.Reader
 type aeadFactory func(key []byte) (cipher.AEAD, error)
 
 type CipherSuiteParams struct {
-	Suite  CipherSuite
-	Cipher aeadFactory // Cipher factory
-	Hash   crypto.Hash // Hash function
-	KeyLen int         // Key length in octets
-	IvLen  int         // IV length in octets
+	Suite       CipherSuite
+	Cipher      aeadFactory // Cipher factory
+	Hash        crypto.Hash // Hash function
+	KeyLen      int         // Key length in octets
+	IvLen       int         // IV length in octets
+	RecordLimit uint64      // Records to protect with one key; zero means no limit
 }
 
 type signatureAlgorithm uint8
@@ -44,6 +47,8 @@ const (
 	signatureAlgorithmRSA_PKCS1
 	signatureAlgorithmRSA_PSS
 	signatureAlgorithmECDSA
+	signatureAlgorithmEd25519
+	signatureAlgorithmEd448
 )
 
 var (
@@ -71,6 +76,8 @@ var (
 		RSA_PSS_SHA256:    signatureAlgorithmRSA_PSS,
 		RSA_PSS_SHA384:    signatureAlgorithmRSA_PSS,
 		RSA_PSS_SHA512:    signatureAlgorithmRSA_PSS,
+		Ed25519:           signatureAlgorithmEd25519,
+		Ed448:             signatureAlgorithmEd448,
 	}
 
 	curveMap = map[SignatureScheme]NamedGroup{
@@ -89,21 +96,77 @@ var (
 		return cipher.NewGCMWithNonceSize(block, 12)
 	}
 
+	newAESCCM = func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return newCCM(block, 12, 16)
+	}
+
+	newAESCCM8 = func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return newCCM(block, 12, 8)
+	}
+
+	newChaCha20Poly1305 = func(key []byte) (cipher.AEAD, error) {
+		return chacha20poly1305.New(key)
+	}
+
+	// AES-GCM keys can protect about 2^24.5 full-size records before an
+	// attacker's advantage grows too large; see RFC 8446, Section 5.5
+	aesGCMRecordLimit uint64 = 23726566
+
+	// AES-CCM runs the block cipher twice for each block, once for CTR and
+	// once for CBC-MAC, so its keys can protect about half as many records;
+	// see RFC 9147, Section 4.5.3
+	aesCCMRecordLimit uint64 = aesGCMRecordLimit / 2
+
 	cipherSuiteMap = map[CipherSuite]CipherSuiteParams{
 		TLS_AES_128_GCM_SHA256: {
-			Suite:  TLS_AES_128_GCM_SHA256,
-			Cipher: newAESGCM,
-			Hash:   crypto.SHA256,
-			KeyLen: 16,
-			IvLen:  12,
+			Suite:       TLS_AES_128_GCM_SHA256,
+			Cipher:      newAESGCM,
+			Hash:        crypto.SHA256,
+			KeyLen:      16,
+			IvLen:       12,
+			RecordLimit: aesGCMRecordLimit,
 		},
 		TLS_AES_256_GCM_SHA384: {
-			Suite:  TLS_AES_256_GCM_SHA384,
-			Cipher: newAESGCM,
-			Hash:   crypto.SHA384,
+			Suite:       TLS_AES_256_GCM_SHA384,
+			Cipher:      newAESGCM,
+			Hash:        crypto.SHA384,
+			KeyLen:      32,
+			IvLen:       12,
+			RecordLimit: aesGCMRecordLimit,
+		},
+		TLS_CHACHA20_POLY1305_SHA256: {
+			Suite:  TLS_CHACHA20_POLY1305_SHA256,
+			Cipher: newChaCha20Poly1305,
+			Hash:   crypto.SHA256,
 			KeyLen: 32,
 			IvLen:  12,
 		},
+		TLS_AES_128_CCM_SHA256: {
+			Suite:       TLS_AES_128_CCM_SHA256,
+			Cipher:      newAESCCM,
+			Hash:        crypto.SHA256,
+			KeyLen:      16,
+			IvLen:       12,
+			RecordLimit: aesCCMRecordLimit,
+		},
+		TLS_AES_128_CCM_8_SHA256: {
+			Suite:       TLS_AES_128_CCM_8_SHA256,
+			Cipher:      newAESCCM8,
+			Hash:        crypto.SHA256,
+			KeyLen:      16,
+			IvLen:       12,
+			RecordLimit: aesCCMRecordLimit,
+		},
 	}
 
 	x509AlgMap = map[SignatureScheme]x509.SignatureAlgorithm{
@@ -114,6 +177,7 @@ var (
 		ECDSA_P256_SHA256: x509.ECDSAWithSHA256,
 		ECDSA_P384_SHA384: x509.ECDSAWithSHA384,
 		ECDSA_P521_SHA512: x509.ECDSAWithSHA512,
+		Ed25519:           x509.PureEd25519,
 	}
 
 	defaultRSAKeySize = 2048
@@ -148,6 +212,8 @@ func keyExchangeSizeFromNamedGroup(group NamedGroup) (size int) {
 	switch group {
 	case X25519:
 		size = 32
+	case X448:
+		size = x448KeySize
 	case P256:
 		size = 65
 	case P384:
@@ -191,6 +257,10 @@ func schemeValidForKey(alg SignatureScheme, key crypto.Signer) bool {
 		return sigType == signatureAlgorithmRSA_PKCS1 || sigType == signatureAlgorithmRSA_PSS
 	case *ecdsa.PrivateKey:
 		return sigType == signatureAlgorithmECDSA
+	case ed25519.PrivateKey:
+		return sigType == signatureAlgorithmEd25519
+	case Ed448PrivateKey:
+		return sigType == signatureAlgorithmEd448
 	default:
 		return false
 	}
@@ -258,6 +328,17 @@ func newKeyShare(group NamedGroup) (pub []byte, priv []byte, err error) {
 		pub = public[:]
 		return
 
+	case X448:
+		priv = make([]byte, x448KeySize)
+		_, err = prng.Read(priv)
+		if err != nil {
+			return
+		}
+
+		// The base point has large order, so the result is never zero
+		pub, _ = x448(priv, x448BasePoint)
+		return
+
 	default:
 		return nil, nil, fmt.Errorf("tls.newkeyshare: Unsupported group %v", group)
 	}
@@ -309,6 +390,19 @@ func keyAgreement(group NamedGroup, pub []byte, priv []byte) ([]byte, error) {
 
 		return ret[:], nil
 
+	case X448:
+		if len(pub) != keyExchangeSizeFromNamedGroup(group) {
+			return nil, fmt.Errorf("tls.keyagreement: Wrong public key size")
+		}
+
+		// RFC 7748, Section 6.2 and RFC 8446, Section 7.4.2
+		ret, ok := x448(priv, pub)
+		if !ok {
+			return nil, fmt.Errorf("tls.keyagreement: All-zero X448 shared secret")
+		}
+
+		return ret, nil
+
 	default:
 		return nil, fmt.Errorf("tls.keyagreement: Unsupported group %v", group)
 	}
@@ -327,6 +421,11 @@ func newSigningKey(sig SignatureScheme) (crypto.Signer, error) {
 		return ecdsa.GenerateKey(elliptic.P384(), prng)
 	case ECDSA_P521_SHA512:
 		return ecdsa.GenerateKey(elliptic.P521(), prng)
+	case Ed25519:
+		_, priv, err := ed25519.GenerateKey(prng)
+		return priv, err
+	case Ed448:
+		return newEd448Key(prng)
 	default:
 		return nil, fmt.Errorf("tls.newsigningkey: Unsupported signature algorithm [%04x]", sig)
 	}
@@ -334,7 +433,7 @@ func newSigningKey(sig SignatureScheme) (crypto.Signer, error) {
 
 func newSelfSigned(name string, alg SignatureScheme, priv crypto.Signer) (*x509.Certificate, error) {
 	sigAlg, ok := x509AlgMap[alg]
-	if !ok {
+	if !ok && alg != Ed448 {
 		return nil, fmt.Errorf("tls.selfsigned: Unknown signature algorithm [%04x]", alg)
 	}
 	if len(name) == 0 {
@@ -356,7 +455,19 @@ func newSelfSigned(name string, alg SignatureScheme, priv crypto.Signer) (*x509.
 		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
-	der, err := x509.CreateCertificate(prng, template, template, priv.Public(), priv)
+
+	// crypto/x509 does not support Ed448, so those certificates are encoded
+	// separately
+	var der []byte
+	if alg == Ed448 {
+		ed448Priv, ok := priv.(Ed448PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("tls.selfsigned: Ed448 requires an Ed448 key")
+		}
+		der, err = newEd448SelfSigned(template, ed448Priv)
+	} else {
+		der, err = x509.CreateCertificate(prng, template, template, priv.Public(), priv)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -366,6 +477,65 @@ func newSelfSigned(name string, alg SignatureScheme, priv crypto.Signer) (*x509.
 	return cert, nil
 }
 
+// verifyCertificateChain checks a peer's certificate chain against a pool of
+// trusted roots, returning the verified chains.  If a name is provided, the
+// leaf certificate must be valid for that name.
+func verifyCertificateChain(chain []*x509.Certificate, roots *x509.CertPool, name string, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("tls.verify: Empty certificate chain")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       name,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	return chain[0].Verify(opts)
+}
+
+// CertificateVerificationError is returned by Handshake when the peer's
+// certificate chain fails verification or is rejected by AuthCertificate.
+type CertificateVerificationError struct {
+	UnverifiedCertificates []*x509.Certificate
+	Err                    error
+}
+
+func (e *CertificateVerificationError) Error() string {
+	return fmt.Sprintf("tls.verify: Certificate verification failed: %v", e.Err)
+}
+
+func (e *CertificateVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// verifyFailure reports a certificate verification failure through report,
+// if it is set, and returns the alert to send
+func verifyFailure(report func(err error), chain []*x509.Certificate, err error) Alert {
+	if report != nil {
+		report(&CertificateVerificationError{UnverifiedCertificates: chain, Err: err})
+	}
+	return verifyAlert(err)
+}
+
+// verifyAlert selects the alert to send when certificate verification fails
+func verifyAlert(err error) Alert {
+	switch err := err.(type) {
+	case x509.UnknownAuthorityError:
+		return AlertUnknownCA
+	case x509.CertificateInvalidError:
+		if err.Reason == x509.Expired {
+			return AlertCertificateExpired
+		}
+	}
+	return AlertBadCertificate
+}
+
 // XXX(rlb): Copied from crypto/x509
 type ecdsaSignature struct {
 	R, S *big.Int
@@ -413,6 +583,21 @@ func sign(alg SignatureScheme, privateKey crypto.Signer, sigInput []byte) ([]byt
 		h := hash.New()
 		h.Write(sigInput)
 		realInput = h.Sum(nil)
+	case ed25519.PrivateKey:
+		if sigType != signatureAlgorithmEd25519 {
+			return nil, fmt.Errorf("tls.crypto.sign: Unsupported algorithm for Ed25519 key")
+		}
+
+		// EdDSA signs the input directly
+		opts = crypto.Hash(0)
+		realInput = sigInput
+	case Ed448PrivateKey:
+		if sigType != signatureAlgorithmEd448 {
+			return nil, fmt.Errorf("tls.crypto.sign: Unsupported algorithm for Ed448 key")
+		}
+
+		opts = crypto.Hash(0)
+		realInput = sigInput
 	default:
 		return nil, fmt.Errorf("tls.crypto.sign: Unsupported private key type")
 	}
@@ -480,6 +665,24 @@ func verify(alg SignatureScheme, publicKey crypto.PublicKey, sigInput []byte, si
 			return fmt.Errorf("tls.verify: ECDSA verification failure")
 		}
 		return nil
+	case ed25519.PublicKey:
+		if sigType != signatureAlgorithmEd25519 {
+			return fmt.Errorf("tls.verify: Unsupported algorithm for Ed25519 key")
+		}
+
+		if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, sigInput, sig) {
+			return fmt.Errorf("tls.verify: Ed25519 verification failure")
+		}
+		return nil
+	case Ed448PublicKey:
+		if sigType != signatureAlgorithmEd448 {
+			return fmt.Errorf("tls.verify: Unsupported algorithm for Ed448 key")
+		}
+
+		if !ed448Verify(pub, sigInput, sig) {
+			return fmt.Errorf("tls.verify: Ed448 verification failure")
+		}
+		return nil
 	default:
 		return fmt.Errorf("tls.verify: Unsupported key type")
 	}
@@ -632,6 +835,19 @@ func deriveSecret(params CipherSuiteParams, secret []byte, label string, message
 	return HkdfExpandLabel(params.Hash, secret, label, messageHash, params.Hash.Size())
 }
 
+// pskBinderKey derives the key for the binder that proves possession of a PSK
+func pskBinderKey(params CipherSuiteParams, psk PreSharedKey) []byte {
+	binderLabel := labelExternalBinder
+	if psk.IsResumption {
+		binderLabel = labelResumptionBinder
+	}
+
+	h0 := params.Hash.New().Sum(nil)
+	zero := bytes.Repeat([]byte{0}, params.Hash.Size())
+	earlySecret := HkdfExtract(params.Hash, zero, psk.Key)
+	return deriveSecret(params, earlySecret, binderLabel, h0)
+}
+
 func computeFinishedData(params CipherSuiteParams, baseKey []byte, input []byte) []byte {
 	macKey := HkdfExpandLabel(params.Hash, baseKey, labelFinished, []byte{}, params.Hash.Size())
 	mac := hmac.New(params.Hash.New, macKey)
@@ -640,6 +856,8 @@ func computeFinishedData(params CipherSuiteParams, baseKey []byte, input []byte)
 }
 
 type keySet struct {
+	suite  CipherSuite
+	secret []byte
 	cipher aeadFactory
 	key    []byte
 	iv     []byte
@@ -648,6 +866,8 @@ type keySet struct {
 func makeTrafficKeys(params CipherSuiteParams, secret []byte) keySet {
 	logf(logTypeCrypto, "making traffic keys: secret=%x", secret)
 	return keySet{
+		suite:  params.Suite,
+		secret: secret,
 		cipher: params.Cipher,
 		key:    HkdfExpandLabel(params.Hash, secret, "key", []byte{}, params.KeyLen),
 		iv:     HkdfExpandLabel(params.Hash, secret, "iv", []byte{}, params.IvLen),
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	_ "crypto/sha256"
+	"crypto/x509"
 	"encoding/asn1"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"math/big"
 	"testing"
@@ -17,7 +20,7 @@ import (
 
 var (
 	ecGroups    = []NamedGroup{P256, P384, P521}
-	nonECGroups = []NamedGroup{FFDHE2048, FFDHE3072, FFDHE4096, FFDHE6144, FFDHE8192, X25519}
+	nonECGroups = []NamedGroup{FFDHE2048, FFDHE3072, FFDHE4096, FFDHE6144, FFDHE8192, X25519, X448}
 	dhGroups    = append(ecGroups, nonECGroups...)
 
 	shortKeyPubHex = "04e9f6076620ddf6a24e4398162057eccd3077892f046b412" +
@@ -37,6 +40,17 @@ var (
 	hkdfHashHex              = "f9a54250131c827542664bcad131b87c09cdd92f0d5f84db3680ee4c0c0f8ed6" // random
 	hkdfEncodedLabelHex      = "002a" + "0a" + hex.EncodeToString([]byte("tls13 "+hkdfLabel)) + "20" + hkdfHashHex
 	hkdfExpandLabelOutputHex = "a7c2b665154333b14f01762409173a6941d9c4e2edbe380e1cdd3091cb56f4aff8aced829cca286be245"
+
+	// Test vector from RFC 8439, Section 2.8.2
+	chachaKeyHex        = "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f"
+	chachaNonceHex      = "070000004041424344454647"
+	chachaDataHex       = "50515253c0c1c2c3c4c5c6c7"
+	chachaPlaintext     = "Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it."
+	chachaCiphertextHex = "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6" +
+		"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36" +
+		"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc" +
+		"3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691"
 )
 
 type mockSigner struct{}
@@ -92,6 +106,13 @@ func TestNewKeyShare(t *testing.T) {
 	assertError(t, err, "Generated an X25519 key with no entropy")
 	prng = originalPRNG
 
+	// Test failure case for an X448 key generation failure
+	originalPRNG = prng
+	prng = bytes.NewReader(nil)
+	_, _, err = newKeyShare(X448)
+	assertError(t, err, "Generated an X448 key with no entropy")
+	prng = originalPRNG
+
 	// Test failure case for an unknown group
 	_, _, err = newKeyShare(NamedGroup(0))
 	assertError(t, err, "Generated a key for an unsupported group")
@@ -135,6 +156,10 @@ func TestKeyAgreement(t *testing.T) {
 	_, err = keyAgreement(X25519, shortKeyPub[:5], shortKeyPriv)
 	assertError(t, err, "Performed key agreement with a truncated public key")
 
+	// Test failure for a too-short X448 public key
+	_, err = keyAgreement(X448, shortKeyPub[:5], shortKeyPriv)
+	assertError(t, err, "Performed key agreement with a truncated public key")
+
 	// Test failure case for an unknown group
 	_, err = keyAgreement(NamedGroup(0), shortKeyPub, shortKeyPriv)
 	assertError(t, err, "Performed key agreement with an unsupported group")
@@ -171,8 +196,19 @@ func TestNewSigningKey(t *testing.T) {
 	pub = privECDSA.(*ecdsa.PrivateKey).Public().(*ecdsa.PublicKey)
 	assertEquals(t, P521, namedGroupFromECDSAKey(pub))
 
+	// Test EdDSA success
+	privEd25519, err := newSigningKey(Ed25519)
+	assertNotError(t, err, "failed to generate Ed25519 private key")
+	_, ok = privEd25519.(ed25519.PrivateKey)
+	assert(t, ok, "New Ed25519 key was not actually an Ed25519 key")
+
+	privEd448, err := newSigningKey(Ed448)
+	assertNotError(t, err, "failed to generate Ed448 private key")
+	_, ok = privEd448.(Ed448PrivateKey)
+	assert(t, ok, "New Ed448 key was not actually an Ed448 key")
+
 	// Test unsupported algorithm
-	_, err = newSigningKey(Ed25519)
+	_, err = newSigningKey(SignatureScheme(0))
 	assertError(t, err, "Created a private key for an unsupported algorithm")
 }
 
@@ -196,6 +232,20 @@ func TestSelfSigned(t *testing.T) {
 	alg = RSA_PKCS1_SHA256
 	_, err = newSelfSigned("example.com", alg, priv)
 	assertError(t, err, "Signed with a mismatched algorithm")
+
+	// Test success with EdDSA keys
+	for _, alg := range []SignatureScheme{Ed25519, Ed448} {
+		privEdDSA, err := newSigningKey(alg)
+		assertNotError(t, err, "Failed to create EdDSA private key")
+		cert, err = newSelfSigned("example.com", alg, privEdDSA)
+		assertNotError(t, err, "Failed to sign EdDSA certificate")
+		assertDeepEquals(t, cert.DNSNames, []string{"example.com"})
+		assertDeepEquals(t, certificatePublicKey(cert), privEdDSA.Public())
+	}
+
+	// Test failure on an Ed448 certificate without an Ed448 key
+	_, err = newSelfSigned("example.com", Ed448, priv)
+	assertError(t, err, "Signed an Ed448 certificate with an ECDSA key")
 }
 
 func TestSignVerify(t *testing.T) {
@@ -313,6 +363,34 @@ func TestSignVerify(t *testing.T) {
 	assertError(t, err, "Verified ECDSA with corrupted signature")
 	sigECDSA[7] ^= 0xFF
 
+	// Test EdDSA signing and verification
+	for _, alg := range []SignatureScheme{Ed25519, Ed448} {
+		privEdDSA, err := newSigningKey(alg)
+		assertNotError(t, err, "failed to generate EdDSA private key")
+
+		sigEdDSA, err := sign(alg, privEdDSA, data)
+		assertNotError(t, err, "Failed to generate EdDSA signature")
+
+		err = verify(alg, privEdDSA.Public(), data, sigEdDSA)
+		assertNotError(t, err, "Failed to verify a valid EdDSA signature")
+
+		_, err = sign(ECDSA_P256_SHA256, privEdDSA, data)
+		assertError(t, err, "Allowed an ECDSA signature with an EdDSA key")
+
+		err = verify(ECDSA_P256_SHA256, privEdDSA.Public(), data, sigEdDSA)
+		assertError(t, err, "Verified ECDSA with an EdDSA key")
+
+		sigEdDSA[0] ^= 0xFF
+		err = verify(alg, privEdDSA.Public(), data, sigEdDSA)
+		assertError(t, err, "Verified EdDSA with corrupted signature")
+	}
+
+	// Test that Ed25519 and Ed448 keys are not interchangeable
+	privEd25519, err := newSigningKey(Ed25519)
+	assertNotError(t, err, "failed to generate Ed25519 private key")
+	_, err = sign(Ed448, privEd25519, data)
+	assertError(t, err, "Allowed an Ed448 signature with an Ed25519 key")
+
 	// Test verify failure on unknown public key type
 	err = verify(ECDSA_P256_SHA256, struct{}{}, data, sigECDSA)
 	assertError(t, err, "Verified with invalid public key type")
@@ -351,8 +429,83 @@ func TestHKDF(t *testing.T) {
 	assertByteEquals(t, out, HkdfExpandLabelOutput)
 }
 
+func TestChaCha20Poly1305(t *testing.T) {
+	aead, err := cipherSuiteMap[TLS_CHACHA20_POLY1305_SHA256].Cipher(unhex(chachaKeyHex))
+	assertNotError(t, err, "Failed to create ChaCha20-Poly1305")
+
+	nonce := unhex(chachaNonceHex)
+	data := unhex(chachaDataHex)
+	ciphertext := unhex(chachaCiphertextHex)
+
+	ct := aead.Seal(nil, nonce, []byte(chachaPlaintext), data)
+	assertByteEquals(t, ct, ciphertext)
+
+	pt, err := aead.Open(nil, nonce, ciphertext, data)
+	assertNotError(t, err, "Failed to open valid ciphertext")
+	assertEquals(t, string(pt), chachaPlaintext)
+}
+
+func TestCipherSuites(t *testing.T) {
+	for suite, params := range cipherSuiteMap {
+		assertEquals(t, params.Suite, suite)
+		assertEquals(t, params.IvLen, 12)
+
+		// Ciphers accept keys of the right length and nothing else
+		aead, err := params.Cipher(random(params.KeyLen))
+		assertNotError(t, err, fmt.Sprintf("Failed to create cipher for %04x", suite))
+		assertEquals(t, aead.NonceSize(), params.IvLen)
+
+		_, err = params.Cipher(random(params.KeyLen + 1))
+		assertError(t, err, fmt.Sprintf("Created cipher for %04x with a bad key", suite))
+
+		nonce := random(params.IvLen)
+		data := random(5)
+		plaintext := random(100)
+		ct := aead.Seal(nil, nonce, plaintext, data)
+		pt, err := aead.Open(nil, nonce, ct, data)
+		assertNotError(t, err, fmt.Sprintf("Round trip failed for %04x", suite))
+		assertByteEquals(t, pt, plaintext)
+	}
+}
+
 func random(n int) []byte {
 	data := make([]byte, n)
 	rand.Reader.Read(data)
 	return data
 }
+
+func TestVerifyCertificateChain(t *testing.T) {
+	roots, cert := newTestChain(t, "example.com", x509.ExtKeyUsageServerAuth)
+	otherRoots, _ := newTestChain(t, "example.com", x509.ExtKeyUsageServerAuth)
+
+	// Test success
+	chains, err := verifyCertificateChain(cert.Chain, roots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertNotError(t, err, "Failed to verify a valid chain")
+	assertEquals(t, len(chains), 1)
+
+	// Test success without a name
+	_, err = verifyCertificateChain(cert.Chain, roots, "", x509.ExtKeyUsageServerAuth)
+	assertNotError(t, err, "Failed to verify a valid chain without a name")
+
+	// Test failure on an empty chain
+	_, err = verifyCertificateChain(nil, roots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Verified an empty chain")
+
+	// Test failure on an unknown root
+	_, err = verifyCertificateChain(cert.Chain, otherRoots, "example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Verified a chain to an unknown root")
+	assertEquals(t, verifyAlert(err), AlertUnknownCA)
+
+	// Test failure on the wrong name
+	_, err = verifyCertificateChain(cert.Chain, roots, "www.example.com", x509.ExtKeyUsageServerAuth)
+	assertError(t, err, "Verified a chain for the wrong name")
+	assertEquals(t, verifyAlert(err), AlertBadCertificate)
+
+	// Test failure on the wrong usage
+	_, err = verifyCertificateChain(cert.Chain, roots, "example.com", x509.ExtKeyUsageClientAuth)
+	assertError(t, err, "Verified a chain for the wrong usage")
+
+	// Test the alert for an expired certificate
+	expired := x509.CertificateInvalidError{Cert: cert.Chain[0], Reason: x509.Expired}
+	assertEquals(t, verifyAlert(expired), AlertCertificateExpired)
+}
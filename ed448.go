@@ -0,0 +1,157 @@
+package mint
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/cloudflare/circl/sign/ed448"
+)
+
+// Ed448 signatures, as specified in RFC 8032, Section 5.2.  Neither the
+// standard library nor x/crypto provides Ed448, so the constant-time
+// implementation from circl is used.
+//
+// crypto/x509 cannot parse or verify Ed448 certificates, so Ed448 is not
+// among the default signature schemes.  A peer with an Ed448 certificate can
+// only be authenticated with InsecureSkipVerify and AuthCertificate.
+
+const (
+	ed448KeySize       = ed448.SeedSize
+	ed448SignatureSize = ed448.SignatureSize
+)
+
+// Ed448PublicKey is an encoded Ed448 public key
+type Ed448PublicKey []byte
+
+// Ed448PrivateKey is the 57-octet seed from which an Ed448 key pair is
+// derived.  It implements crypto.Signer.
+type Ed448PrivateKey []byte
+
+var ed448OID = asn1.ObjectIdentifier{1, 3, 101, 113}
+
+func newEd448Key(rand io.Reader) (Ed448PrivateKey, error) {
+	priv := make(Ed448PrivateKey, ed448KeySize)
+	if _, err := io.ReadFull(rand, priv); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+func (priv Ed448PrivateKey) Public() crypto.PublicKey {
+	pub := ed448.NewKeyFromSeed(priv).Public().(ed448.PublicKey)
+	return Ed448PublicKey(pub)
+}
+
+// Sign signs the message itself, so opts must not specify a hash function
+func (priv Ed448PrivateKey) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if len(priv) != ed448KeySize {
+		return nil, fmt.Errorf("tls.ed448: Bad private key length [%d]", len(priv))
+	}
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("tls.ed448: Cannot sign a hashed message")
+	}
+
+	return ed448.Sign(ed448.NewKeyFromSeed(priv), message, ""), nil
+}
+
+func ed448Verify(pub Ed448PublicKey, message, sig []byte) bool {
+	if len(pub) != ed448.PublicKeySize || len(sig) != ed448SignatureSize {
+		return false
+	}
+	return ed448.Verify(ed448.PublicKey(pub), message, sig, "")
+}
+
+// certificatePublicKey returns the public key from a certificate.  The
+// crypto/x509 parser leaves Ed448 keys unset, so we extract them ourselves.
+func certificatePublicKey(cert *x509.Certificate) crypto.PublicKey {
+	if cert.PublicKey != nil {
+		return cert.PublicKey
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil
+	}
+	if !spki.Algorithm.Algorithm.Equal(ed448OID) || len(spki.PublicKey.Bytes) != ed448KeySize {
+		return nil
+	}
+	return Ed448PublicKey(spki.PublicKey.Bytes)
+}
+
+// newEd448SelfSigned encodes and signs a certificate for an Ed448 key, since
+// crypto/x509 cannot.  Only the serial number, validity, subject and DNS
+// names are taken from the template.
+func newEd448SelfSigned(template *x509.Certificate, priv Ed448PrivateKey) ([]byte, error) {
+	alg := pkix.AlgorithmIdentifier{Algorithm: ed448OID}
+
+	name, err := asn1.Marshal(template.Subject.ToRDNSequence())
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames := make([]asn1.RawValue, len(template.DNSNames))
+	for i, dnsName := range template.DNSNames {
+		dnsNames[i] = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte(dnsName)}
+	}
+	san, err := asn1.Marshal(dnsNames)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs := struct {
+		Version      int `asn1:"explicit,tag:0"`
+		SerialNumber *big.Int
+		Signature    pkix.AlgorithmIdentifier
+		Issuer       asn1.RawValue
+		Validity     struct{ NotBefore, NotAfter time.Time }
+		Subject      asn1.RawValue
+		PublicKey    struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}
+		Extensions []pkix.Extension `asn1:"explicit,tag:3"`
+	}{
+		Version:      2,
+		SerialNumber: template.SerialNumber,
+		Signature:    alg,
+		Issuer:       asn1.RawValue{FullBytes: name},
+		Subject:      asn1.RawValue{FullBytes: name},
+		Extensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: san},
+		},
+	}
+	tbs.Validity.NotBefore = template.NotBefore.UTC()
+	tbs.Validity.NotAfter = template.NotAfter.UTC()
+	tbs.PublicKey.Algorithm = alg
+	pub := priv.Public().(Ed448PublicKey)
+	tbs.PublicKey.PublicKey = asn1.BitString{Bytes: pub, BitLength: 8 * len(pub)}
+
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := priv.Sign(prng, tbsDER, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(struct {
+		TBSCertificate     asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbsDER},
+		SignatureAlgorithm: alg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+}
@@ -0,0 +1,106 @@
+package mint
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// memoryAddr is the address of both ends of a memoryConn
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
+
+// memoryConn is a net.Conn backed by a pair of buffers.  Reads return zero
+// bytes when the input buffer is empty, which the record layer reports as
+// WouldBlock.
+type memoryConn struct {
+	sync.Mutex
+	in, out bytes.Buffer
+	closed  bool
+}
+
+func (m *memoryConn) Read(data []byte) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	n, err := m.in.Read(data)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (m *memoryConn) Write(data []byte) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return m.out.Write(data)
+}
+
+func (m *memoryConn) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.closed = true
+	return nil
+}
+
+func (m *memoryConn) LocalAddr() net.Addr                { return memoryAddr{} }
+func (m *memoryConn) RemoteAddr() net.Addr               { return memoryAddr{} }
+func (m *memoryConn) SetDeadline(t time.Time) error      { return nil }
+func (m *memoryConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *memoryConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Engine is a TLS connection that does no I/O of its own, like an OpenSSL
+// memory BIO.  The caller passes bytes received from the peer to Input, and
+// sends the peer whatever Output returns after each call into the engine.
+//
+// The Conn methods (Handshake, Read, Write, Close, State, and so on) work as
+// usual, except that they never block: when more input is needed, Handshake
+// and Read return WouldBlock.
+type Engine struct {
+	*Conn
+	transport *memoryConn
+}
+
+// NewEngine returns a client or server engine with the given configuration.
+// The engine always operates in non-blocking mode.
+func NewEngine(config *Config, isClient bool) *Engine {
+	transport := &memoryConn{}
+	c := NewConn(transport, config, isClient)
+	c.nonblocking = true
+	c.hIn.nonblocking = true
+	return &Engine{Conn: c, transport: transport}
+}
+
+// Input provides the engine with bytes received from the peer.  They are
+// processed by the next call to Handshake or Read.
+func (e *Engine) Input(data []byte) {
+	e.transport.Lock()
+	defer e.transport.Unlock()
+
+	e.transport.in.Write(data)
+}
+
+// Output returns the bytes that the engine has produced for the peer since the
+// last call, or nil if there are none.
+func (e *Engine) Output() []byte {
+	e.transport.Lock()
+	defer e.transport.Unlock()
+
+	if e.transport.out.Len() == 0 {
+		return nil
+	}
+
+	data := make([]byte, e.transport.out.Len())
+	copy(data, e.transport.out.Bytes())
+	e.transport.out.Reset()
+	return data
+}
@@ -0,0 +1,335 @@
+package mint
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// runEngines passes data between two engines until neither makes progress
+func runEngines(client, server *Engine) (clientErr, serverErr error) {
+	for i := 0; i < 10; i++ {
+		clientErr = client.Handshake()
+		server.Input(client.Output())
+		serverErr = server.Handshake()
+		client.Input(server.Output())
+
+		if clientErr != WouldBlock && serverErr != WouldBlock {
+			break
+		}
+	}
+	return
+}
+
+// inputBytewise feeds data to an engine one byte at a time, checking that
+// the handshake only blocks until the last byte arrives
+func inputBytewise(t *testing.T, e *Engine, data []byte) error {
+	err := WouldBlock
+	for i := range data {
+		assertEquals(t, err, WouldBlock)
+		e.Input(data[i : i+1])
+		err = e.Handshake()
+	}
+	return err
+}
+
+func TestEngineHandshake(t *testing.T) {
+	client := NewEngine(basicConfig, true)
+	server := NewEngine(basicConfig, false)
+
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assertDeepEquals(t, client.state.Params, server.state.Params)
+	assertByteEquals(t, client.state.clientTrafficSecret, server.state.clientTrafficSecret)
+	assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
+
+	// Reads block until data has been provided
+	buf := make([]byte, 10)
+	_, err := server.Read(buf)
+	assertEquals(t, err, WouldBlock)
+
+	n, err := client.Write([]byte("hello"))
+	assertNotError(t, err, "Engine write failed")
+	assertEquals(t, n, 5)
+	server.Input(client.Output())
+
+	n, err = server.Read(buf)
+	assertNotError(t, err, "Engine read failed")
+	assertEquals(t, string(buf[:n]), "hello")
+
+	// Output is drained
+	assertEquals(t, len(client.Output()), 0)
+}
+
+func TestEngineBytewiseInput(t *testing.T) {
+	client := NewEngine(basicConfig, true)
+	server := NewEngine(basicConfig, false)
+
+	assertEquals(t, client.Handshake(), WouldBlock)
+	assertEquals(t, inputBytewise(t, server, client.Output()), WouldBlock)
+	assertNotError(t, inputBytewise(t, client, server.Output()), "Client handshake failed")
+	assertNotError(t, inputBytewise(t, server, client.Output()), "Server handshake failed")
+	assertByteEquals(t, client.state.serverTrafficSecret, server.state.serverTrafficSecret)
+}
+
+func TestEngineEarlyData(t *testing.T) {
+	earlyData := []byte("hello 0xRTT world!")
+
+	// Test that accepted early data is read, even when it arrives in pieces
+	client := NewEngine(pskConfig, true)
+	client.EarlyData = earlyData
+	server := NewEngine(pskConfig, false)
+
+	assertEquals(t, client.Handshake(), WouldBlock)
+	assertEquals(t, inputBytewise(t, server, client.Output()), WouldBlock)
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, server.State().UsingEarlyData, "Server did not accept early data")
+	assertByteEquals(t, server.EarlyData, earlyData)
+
+	// Test that rejected early data is skipped, even when it arrives in pieces
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
+	}
+	serverConfig := &Config{
+		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Certificates: certificates,
+	}
+
+	client = NewEngine(clientConfig, true)
+	client.EarlyData = earlyData
+	server = NewEngine(serverConfig, false)
+
+	assertEquals(t, client.Handshake(), WouldBlock)
+	assertEquals(t, inputBytewise(t, server, client.Output()), WouldBlock)
+	clientErr, serverErr = runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, !server.State().UsingEarlyData, "Server accepted early data")
+	assertEquals(t, len(server.EarlyData), 0)
+}
+
+func TestEngineReadEarlyData(t *testing.T) {
+	earlyData := []byte("hello 0xRTT world!")
+	appData := []byte("hello 1xRTT world!")
+	buf := make([]byte, 1024)
+
+	// Test that early data is read before the client's Finished arrives
+	client := NewEngine(pskConfig, true)
+	client.EarlyData = earlyData
+	server := NewEngine(pskConfig, false)
+
+	assertEquals(t, client.Handshake(), WouldBlock)
+	server.Input(client.Output())
+
+	n, err := server.ReadEarlyData(buf[:5])
+	assertNotError(t, err, "Failed to read early data")
+	assertByteEquals(t, buf[:n], earlyData[:5])
+	n, err = server.ReadEarlyData(buf)
+	assertNotError(t, err, "Failed to read early data")
+	assertByteEquals(t, buf[:n], earlyData[5:])
+	_, err = server.ReadEarlyData(buf)
+	assertEquals(t, err, WouldBlock)
+
+	// Test that early data ends with the handshake, and later data is not early
+	client.Input(server.Output())
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, server.State().UsingEarlyData, "Server did not accept early data")
+
+	_, err = server.ReadEarlyData(buf)
+	assertEquals(t, err, io.EOF)
+
+	_, err = client.Write(appData)
+	assertNotError(t, err, "Failed to write application data")
+	server.Input(client.Output())
+	n, err = server.Read(buf)
+	assertNotError(t, err, "Failed to read application data")
+	assertByteEquals(t, buf[:n], appData)
+
+	// Test that there is no early data when it is rejected
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
+	}
+	serverConfig := &Config{
+		CipherSuites: []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Certificates: certificates,
+	}
+
+	client = NewEngine(clientConfig, true)
+	client.EarlyData = earlyData
+	server = NewEngine(serverConfig, false)
+
+	assertEquals(t, client.Handshake(), WouldBlock)
+	server.Input(client.Output())
+	_, err = server.ReadEarlyData(buf)
+	assertEquals(t, err, io.EOF)
+
+	// Test that early data with an external PSK is limited by the configured
+	// size, which defaults to 16 KiB
+	for _, maxEarlyDataSize := range []uint32{0, 4} {
+		serverConfig = &Config{
+			ServerName:       serverName,
+			CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+			PSKs:             psks,
+			AllowEarlyData:   true,
+			MaxEarlyDataSize: maxEarlyDataSize,
+		}
+
+		client = NewEngine(pskConfig, true)
+		client.EarlyData = earlyData
+		if maxEarlyDataSize == 0 {
+			client.EarlyData = make([]byte, defaultMaxEarlyDataSize+1)
+		}
+		server = NewEngine(serverConfig, false)
+
+		assertEquals(t, client.Handshake(), WouldBlock)
+		server.Input(client.Output())
+		assertEquals(t, server.Handshake(), AlertError{Alert: AlertUnexpectedMessage})
+	}
+
+	// Test that clients cannot read early data
+	_, err = client.ReadEarlyData(buf)
+	assertError(t, err, "Client read early data")
+}
+
+func TestEngineTicketEarlyData(t *testing.T) {
+	earlyData := []byte("hello 0xRTT world!")
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}
+	newServerConfig := func(allowEarlyData bool, maxEarlyDataSize uint32) *Config {
+		return &Config{
+			Certificates:       certificates,
+			SendSessionTickets: true,
+			TicketLifetime:     3600,
+			AllowEarlyData:     allowEarlyData,
+			MaxEarlyDataSize:   maxEarlyDataSize,
+			SessionTicketKeys:  [][32]byte{ticketKey1},
+		}
+	}
+	getTicket := func(serverConfig *Config) PreSharedKey {
+		client := NewEngine(clientConfig, true)
+		server := NewEngine(serverConfig, false)
+		clientErr, serverErr := runEngines(client, server)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+
+		_, err := client.Read(make([]byte, 1))
+		assertEquals(t, err, WouldBlock)
+		psk, ok := clientConfig.PSKs.Get(serverName)
+		assert(t, ok, "Client did not store ticket")
+		return psk
+	}
+	resume := func(serverConfig *Config) (*Engine, *Engine) {
+		client := NewEngine(clientConfig, true)
+		client.EarlyData = earlyData
+		server := NewEngine(serverConfig, false)
+		clientErr, serverErr := runEngines(client, server)
+		assertNotError(t, clientErr, "Client handshake failed")
+		assertNotError(t, serverErr, "Server handshake failed")
+		assert(t, client.State().DidResume, "Client did not resume")
+		return client, server
+	}
+
+	// Test that early data is sent within the advertised size
+	serverConfig := newServerConfig(true, 1024)
+	psk := getTicket(serverConfig)
+	assertEquals(t, psk.MaxEarlyDataSize, uint32(1024))
+	client, server := resume(serverConfig)
+	assert(t, client.State().UsingEarlyData, "Client did not send early data")
+	assertByteEquals(t, server.EarlyData, earlyData)
+
+	// Test that a limit of zero is advertised as the default limit
+	psk = getTicket(newServerConfig(true, 0))
+	assertEquals(t, psk.MaxEarlyDataSize, defaultMaxEarlyDataSize)
+
+	// Test that early data is not sent beyond the advertised size
+	serverConfig = newServerConfig(true, 4)
+	psk = getTicket(serverConfig)
+	assertEquals(t, psk.MaxEarlyDataSize, uint32(4))
+	client, server = resume(serverConfig)
+	assert(t, !client.State().UsingEarlyData, "Client sent too much early data")
+	assertEquals(t, len(server.EarlyData), 0)
+
+	// Test that early data is not sent if the ticket does not allow it
+	serverConfig = newServerConfig(false, 1024)
+	psk = getTicket(serverConfig)
+	assertEquals(t, psk.MaxEarlyDataSize, uint32(0))
+	client, server = resume(serverConfig)
+	assert(t, !client.State().UsingEarlyData, "Client sent early data without permission")
+	assertEquals(t, len(server.EarlyData), 0)
+
+	// Test that too much early data is refused, whether it is accepted or
+	// skipped.  The alert follows the server's first flight, so the client
+	// sees it after finishing the handshake.
+	for _, rejectEarlyData := range []bool{false, true} {
+		serverConfig = newServerConfig(true, 4)
+		psk = getTicket(serverConfig)
+		psk.MaxEarlyDataSize = 1024
+		if rejectEarlyData {
+			serverConfig.AntiReplay = NewClientHelloRecorder(time.Second, 16)
+			psk.ReceivedAt = psk.ReceivedAt.Add(-time.Minute)
+		}
+		clientConfig.PSKs = &PSKListCache{}
+		clientConfig.PSKs.Put(serverName, psk)
+
+		client = NewEngine(clientConfig, true)
+		client.EarlyData = earlyData
+		server = NewEngine(serverConfig, false)
+		assertEquals(t, client.Handshake(), WouldBlock)
+		server.Input(client.Output())
+		assertEquals(t, server.Handshake(), AlertError{Alert: AlertUnexpectedMessage})
+
+		client.Input(server.Output())
+		assertNotError(t, client.Handshake(), "Client handshake failed")
+		_, err := client.Read(make([]byte, 1))
+		assertEquals(t, err, AlertError{Alert: AlertUnexpectedMessage, Remote: true})
+	}
+
+	// Test that a ticket age out of tolerance only costs the early data
+	serverConfig = newServerConfig(true, 1024)
+	psk = getTicket(serverConfig)
+	psk.ReceivedAt = psk.ReceivedAt.Add(-time.Minute)
+	clientConfig.PSKs = &PSKListCache{}
+	clientConfig.PSKs.Put(serverName, psk)
+	client, server = resume(serverConfig)
+	assert(t, !client.State().UsingEarlyData, "Client reported early data")
+	assert(t, !server.State().UsingEarlyData, "Server accepted stale early data")
+	assertEquals(t, len(server.EarlyData), 0)
+}
+
+func TestEngineChangeCipherSpec(t *testing.T) {
+	ccs := unhex(changeCipherSpecHex)
+
+	// change_cipher_spec records are dropped during the handshake
+	client := NewEngine(basicConfig, true)
+	server := NewEngine(basicConfig, false)
+	assertEquals(t, client.Handshake(), WouldBlock)
+	server.Input(append(client.Output(), ccs...))
+	assertEquals(t, server.Handshake(), WouldBlock)
+	client.Input(append(ccs, server.Output()...))
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+
+	// ... but not after it
+	client.Input(ccs)
+	_, err := client.Read(make([]byte, 10))
+	assertDeepEquals(t, err, AlertError{Alert: AlertUnexpectedMessage})
+
+	// ... or before the ClientHello
+	server = NewEngine(basicConfig, false)
+	server.Input(ccs)
+	assertDeepEquals(t, server.Handshake(), AlertError{Alert: AlertUnexpectedMessage})
+}
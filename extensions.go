@@ -445,40 +445,62 @@ func (pkem *PSKKeyExchangeModesExtension) Unmarshal(data []byte) (int, error) {
 }
 
 // struct {
+//     select (Handshake.msg_type) {
+//         case new_session_ticket:   uint32 max_early_data_size;
+//         case client_hello:         Empty;
+//         case encrypted_extensions: Empty;
+//     };
 // } EarlyDataIndication;
+//
+// The zero HandshakeType is treated like client_hello, since most uses of this
+// extension have an empty body.
+type EarlyDataExtension struct {
+	HandshakeType    HandshakeType
+	MaxEarlyDataSize uint32
+}
 
-type EarlyDataExtension struct{}
+type earlyDataTicketInner struct {
+	MaxEarlyDataSize uint32
+}
 
 func (ed EarlyDataExtension) Type() ExtensionType {
 	return ExtensionTypeEarlyData
 }
 
 func (ed EarlyDataExtension) Marshal() ([]byte, error) {
+	if ed.HandshakeType == HandshakeTypeNewSessionTicket {
+		return syntax.Marshal(earlyDataTicketInner{ed.MaxEarlyDataSize})
+	}
 	return []byte{}, nil
 }
 
 func (ed *EarlyDataExtension) Unmarshal(data []byte) (int, error) {
+	if ed.HandshakeType == HandshakeTypeNewSessionTicket {
+		var inner earlyDataTicketInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return 0, err
+		}
+
+		ed.MaxEarlyDataSize = inner.MaxEarlyDataSize
+		return read, nil
+	}
 	return 0, nil
 }
 
-// struct {
-//     uint32 max_early_data_size;
-// } TicketEarlyDataInfo;
-
-type TicketEarlyDataInfoExtension struct {
-	MaxEarlyDataSize uint32
-}
+// struct {} PostHandshakeAuth;
+type PostHandshakeAuthExtension struct{}
 
-func (tedi TicketEarlyDataInfoExtension) Type() ExtensionType {
-	return ExtensionTypeTicketEarlyDataInfo
+func (pha PostHandshakeAuthExtension) Type() ExtensionType {
+	return ExtensionTypePostHandshakeAuth
 }
 
-func (tedi TicketEarlyDataInfoExtension) Marshal() ([]byte, error) {
-	return syntax.Marshal(tedi)
+func (pha PostHandshakeAuthExtension) Marshal() ([]byte, error) {
+	return []byte{}, nil
 }
 
-func (tedi *TicketEarlyDataInfoExtension) Unmarshal(data []byte) (int, error) {
-	return syntax.Unmarshal(data, tedi)
+func (pha *PostHandshakeAuthExtension) Unmarshal(data []byte) (int, error) {
+	return 0, nil
 }
 
 // opaque ProtocolName<1..2^8-1>;
@@ -526,22 +548,73 @@ func (alpn *ALPNExtension) Unmarshal(data []byte) (int, error) {
 }
 
 // struct {
-//     ProtocolVersion versions<2..254>;
+//     select (Handshake.msg_type) {
+//         case client_hello:
+//              ProtocolVersion versions<2..254>;
+//
+//         case server_hello: /* and HelloRetryRequest */
+//              ProtocolVersion selected_version;
+//     };
 // } SupportedVersions;
 type SupportedVersionsExtension struct {
+	HandshakeType HandshakeType
+	Versions      []uint16
+}
+
+type SupportedVersionsClientHelloInner struct {
 	Versions []uint16 `tls:"head=1,min=2,max=254"`
 }
 
+type SupportedVersionsServerHelloInner struct {
+	Version uint16
+}
+
 func (sv SupportedVersionsExtension) Type() ExtensionType {
 	return ExtensionTypeSupportedVersions
 }
 
 func (sv SupportedVersionsExtension) Marshal() ([]byte, error) {
-	return syntax.Marshal(sv)
+	switch sv.HandshakeType {
+	case HandshakeTypeClientHello:
+		return syntax.Marshal(SupportedVersionsClientHelloInner{sv.Versions})
+
+	case HandshakeTypeServerHello, HandshakeTypeHelloRetryRequest:
+		if len(sv.Versions) != 1 {
+			return nil, fmt.Errorf("tls.supportedversions: Server must select exactly one version")
+		}
+
+		return syntax.Marshal(SupportedVersionsServerHelloInner{sv.Versions[0]})
+
+	default:
+		return nil, fmt.Errorf("tls.supportedversions: Handshake type not allowed")
+	}
 }
 
 func (sv *SupportedVersionsExtension) Unmarshal(data []byte) (int, error) {
-	return syntax.Unmarshal(data, sv)
+	switch sv.HandshakeType {
+	case HandshakeTypeClientHello:
+		var inner SupportedVersionsClientHelloInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return 0, err
+		}
+
+		sv.Versions = inner.Versions
+		return read, nil
+
+	case HandshakeTypeServerHello, HandshakeTypeHelloRetryRequest:
+		var inner SupportedVersionsServerHelloInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return 0, err
+		}
+
+		sv.Versions = []uint16{inner.Version}
+		return read, nil
+
+	default:
+		return 0, fmt.Errorf("tls.supportedversions: Handshake type not allowed")
+	}
 }
 
 // struct {
@@ -574,3 +647,24 @@ func NewCookie() (*CookieExtension, error) {
 	_, err := prng.Read(cookie.Cookie)
 	return cookie, err
 }
+
+// opaque TransportParameters<0..2^16-1>;
+//
+// The QUIC transport parameters are opaque to TLS, so the extension body is
+// carried as-is.  See RFC 9001, Section 8.2.
+type QUICTransportParametersExtension struct {
+	Parameters []byte
+}
+
+func (tp QUICTransportParametersExtension) Type() ExtensionType {
+	return ExtensionTypeQUICTransportParameters
+}
+
+func (tp QUICTransportParametersExtension) Marshal() ([]byte, error) {
+	return append([]byte{}, tp.Parameters...), nil
+}
+
+func (tp *QUICTransportParametersExtension) Unmarshal(data []byte) (int, error) {
+	tp.Parameters = append([]byte{}, data...)
+	return len(data), nil
+}
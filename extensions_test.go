@@ -124,6 +124,13 @@ var (
 		HandshakeType: HandshakeTypeHelloRetryRequest,
 	}
 
+	// SupportedVersions test cases (server side)
+	supportedVersionsServerIn = &SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeServerHello,
+		Versions:      []uint16{0x0304},
+	}
+	supportedVersionsServerHex = "0304"
+
 	// SNI test cases (pre-declared so that we can take references in the test case)
 	serverNameRaw = "example.com"
 	serverNameIn  = ServerNameExtension(serverNameRaw)
@@ -181,11 +188,19 @@ var validExtensionTestCases = map[ExtensionType]struct {
 		marshaledHex: "",
 	},
 
+	// PostHandshakeAuth
+	ExtensionTypePostHandshakeAuth: {
+		blank:        &PostHandshakeAuthExtension{},
+		unmarshaled:  &PostHandshakeAuthExtension{},
+		marshaledHex: "",
+	},
+
 	// SupportedVersions
 	ExtensionTypeSupportedVersions: {
-		blank: &SupportedVersionsExtension{},
+		blank: &SupportedVersionsExtension{HandshakeType: HandshakeTypeClientHello},
 		unmarshaled: &SupportedVersionsExtension{
-			Versions: []uint16{0x0300, 0x0304},
+			HandshakeType: HandshakeTypeClientHello,
+			Versions:      []uint16{0x0300, 0x0304},
 		},
 		marshaledHex: "0403000304",
 	},
@@ -211,11 +226,11 @@ var validExtensionTestCases = map[ExtensionType]struct {
 		marshaledHex: "020001",
 	},
 
-	// TicketEarlyDataInfo
-	ExtensionTypeTicketEarlyDataInfo: {
-		blank: &TicketEarlyDataInfoExtension{},
-		unmarshaled: &TicketEarlyDataInfoExtension{
-			MaxEarlyDataSize: 0x01020304,
+	// QUICTransportParameters
+	ExtensionTypeQUICTransportParameters: {
+		blank: &QUICTransportParametersExtension{},
+		unmarshaled: &QUICTransportParametersExtension{
+			Parameters: []byte{0x01, 0x02, 0x03, 0x04},
 		},
 		marshaledHex: "01020304",
 	},
@@ -383,6 +398,52 @@ func TestServerNameMarshalUnmarshal(t *testing.T) {
 	serverName[2]--
 }
 
+func TestSupportedVersionsMarshalUnmarshal(t *testing.T) {
+	supportedVersionsServer := unhex(supportedVersionsServerHex)
+
+	// Test successful marshal (server side)
+	out, err := supportedVersionsServerIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid SupportedVersions (server)")
+	assertByteEquals(t, out, supportedVersionsServer)
+
+	// Test successful marshal (hello retry)
+	supportedVersionsServerIn.HandshakeType = HandshakeTypeHelloRetryRequest
+	out, err = supportedVersionsServerIn.Marshal()
+	assertNotError(t, err, "Failed to marshal valid SupportedVersions (hello retry)")
+	assertByteEquals(t, out, supportedVersionsServer)
+	supportedVersionsServerIn.HandshakeType = HandshakeTypeServerHello
+
+	// Test marshal failure on server selecting multiple versions
+	sv := SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeServerHello,
+		Versions:      []uint16{0x0304, 0x7f1c},
+	}
+	_, err = sv.Marshal()
+	assertError(t, err, "Marshaled multiple versions for server")
+
+	// Test marshal failure on an unsupported handshake type
+	sv.HandshakeType = HandshakeTypeCertificate
+	_, err = sv.Marshal()
+	assertError(t, err, "Marshaled an unsupported handshake type")
+
+	// Test successful unmarshal (server side)
+	sv = SupportedVersionsExtension{HandshakeType: HandshakeTypeServerHello}
+	read, err := sv.Unmarshal(supportedVersionsServer)
+	assertNotError(t, err, "Failed to unmarshal valid SupportedVersions (server)")
+	assertDeepEquals(t, &sv, supportedVersionsServerIn)
+	assertEquals(t, read, len(supportedVersionsServer))
+
+	// Test unmarshal failure on a truncated version
+	sv = SupportedVersionsExtension{HandshakeType: HandshakeTypeServerHello}
+	_, err = sv.Unmarshal(supportedVersionsServer[:1])
+	assertError(t, err, "Unmarshaled a truncated SupportedVersions")
+
+	// Test unmarshal failure on an unsupported handshake type
+	sv = SupportedVersionsExtension{HandshakeType: HandshakeTypeCertificate}
+	_, err = sv.Unmarshal(supportedVersionsServer)
+	assertError(t, err, "Unmarshaled an unsupported handshake type")
+}
+
 func TestKeyShareMarshalUnmarshal(t *testing.T) {
 	keyShareClient := unhex(keyShareClientHex)
 	keyShareHelloRetry := unhex(keyShareHelloRetryHex)
@@ -556,6 +617,40 @@ func TestPreSharedKeyMarshalUnmarshal(t *testing.T) {
 	assert(t, !found, "Found a not-present identity")
 }
 
+func TestEarlyDataMarshalUnmarshal(t *testing.T) {
+	ticketEarlyData := unhex("01020304")
+
+	// Test successful marshal (ticket)
+	ed := EarlyDataExtension{
+		HandshakeType:    HandshakeTypeNewSessionTicket,
+		MaxEarlyDataSize: 0x01020304,
+	}
+	out, err := ed.Marshal()
+	assertNotError(t, err, "Failed to marshal valid EarlyData (ticket)")
+	assertByteEquals(t, out, ticketEarlyData)
+
+	// Test successful unmarshal (ticket)
+	ed = EarlyDataExtension{HandshakeType: HandshakeTypeNewSessionTicket}
+	read, err := ed.Unmarshal(ticketEarlyData)
+	assertNotError(t, err, "Failed to unmarshal valid EarlyData (ticket)")
+	assertEquals(t, read, len(ticketEarlyData))
+	assertEquals(t, ed.MaxEarlyDataSize, uint32(0x01020304))
+
+	// Test unmarshal failure on a truncated body (ticket)
+	ed = EarlyDataExtension{HandshakeType: HandshakeTypeNewSessionTicket}
+	_, err = ed.Unmarshal(ticketEarlyData[:2])
+	assertError(t, err, "Unmarshaled a truncated EarlyData (ticket)")
+
+	// Test that the body is empty in other messages
+	ed = EarlyDataExtension{
+		HandshakeType:    HandshakeTypeEncryptedExtensions,
+		MaxEarlyDataSize: 0x01020304,
+	}
+	out, err = ed.Marshal()
+	assertNotError(t, err, "Failed to marshal valid EarlyData (encrypted extensions)")
+	assertEquals(t, len(out), 0)
+}
+
 func TestALPNMarshalUnmarshal(t *testing.T) {
 	alpnHex := validExtensionTestCases[ExtensionTypeALPN].marshaledHex
 	alpn := unhex(alpnHex)
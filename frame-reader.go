@@ -52,6 +52,12 @@ func (f *frameReader) needed() int {
 	return tmp
 }
 
+// buffering reports whether part of a frame has been added but not yet
+// returned
+func (f *frameReader) buffering() bool {
+	return f.state == kFrameReaderBody || f.writeOffset > 0 || len(f.remainder) > 0
+}
+
 func (f *frameReader) addChunk(in []byte) {
 	// Append to the buffer.
 	logf(logTypeFrameReader, "Appending %v", len(in))
@@ -9,6 +9,7 @@ var structs = []interface{}{
 	// Handshake messages
 	&ClientHelloBody{},
 	&ServerHelloBody{},
+	&HelloRetryRequestBody{},
 	&FinishedBody{VerifyDataLen: 32},
 	&EncryptedExtensionsBody{},
 	&CertificateBody{},
@@ -26,13 +27,15 @@ var structs = []interface{}{
 	&SignatureAlgorithmsExtension{},
 	&PreSharedKeyExtension{HandshakeType: HandshakeTypeClientHello},
 	&PreSharedKeyExtension{HandshakeType: HandshakeTypeServerHello},
-	&SupportedVersionsExtension{},
+	&SupportedVersionsExtension{HandshakeType: HandshakeTypeClientHello},
+	&SupportedVersionsExtension{HandshakeType: HandshakeTypeServerHello},
 }
 
 var validHex = []string{
 	// Handshake messages
 	chValidHex,
 	shValidHex,
+	hrrValidHex,
 	finValidHex,
 	encExtValidHex,
 	certValidHex,
@@ -51,6 +54,7 @@ var validHex = []string{
 	pskClientHex,
 	pskServerHex,
 	validExtensionTestCases[ExtensionTypeSupportedVersions].marshaledHex,
+	supportedVersionsServerHex,
 }
 
 func randomBytes(n int, rand *rand.Rand) []byte {
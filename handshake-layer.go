@@ -60,9 +60,11 @@ func (hm HandshakeMessage) ToBody() (HandshakeMessageBody, error) {
 	case HandshakeTypeClientHello:
 		body = new(ClientHelloBody)
 	case HandshakeTypeServerHello:
-		body = new(ServerHelloBody)
-	case HandshakeTypeHelloRetryRequest:
-		body = new(HelloRetryRequestBody)
+		if isHelloRetryRequest(hm.body) {
+			body = new(HelloRetryRequestBody)
+		} else {
+			body = new(ServerHelloBody)
+		}
 	case HandshakeTypeEncryptedExtensions:
 		body = new(EncryptedExtensionsBody)
 	case HandshakeTypeCertificate:
@@ -172,7 +174,6 @@ func (h *HandshakeLayer) sendAlert(err Alert) error {
 }
 
 func (h *HandshakeLayer) ReadMessage() (*HandshakeMessage, error) {
-	var hdr, body []byte
 	var err error
 
 	for {
@@ -185,14 +186,32 @@ func (h *HandshakeLayer) ReadMessage() (*HandshakeMessage, error) {
 			return nil, err
 		}
 
-		hdr, body, err = h.frame.process()
-		if err == nil {
-			break
-		}
-		if err != nil && (h.nonblocking || err != WouldBlock) {
-			return nil, err
+		// An incomplete message means that we need another record, which may
+		// already be buffered, so only the record layer decides whether we
+		// would block
+		hm, err := h.readBufferedMessage()
+		if err != WouldBlock {
+			return hm, err
 		}
 	}
+}
+
+// handleRecord buffers the contents of a handshake record that has been read
+// by someone else, as with post-handshake messages, which arrive among
+// application data.  The messages it completes are then returned by
+// readBufferedMessage.
+func (h *HandshakeLayer) handleRecord(fragment []byte) {
+	logf(logTypeIO, "handle handshake record of len %v", len(fragment))
+	h.frame.addChunk(fragment)
+}
+
+// readBufferedMessage returns the next handshake message from the records
+// that have been buffered, or WouldBlock if the message is not yet complete.
+func (h *HandshakeLayer) readBufferedMessage() (*HandshakeMessage, error) {
+	hdr, body, err := h.frame.process()
+	if err != nil {
+		return nil, err
+	}
 
 	logf(logTypeHandshake, "read handshake message")
 
@@ -205,6 +224,11 @@ func (h *HandshakeLayer) ReadMessage() (*HandshakeMessage, error) {
 	return hm, nil
 }
 
+// partialMessage reports whether part of a handshake message is buffered
+func (h *HandshakeLayer) partialMessage() bool {
+	return h.frame.buffering()
+}
+
 func (h *HandshakeLayer) WriteMessage(hm *HandshakeMessage) error {
 	return h.WriteMessages([]*HandshakeMessage{hm})
 }
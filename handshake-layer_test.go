@@ -19,7 +19,7 @@ func (e ErrorReadWriter) Write(p []byte) (n int, err error) {
 
 func recordHeaderHex(data []byte) string {
 	dataLen := len(data)
-	return hex.EncodeToString([]byte{0x16, 0x03, 0x01, byte(dataLen >> 8), byte(dataLen)})
+	return hex.EncodeToString([]byte{0x16, 0x03, 0x03, byte(dataLen >> 8), byte(dataLen)})
 }
 
 var (
@@ -72,8 +72,8 @@ var (
 		recordHeaderHex(slsFragment2) + hex.EncodeToString(slsFragment2) +
 		recordHeaderHex(slsFragment3) + hex.EncodeToString(slsFragment3)
 
-	insufficientDataHex = "1603010004" + "01000004" + "1603010002" + "0000"
-	nonHandshakeHex     = "15030100020000"
+	insufficientDataHex = "1603030004" + "01000004" + "1603030002" + "0000"
+	nonHandshakeHex     = "15030300020000"
 )
 
 func TestMessageMarshal(t *testing.T) {
@@ -103,6 +103,13 @@ func TestMessageToBody(t *testing.T) {
 	_, err = hm.ToBody()
 	assertNotError(t, err, "Failed to convert ServerHello body")
 
+	// Test successful marshal of HelloRetryRequest
+	hm = HandshakeMessage{HandshakeTypeServerHello, unhex(hrrValidHex)}
+	body, err := hm.ToBody()
+	assertNotError(t, err, "Failed to convert HelloRetryRequest body")
+	_, ok := body.(*HelloRetryRequestBody)
+	assert(t, ok, "HelloRetryRequest converted to the wrong type")
+
 	// Test successful marshal of EncryptedExtensions
 	hm = HandshakeMessage{HandshakeTypeEncryptedExtensions, encExtValid}
 	_, err = hm.ToBody()
@@ -177,6 +184,14 @@ func TestReadHandshakeMessage(t *testing.T) {
 	assertNotError(t, err, "Failed to read a long handshake message")
 	assertDeepEquals(t, hm, longMessageIn)
 
+	// Test that a non-blocking read does not stop between records
+	b = bytes.NewBuffer(long)
+	h = NewHandshakeLayer(NewRecordLayer(b))
+	h.nonblocking = true
+	hm, err = h.ReadMessage()
+	assertNotError(t, err, "Failed to read a long handshake message without blocking")
+	assertDeepEquals(t, hm, longMessageIn)
+
 	// Test successful read of multiple messages sequentially
 	b = bytes.NewBuffer(shortLongShort)
 	h = NewHandshakeLayer(NewRecordLayer(b))
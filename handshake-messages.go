@@ -26,11 +26,11 @@ type HandshakeMessageBody interface {
 // } ClientHello;
 type ClientHelloBody struct {
 	// Omitted: clientVersion
-	// Omitted: legacySessionID
 	// Omitted: legacyCompressionMethods
-	Random       [32]byte
-	CipherSuites []CipherSuite
-	Extensions   ExtensionList
+	Random          [32]byte
+	LegacySessionID []byte
+	CipherSuites    []CipherSuite
+	Extensions      ExtensionList
 }
 
 type clientHelloBodyInner struct {
@@ -48,9 +48,9 @@ func (ch ClientHelloBody) Type() HandshakeType {
 
 func (ch ClientHelloBody) Marshal() ([]byte, error) {
 	return syntax.Marshal(clientHelloBodyInner{
-		LegacyVersion:            0x0303,
+		LegacyVersion:            tls12Version,
 		Random:                   ch.Random,
-		LegacySessionID:          []byte{},
+		LegacySessionID:          ch.LegacySessionID,
 		CipherSuites:             ch.CipherSuites,
 		LegacyCompressionMethods: []byte{0},
 		Extensions:               ch.Extensions,
@@ -65,7 +65,7 @@ func (ch *ClientHelloBody) Unmarshal(data []byte) (int, error) {
 	}
 
 	// We are strict about these things because we only support 1.3
-	if inner.LegacyVersion != 0x0303 {
+	if inner.LegacyVersion != tls12Version {
 		return 0, fmt.Errorf("tls.clienthello: Incorrect version number")
 	}
 
@@ -74,6 +74,7 @@ func (ch *ClientHelloBody) Unmarshal(data []byte) (int, error) {
 	}
 
 	ch.Random = inner.Random
+	ch.LegacySessionID = inner.LegacySessionID
 	ch.CipherSuites = inner.CipherSuites
 	ch.Extensions = inner.Extensions
 	return read, nil
@@ -115,40 +116,95 @@ func (ch ClientHelloBody) Truncated() ([]byte, error) {
 	return chData[:chLen-binderLen], nil
 }
 
+// A HelloRetryRequest is a ServerHello with a fixed random value, so it has
+// the same syntax as a ServerHello, but at least one extension is required.
+//
 // struct {
-//     ProtocolVersion server_version;
-//     CipherSuite	cipher_suite;
+//     ProtocolVersion legacy_version = 0x0303;
+//     Random random = helloRetryRequestRandom;
+//     opaque legacy_session_id_echo<0..32>;
+//     CipherSuite cipher_suite;
+//     uint8 legacy_compression_method = 0;
 //     Extension extensions<2..2^16-1>;
 // } HelloRetryRequest;
 type HelloRetryRequestBody struct {
-	Version     uint16
-	CipherSuite CipherSuite
-	Extensions  ExtensionList `tls:"head=2,min=2"`
+	// Omitted: random
+	// Omitted: legacyCompressionMethod
+	Version         uint16
+	LegacySessionID []byte
+	CipherSuite     CipherSuite
+	Extensions      ExtensionList
+}
+
+type helloRetryRequestBodyInner struct {
+	Version                 uint16
+	Random                  [32]byte
+	LegacySessionID         []byte `tls:"head=1,max=32"`
+	CipherSuite             CipherSuite
+	LegacyCompressionMethod uint8
+	Extensions              ExtensionList `tls:"head=2,min=2"`
 }
 
 func (hrr HelloRetryRequestBody) Type() HandshakeType {
-	return HandshakeTypeHelloRetryRequest
+	return HandshakeTypeServerHello
 }
 
 func (hrr HelloRetryRequestBody) Marshal() ([]byte, error) {
-	return syntax.Marshal(hrr)
+	return syntax.Marshal(helloRetryRequestBodyInner{
+		Version:         hrr.Version,
+		Random:          helloRetryRequestRandom,
+		LegacySessionID: hrr.LegacySessionID,
+		CipherSuite:     hrr.CipherSuite,
+		Extensions:      hrr.Extensions,
+	})
 }
 
 func (hrr *HelloRetryRequestBody) Unmarshal(data []byte) (int, error) {
-	return syntax.Unmarshal(data, hrr)
+	var inner helloRetryRequestBodyInner
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return 0, err
+	}
+
+	if inner.Random != helloRetryRequestRandom {
+		return 0, fmt.Errorf("tls.helloretryrequest: Incorrect random value")
+	}
+
+	if inner.LegacyCompressionMethod != 0 {
+		return 0, fmt.Errorf("tls.helloretryrequest: Invalid compression method")
+	}
+
+	hrr.Version = inner.Version
+	hrr.LegacySessionID = inner.LegacySessionID
+	hrr.CipherSuite = inner.CipherSuite
+	hrr.Extensions = inner.Extensions
+	return read, nil
 }
 
 // struct {
-//     ProtocolVersion version;
+//     ProtocolVersion legacy_version = 0x0303;    /* TLS v1.2 */
 //     Random random;
+//     opaque legacy_session_id_echo<0..32>;
 //     CipherSuite cipher_suite;
-//     Extension extensions<0..2^16-1>;
+//     uint8 legacy_compression_method = 0;
+//     Extension extensions<6..2^16-1>;
 // } ServerHello;
 type ServerHelloBody struct {
-	Version     uint16
-	Random      [32]byte
-	CipherSuite CipherSuite
-	Extensions  ExtensionList `tls:"head=2"`
+	// Omitted: legacyCompressionMethod
+	Version         uint16
+	Random          [32]byte
+	LegacySessionID []byte
+	CipherSuite     CipherSuite
+	Extensions      ExtensionList
+}
+
+type serverHelloBodyInner struct {
+	Version                 uint16
+	Random                  [32]byte
+	LegacySessionID         []byte `tls:"head=1,max=32"`
+	CipherSuite             CipherSuite
+	LegacyCompressionMethod uint8
+	Extensions              ExtensionList `tls:"head=2"`
 }
 
 func (sh ServerHelloBody) Type() HandshakeType {
@@ -156,11 +212,43 @@ func (sh ServerHelloBody) Type() HandshakeType {
 }
 
 func (sh ServerHelloBody) Marshal() ([]byte, error) {
-	return syntax.Marshal(sh)
+	return syntax.Marshal(serverHelloBodyInner{
+		Version:         sh.Version,
+		Random:          sh.Random,
+		LegacySessionID: sh.LegacySessionID,
+		CipherSuite:     sh.CipherSuite,
+		Extensions:      sh.Extensions,
+	})
 }
 
 func (sh *ServerHelloBody) Unmarshal(data []byte) (int, error) {
-	return syntax.Unmarshal(data, sh)
+	var inner serverHelloBodyInner
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return 0, err
+	}
+
+	if inner.LegacyCompressionMethod != 0 {
+		return 0, fmt.Errorf("tls.serverhello: Invalid compression method")
+	}
+
+	sh.Version = inner.Version
+	sh.Random = inner.Random
+	sh.LegacySessionID = inner.LegacySessionID
+	sh.CipherSuite = inner.CipherSuite
+	sh.Extensions = inner.Extensions
+	return read, nil
+}
+
+// isHelloRetryRequest reports whether the body of a ServerHello message has
+// the random value that marks it as a HelloRetryRequest
+func isHelloRetryRequest(body []byte) bool {
+	const randomStart = 2
+	if len(body) < randomStart+len(helloRetryRequestRandom) {
+		return false
+	}
+
+	return bytes.Equal(body[randomStart:randomStart+len(helloRetryRequestRandom)], helloRetryRequestRandom[:])
 }
 
 // struct {
@@ -320,10 +408,14 @@ func (cv *CertificateVerifyBody) Unmarshal(data []byte) (int, error) {
 	return syntax.Unmarshal(data, cv)
 }
 
-func (cv *CertificateVerifyBody) EncodeSignatureInput(data []byte) []byte {
-	// TODO: Change context for client auth
-	// TODO: Put this in a const
-	const context = "TLS 1.3, server CertificateVerify"
+// Context strings for CertificateVerify signatures, which keep a signature
+// made by one side from being used as the other's
+const (
+	serverSignatureContext = "TLS 1.3, server CertificateVerify"
+	clientSignatureContext = "TLS 1.3, client CertificateVerify"
+)
+
+func (cv *CertificateVerifyBody) EncodeSignatureInput(context string, data []byte) []byte {
 	sigInput := bytes.Repeat([]byte{0x20}, 64)
 	sigInput = append(sigInput, []byte(context)...)
 	sigInput = append(sigInput, []byte{0}...)
@@ -331,15 +423,15 @@ func (cv *CertificateVerifyBody) EncodeSignatureInput(data []byte) []byte {
 	return sigInput
 }
 
-func (cv *CertificateVerifyBody) Sign(privateKey crypto.Signer, handshakeHash []byte) (err error) {
-	sigInput := cv.EncodeSignatureInput(handshakeHash)
+func (cv *CertificateVerifyBody) Sign(privateKey crypto.Signer, context string, handshakeHash []byte) (err error) {
+	sigInput := cv.EncodeSignatureInput(context, handshakeHash)
 	cv.Signature, err = sign(cv.Algorithm, privateKey, sigInput)
 	logf(logTypeHandshake, "Signed: alg=[%04x] sigInput=[%x], sig=[%x]", cv.Algorithm, sigInput, cv.Signature)
 	return
 }
 
-func (cv *CertificateVerifyBody) Verify(publicKey crypto.PublicKey, handshakeHash []byte) error {
-	sigInput := cv.EncodeSignatureInput(handshakeHash)
+func (cv *CertificateVerifyBody) Verify(publicKey crypto.PublicKey, context string, handshakeHash []byte) error {
+	sigInput := cv.EncodeSignatureInput(context, handshakeHash)
 	logf(logTypeHandshake, "About to verify: alg=[%04x] sigInput=[%x], sig=[%x]", cv.Algorithm, sigInput, cv.Signature)
 	return verify(cv.Algorithm, publicKey, sigInput, cv.Signature)
 }
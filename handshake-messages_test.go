@@ -2,6 +2,7 @@ package mint
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"testing"
@@ -9,7 +10,7 @@ import (
 
 const (
 	fixedClientHelloBodyLen  = 39
-	fixedServerHelloBodyLen  = 36
+	fixedServerHelloBodyLen  = 38
 	maxCipherSuites          = 1 << 15
 	maxExtensionDataLen      = (1 << 16) - 1
 	maxCertRequestContextLen = 255
@@ -17,9 +18,9 @@ const (
 )
 
 var (
-	supportedVersionHex = hex.EncodeToString([]byte{
-		byte(supportedVersion >> 8),
-		byte(supportedVersion),
+	legacyVersionHex = hex.EncodeToString([]byte{
+		byte(tls12Version >> 8),
+		byte(tls12Version),
 	})
 
 	// ClientHello test cases
@@ -30,9 +31,10 @@ var (
 		0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37}
 	chCipherSuites = []CipherSuite{0x0001, 0x0002, 0x0003}
 	chValidIn      = ClientHelloBody{
-		Random:       helloRandom,
-		CipherSuites: chCipherSuites,
-		Extensions:   extListValidIn,
+		Random:          helloRandom,
+		LegacySessionID: []byte{},
+		CipherSuites:    chCipherSuites,
+		Extensions:      extListValidIn,
 	}
 	chValidHex = "0303" + hex.EncodeToString(helloRandom[:]) + "00" +
 		"0006000100020003" + "0100" + extListValidHex
@@ -76,29 +78,35 @@ var (
 
 	// HelloRetryRequest test cases
 	hrrValidIn = HelloRetryRequestBody{
-		Version:     supportedVersion,
-		CipherSuite: 0x0001,
-		Extensions:  extListValidIn,
+		Version:         tls12Version,
+		LegacySessionID: []byte{},
+		CipherSuite:     0x0001,
+		Extensions:      extListValidIn,
 	}
 	hrrEmptyIn  = HelloRetryRequestBody{}
-	hrrValidHex = supportedVersionHex + "0001" + extListValidHex
-	hrrEmptyHex = supportedVersionHex + "0001" + "0000"
+	hrrValidHex = legacyVersionHex + hex.EncodeToString(helloRetryRequestRandom[:]) +
+		"00" + "0001" + "00" + extListValidHex
+	hrrEmptyHex = legacyVersionHex + hex.EncodeToString(helloRetryRequestRandom[:]) +
+		"00" + "0001" + "00" + "0000"
 
 	// ServerHello test cases
 	shValidIn = ServerHelloBody{
-		Version:     supportedVersion,
-		Random:      helloRandom,
-		CipherSuite: CipherSuite(0x0001),
-		Extensions:  extListValidIn,
+		Version:         tls12Version,
+		Random:          helloRandom,
+		LegacySessionID: []byte{},
+		CipherSuite:     CipherSuite(0x0001),
+		Extensions:      extListValidIn,
 	}
 	shEmptyIn = ServerHelloBody{
-		Version:     supportedVersion,
+		Version:     tls12Version,
 		Random:      helloRandom,
 		CipherSuite: CipherSuite(0x0001),
 	}
-	shValidHex    = supportedVersionHex + hex.EncodeToString(helloRandom[:]) + "0001" + extListValidHex
-	shEmptyHex    = supportedVersionHex + hex.EncodeToString(helloRandom[:]) + "0001" + "0000"
-	shOverflowHex = supportedVersionHex + hex.EncodeToString(helloRandom[:]) + "0001" + extListOverflowOuterHex
+	shValidHex     = legacyVersionHex + hex.EncodeToString(helloRandom[:]) + "00" + "0001" + "00" + extListValidHex
+	shEmptyHex     = legacyVersionHex + hex.EncodeToString(helloRandom[:]) + "00" + "0001" + "00" + "0000"
+	shOverflowHex  = legacyVersionHex + hex.EncodeToString(helloRandom[:]) + "00" + "0001" + "00" + extListOverflowOuterHex
+	shSessionIDHex = legacyVersionHex + hex.EncodeToString(helloRandom[:]) + "0401020304" + "0001" + "00" + "0000"
+	shBadCompHex   = legacyVersionHex + hex.EncodeToString(helloRandom[:]) + "00" + "0001" + "01" + "0000"
 
 	// Finished test cases
 	finValidIn = FinishedBody{
@@ -350,8 +358,8 @@ func TestHelloRetryRequestMarshalUnmarshal(t *testing.T) {
 	hrrValid := unhex(hrrValidHex)
 	hrrEmpty := unhex(hrrEmptyHex)
 
-	// Test correctness of handshake type
-	assertEquals(t, (HelloRetryRequestBody{}).Type(), HandshakeTypeHelloRetryRequest)
+	// Test correctness of handshake type (HRR is sent as a ServerHello)
+	assertEquals(t, (HelloRetryRequestBody{}).Type(), HandshakeTypeServerHello)
 
 	// Test successful marshal
 	out, err := hrrValidIn.Marshal()
@@ -372,6 +380,20 @@ func TestHelloRetryRequestMarshalUnmarshal(t *testing.T) {
 	// Test unmarshal failure with no extensions present
 	read, err = hrr.Unmarshal(hrrEmpty)
 	assertError(t, err, "Unmarshaled a HelloRetryRequest with no extensions")
+
+	// Test unmarshal failure on a ServerHello that is not an HRR
+	shValid := unhex(shValidHex)
+	read, err = hrr.Unmarshal(shValid)
+	assertError(t, err, "Unmarshaled a ServerHello as a HelloRetryRequest")
+
+	// Test that HRR and ServerHello are distinguished by their random values
+	assert(t, isHelloRetryRequest(hrrValid), "Failed to recognize a HelloRetryRequest")
+	assert(t, !isHelloRetryRequest(shValid), "Recognized a ServerHello as a HelloRetryRequest")
+	assert(t, !isHelloRetryRequest(hrrValid[:10]), "Recognized a truncated HelloRetryRequest")
+
+	// Test that the magic random value is correct
+	hrrRandom := sha256.Sum256([]byte("HelloRetryRequest"))
+	assertByteEquals(t, helloRetryRequestRandom[:], hrrRandom[:])
 }
 
 func TestServerHelloMarshalUnmarshal(t *testing.T) {
@@ -417,6 +439,18 @@ func TestServerHelloMarshalUnmarshal(t *testing.T) {
 	_, err = sh.Unmarshal(shValid[:fixedServerHelloBodyLen-1])
 	assertError(t, err, "Unmarshaled a too-short ServerHello")
 
+	// Test successful unmarshal with a session ID echo
+	shSessionID := unhex(shSessionIDHex)
+	read, err = sh.Unmarshal(shSessionID)
+	assertNotError(t, err, "Failed to unmarshal a ServerHello with a session ID")
+	assertEquals(t, read, len(shSessionID))
+	assertByteEquals(t, sh.LegacySessionID, []byte{1, 2, 3, 4})
+
+	// Test unmarshal failure on a compression method
+	shBadComp := unhex(shBadCompHex)
+	_, err = sh.Unmarshal(shBadComp)
+	assertError(t, err, "Unmarshaled a ServerHello with compression")
+
 	// Test unmarshal failure on extension list unmarshal failure
 	_, err = sh.Unmarshal(shOverflow)
 	assertError(t, err, "Unmarshaled a ServerHello with invalid extensions")
@@ -574,27 +608,31 @@ func TestCertificateVerifyMarshalUnmarshal(t *testing.T) {
 
 	// Test successful sign / verify round-trip
 	certVerifyValidIn.Algorithm = RSA_PSS_SHA256
-	err = certVerifyValidIn.Sign(privRSA, handshakeHash)
+	err = certVerifyValidIn.Sign(privRSA, serverSignatureContext, handshakeHash)
 	assertNotError(t, err, "Failed to sign CertificateVerify")
 
 	// Test sign failure on algorithm
 	originalAlg := certVerifyValidIn.Algorithm
 	certVerifyValidIn.Algorithm = SignatureScheme(0)
-	err = certVerifyValidIn.Sign(privRSA, handshakeHash)
+	err = certVerifyValidIn.Sign(privRSA, serverSignatureContext, handshakeHash)
 	assertError(t, err, "Signed CertificateVerify despite bad algorithm")
 	certVerifyValidIn.Algorithm = originalAlg
 
 	// Test successful verify
 	certVerifyValidIn = CertificateVerifyBody{Algorithm: RSA_PSS_SHA256}
-	err = certVerifyValidIn.Sign(privRSA, handshakeHash)
+	err = certVerifyValidIn.Sign(privRSA, serverSignatureContext, handshakeHash)
 	assertNotError(t, err, "Failed to sign CertificateVerify")
-	err = certVerifyValidIn.Verify(privRSA.Public(), handshakeHash)
+	err = certVerifyValidIn.Verify(privRSA.Public(), serverSignatureContext, handshakeHash)
 	assertNotError(t, err, "Failed to verify CertificateVerify")
 
+	// Test verify failure on the wrong context
+	err = certVerifyValidIn.Verify(privRSA.Public(), clientSignatureContext, handshakeHash)
+	assertError(t, err, "Verified CertificateVerify with the wrong context")
+
 	// Test verify failure on bad algorithm
 	originalAlg = certVerifyValidIn.Algorithm
 	certVerifyValidIn.Algorithm = SignatureScheme(0)
-	err = certVerifyValidIn.Verify(privRSA.Public(), handshakeHash)
+	err = certVerifyValidIn.Verify(privRSA.Public(), serverSignatureContext, handshakeHash)
 	assertError(t, err, "Verified CertificateVerify despite bad hash algorithm")
 	certVerifyValidIn.Algorithm = originalAlg
 }
@@ -0,0 +1,55 @@
+package mint
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Labels for the NSS key log format, which is understood by tools like
+// Wireshark.  Traffic secrets are numbered by key update generation.
+const (
+	keyLogLabelClientEarlyTraffic     = "CLIENT_EARLY_TRAFFIC_SECRET"
+	keyLogLabelClientHandshakeTraffic = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelServerHandshakeTraffic = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelClientTraffic          = "CLIENT_TRAFFIC_SECRET_"
+	keyLogLabelServerTraffic          = "SERVER_TRAFFIC_SECRET_"
+	keyLogLabelExporter               = "EXPORTER_SECRET"
+)
+
+// A KeyLogWriter can be shared among connections, so writes to it are
+// serialized
+var keyLogMutex sync.Mutex
+
+// keyLogger writes the secrets of one connection to a KeyLogWriter.  The zero
+// value discards them.
+type keyLogger struct {
+	writer       io.Writer
+	clientRandom []byte
+}
+
+func newKeyLogger(writer io.Writer, clientRandom [32]byte) keyLogger {
+	return keyLogger{writer: writer, clientRandom: clientRandom[:]}
+}
+
+// log writes a line of the form "<label> <client random> <secret>"
+func (kl keyLogger) log(label string, secret []byte) {
+	if kl.writer == nil {
+		return
+	}
+
+	keyLogMutex.Lock()
+	defer keyLogMutex.Unlock()
+
+	_, err := fmt.Fprintf(kl.writer, "%s %x %x\n", label, kl.clientRandom, secret)
+	if err != nil {
+		logf(logTypeCrypto, "Error writing key log: %v", err)
+	}
+}
+
+// logTraffic writes an application traffic secret, numbered by the number of
+// key updates that led to it
+func (kl keyLogger) logTraffic(label string, generation int, secret []byte) {
+	kl.log(label+strconv.Itoa(generation), secret)
+}
@@ -0,0 +1,76 @@
+package mint
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeyLogWriter(t *testing.T) {
+	clientLog := &bytes.Buffer{}
+	serverLog := &bytes.Buffer{}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:               psks,
+		KeyLogWriter:       clientLog,
+	}
+	serverConfig := &Config{
+		CipherSuites:   []CipherSuite{TLS_AES_128_GCM_SHA256},
+		Certificates:   certificates,
+		PSKs:           psks,
+		AllowEarlyData: true,
+		KeyLogWriter:   serverLog,
+	}
+
+	client := NewEngine(clientConfig, true)
+	client.EarlyData = []byte("hello 0xRTT world!")
+	server := NewEngine(serverConfig, false)
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, server.State().UsingEarlyData, "Server did not accept early data")
+
+	// Both sides log the same secrets, keyed by the ClientHello random
+	assertEquals(t, clientLog.String(), serverLog.String())
+
+	lines := strings.Split(strings.TrimSpace(clientLog.String()), "\n")
+	labels := []string{
+		"CLIENT_EARLY_TRAFFIC_SECRET",
+		"CLIENT_HANDSHAKE_TRAFFIC_SECRET",
+		"SERVER_HANDSHAKE_TRAFFIC_SECRET",
+		"CLIENT_TRAFFIC_SECRET_0",
+		"SERVER_TRAFFIC_SECRET_0",
+		"EXPORTER_SECRET",
+	}
+	assertEquals(t, len(lines), len(labels))
+
+	random := strings.Fields(lines[0])[1]
+	assertEquals(t, len(random), 64)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		assertEquals(t, len(fields), 3)
+		assertEquals(t, fields[0], labels[i])
+		assertEquals(t, fields[1], random)
+	}
+
+	assertEquals(t, lines[3], fmt.Sprintf("CLIENT_TRAFFIC_SECRET_0 %s %x", random, client.state.clientTrafficSecret))
+	assertEquals(t, lines[5], fmt.Sprintf("EXPORTER_SECRET %s %x", random, client.state.exporterSecret))
+
+	// Key updates log the next generation of traffic secret
+	clientLog.Reset()
+	serverLog.Reset()
+	err := client.SendKeyUpdate(true)
+	assertNotError(t, err, "Key update failed")
+	buf := make([]byte, 1)
+	server.Input(client.Output())
+	server.Read(buf)
+	client.Input(server.Output())
+	client.Read(buf)
+
+	assertEquals(t, clientLog.String(), fmt.Sprintf("CLIENT_TRAFFIC_SECRET_1 %s %x\nSERVER_TRAFFIC_SECRET_1 %s %x\n",
+		random, client.state.clientTrafficSecret, random, client.state.serverTrafficSecret))
+	assertEquals(t, serverLog.String(), clientLog.String())
+}
@@ -4,17 +4,31 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
-	"time"
+	"strings"
 )
 
+// VersionNegotiation selects the first version in the server's supported list
+// that the client also offered.
 func VersionNegotiation(offered, supported []uint16) (bool, uint16) {
-	for _, offeredVersion := range offered {
-		for _, supportedVersion := range supported {
+	for _, supportedVersion := range supported {
+		for _, offeredVersion := range offered {
 			logf(logTypeHandshake, "[server] version offered by client [%04x] <> [%04x]", offeredVersion, supportedVersion)
 			if offeredVersion == supportedVersion {
-				// XXX: Should probably be highest supported version, but for now, we
-				// only support one version, so it doesn't really matter.
-				return true, offeredVersion
+				return true, supportedVersion
+			}
+		}
+	}
+
+	return false, 0
+}
+
+// GroupNegotiation selects the first group in the server's supported list
+// that the client also offered, for use in a HelloRetryRequest.
+func GroupNegotiation(offered, supported []NamedGroup) (bool, NamedGroup) {
+	for _, supportedGroup := range supported {
+		for _, offeredGroup := range offered {
+			if offeredGroup == supportedGroup {
+				return true, supportedGroup
 			}
 		}
 	}
@@ -48,10 +62,6 @@ func DHNegotiation(keyShares []KeyShareEntry, groups []NamedGroup) (bool, NamedG
 	return false, 0, nil, nil
 }
 
-const (
-	ticketAgeTolerance uint32 = 5 * 1000 // five seconds in milliseconds
-)
-
 func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context []byte, psks PreSharedKeyCache) (bool, int, *PreSharedKey, CipherSuiteParams, error) {
 	logf(logTypeNegotiation, "Negotiating PSK offered=[%d] supported=[%d]", len(identities), psks.Size())
 	for i, id := range identities {
@@ -63,21 +73,8 @@ func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context
 			continue
 		}
 
-		// For resumption, make sure the ticket age is correct
-		if psk.IsResumption {
-			extTicketAge := id.ObfuscatedTicketAge - psk.TicketAgeAdd
-			knownTicketAge := uint32(time.Since(psk.ReceivedAt) / time.Millisecond)
-			ticketAgeDelta := knownTicketAge - extTicketAge
-			if knownTicketAge < extTicketAge {
-				ticketAgeDelta = extTicketAge - knownTicketAge
-			}
-			if ticketAgeDelta > ticketAgeTolerance {
-				logf(logTypeNegotiation, "WARNING potential replay [%x]", psk.Identity)
-				logf(logTypeNegotiation, "Ticket age exceeds tolerance |%d - %d| = [%d] > [%d]",
-					extTicketAge, knownTicketAge, ticketAgeDelta, ticketAgeTolerance)
-				return false, 0, nil, CipherSuiteParams{}, fmt.Errorf("WARNING Potential replay for identity %x", psk.Identity)
-			}
-		}
+		// The ticket age only matters for early data, so it is checked by the
+		// server's AntiReplay rather than here
 
 		params, ok := cipherSuiteMap[psk.CipherSuite]
 		if !ok {
@@ -86,15 +83,7 @@ func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context
 		}
 
 		// Compute binder
-		binderLabel := labelExternalBinder
-		if psk.IsResumption {
-			binderLabel = labelResumptionBinder
-		}
-
-		h0 := params.Hash.New().Sum(nil)
-		zero := bytes.Repeat([]byte{0}, params.Hash.Size())
-		earlySecret := HkdfExtract(params.Hash, zero, psk.Key)
-		binderKey := deriveSecret(params, earlySecret, binderLabel, h0)
+		binderKey := pskBinderKey(params, psk)
 
 		// context = ClientHello[truncated]
 		// context = ClientHello1 + HelloRetryRequest + ClientHello2[truncated]
@@ -134,14 +123,41 @@ func PSKModeNegotiation(canDoDH, canDoPSK bool, modes []PSKKeyExchangeMode) (boo
 	return usingDH, usingPSK
 }
 
+// certificateHasName reports whether a certificate lists a server name among
+// its DNS names.  If wildcard is set, then names with a wildcard in the
+// leftmost label are matched instead of exact names.
+func certificateHasName(cert *Certificate, serverName string, wildcard bool) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if len(serverName) == 0 {
+		return false
+	}
+
+	for _, name := range cert.Chain[0].DNSNames {
+		name = strings.ToLower(name)
+		if !wildcard && name == serverName {
+			return true
+		}
+
+		// A wildcard matches exactly one label
+		dot := strings.Index(serverName, ".")
+		if wildcard && strings.HasPrefix(name, "*.") && dot > 0 && serverName[dot:] == name[1:] {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificateSelection chooses a certificate that is valid for the server
+// name (if provided) and compatible with one of the signature schemes.
+// Certificates with an exact name are preferred over wildcard certificates.
 func CertificateSelection(serverName *string, signatureSchemes []SignatureScheme, certs []*Certificate) (*Certificate, SignatureScheme, error) {
 	// Select for server name if provided
 	candidates := certs
 	if serverName != nil {
 		candidatesByName := []*Certificate{}
-		for _, cert := range certs {
-			for _, name := range cert.Chain[0].DNSNames {
-				if len(*serverName) > 0 && name == *serverName {
+		for _, wildcard := range []bool{false, true} {
+			for _, cert := range certs {
+				if certificateHasName(cert, *serverName, wildcard) {
 					candidatesByName = append(candidatesByName, cert)
 				}
 			}
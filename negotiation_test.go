@@ -2,6 +2,7 @@ package mint
 
 import (
 	"bytes"
+	"crypto/x509"
 	"testing"
 )
 
@@ -11,11 +12,31 @@ func TestVersionNegotiation(t *testing.T) {
 	assertEquals(t, ok, true)
 	assertEquals(t, negotiated, uint16(0x7f12))
 
+	// Test that the server's preference wins
+	ok, negotiated = VersionNegotiation([]uint16{0x7f1c, 0x0304}, []uint16{0x0304, 0x7f1c})
+	assertEquals(t, ok, true)
+	assertEquals(t, negotiated, uint16(0x0304))
+
+	ok, negotiated = VersionNegotiation([]uint16{0x0304, 0x7f1c}, []uint16{0x7f1c, 0x0304})
+	assertEquals(t, ok, true)
+	assertEquals(t, negotiated, uint16(0x7f1c))
+
 	// Test failed negotiation
 	ok, negotiated = VersionNegotiation([]uint16{0x0300}, []uint16{0x0400})
 	assertEquals(t, ok, false)
 }
 
+func TestGroupNegotiation(t *testing.T) {
+	// Test that the server's preference wins
+	ok, group := GroupNegotiation([]NamedGroup{X25519, P256, P384}, []NamedGroup{P384, P256})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, P384)
+
+	// Test failed negotiation
+	ok, _ = GroupNegotiation([]NamedGroup{X25519}, []NamedGroup{P256})
+	assertEquals(t, ok, false)
+}
+
 func TestDHNegotiation(t *testing.T) {
 	keyShares := []KeyShareEntry{
 		{Group: P256, KeyExchange: random(keyExchangeSizeFromNamedGroup(P256))},
@@ -49,6 +70,16 @@ func TestDHNegotiation(t *testing.T) {
 	assertNotNil(t, pub, "Nil public key")
 	assertNotNil(t, secret, "Nil DH secret")
 
+	// Test success with X448
+	x448Shares := []KeyShareEntry{
+		{Group: X448, KeyExchange: random(keyExchangeSizeFromNamedGroup(X448))},
+	}
+	ok, group, pub, secret = DHNegotiation(x448Shares, []NamedGroup{X25519, X448})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, X448)
+	assertEquals(t, len(pub), keyExchangeSizeFromNamedGroup(X448))
+	assertNotNil(t, secret, "Nil DH secret")
+
 	// Test failure
 	ok, _, _, _ = DHNegotiation(keyShares, []NamedGroup{P521})
 	assertEquals(t, ok, false)
@@ -139,6 +170,28 @@ func TestCertificateSelection(t *testing.T) {
 	// Test failure on no certs matching signature scheme
 	_, _, err = CertificateSelection(&goodName, eddsa, certificates)
 	assertError(t, err, "Found a certificate for an incorrect signature scheme")
+
+	// Test wildcard matching, with exact names preferred
+	_, exact := newTestChain(t, "www.example.com", x509.ExtKeyUsageServerAuth)
+	_, wildcard := newTestChain(t, "*.example.com", x509.ExtKeyUsageServerAuth)
+	ecdsa := []SignatureScheme{ECDSA_P256_SHA256}
+	both := []*Certificate{wildcard, exact}
+
+	name := "WWW.Example.com."
+	cert, _, err = CertificateSelection(&name, ecdsa, both)
+	assertNotError(t, err, "Failed to find certificate by exact name")
+	assertEquals(t, cert, exact)
+
+	name = "mail.example.com"
+	cert, _, err = CertificateSelection(&name, ecdsa, both)
+	assertNotError(t, err, "Failed to find certificate by wildcard")
+	assertEquals(t, cert, wildcard)
+
+	// Test failure on names a wildcard does not cover
+	for _, name := range []string{"example.com", "a.b.example.com", "example.org"} {
+		_, _, err = CertificateSelection(&name, ecdsa, []*Certificate{wildcard})
+		assertError(t, err, "Wildcard matched an incorrect host name")
+	}
 }
 
 func TestEarlyDataNegotiation(t *testing.T) {
@@ -0,0 +1,379 @@
+package mint
+
+import (
+	"encoding/hex"
+	"reflect"
+)
+
+// QUICEncryptionLevel identifies the keys that protect handshake data carried
+// by QUIC, as in RFC 9001, Section 4.1.4.
+type QUICEncryptionLevel uint8
+
+const (
+	QUICEncryptionLevelInitial QUICEncryptionLevel = iota
+	QUICEncryptionLevelEarly
+	QUICEncryptionLevelHandshake
+	QUICEncryptionLevelApplication
+)
+
+// Handshake messages are only buffered up to these sizes, as in crypto/tls,
+// rather than the 16 MiB that the length field allows
+const (
+	maxQUICMessageLen            = 1 << 16
+	maxQUICCertificateMessageLen = 1 << 18
+)
+
+// quicLevels maps the labels on RekeyIn and RekeyOut actions to levels.
+// Key updates are done by QUIC itself, so "update" has no level.
+var quicLevels = map[string]QUICEncryptionLevel{
+	"early":       QUICEncryptionLevelEarly,
+	"handshake":   QUICEncryptionLevelHandshake,
+	"application": QUICEncryptionLevelApplication,
+}
+
+// QUICTransport is implemented by a QUIC stack that uses mint as its TLS
+// engine.  Instead of writing records, a QUICConn passes handshake messages to
+// WriteHandshakeData, tagged with the level they are to be protected at, and
+// passes each new traffic secret to SetReadSecret or SetWriteSecret.  An error
+// from any of these aborts the handshake with an internal_error alert.
+type QUICTransport interface {
+	WriteHandshakeData(level QUICEncryptionLevel, data []byte) error
+	SetReadSecret(level QUICEncryptionLevel, suite CipherSuite, secret []byte) error
+	SetWriteSecret(level QUICEncryptionLevel, suite CipherSuite, secret []byte) error
+}
+
+// quicExtensionHandler sends the local QUIC transport parameters and records
+// the peer's, passing all other extensions on to the application's handler.
+type quicExtensionHandler struct {
+	isClient   bool
+	params     []byte
+	peerParams []byte
+	next       AppExtensionHandler
+}
+
+// carriesParams reports whether messages of type hs carry the transport
+// parameters of the side that sends them
+func (h *quicExtensionHandler) carriesParams(hs HandshakeType, sending bool) bool {
+	if h.isClient == sending {
+		return hs == HandshakeTypeClientHello
+	}
+	return hs == HandshakeTypeEncryptedExtensions
+}
+
+func (h *quicExtensionHandler) Send(hs HandshakeType, el *ExtensionList) error {
+	if h.carriesParams(hs, true) {
+		err := el.Add(&QUICTransportParametersExtension{Parameters: h.params})
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.next != nil {
+		return h.next.Send(hs, el)
+	}
+	return nil
+}
+
+func (h *quicExtensionHandler) Receive(hs HandshakeType, el *ExtensionList) error {
+	if h.carriesParams(hs, false) {
+		tp := &QUICTransportParametersExtension{}
+		if !el.Find(tp) {
+			logf(logTypeHandshake, "[quic] Peer did not send transport parameters")
+			return AlertMissingExtension
+		}
+		h.peerParams = tp.Parameters
+	}
+
+	if h.next != nil {
+		return h.next.Receive(hs, el)
+	}
+	return nil
+}
+
+// QUICConn runs a TLS handshake on behalf of a QUIC connection, following
+// RFC 9001.  It has no I/O of its own: the transport supplies the handshake
+// bytes it receives at each encryption level through HandleData, and is given
+// outgoing handshake bytes and new secrets through its QUICTransport methods.
+//
+// Early data is not supported, so 0-RTT is never offered or accepted.
+type QUICConn struct {
+	config     *Config
+	isClient   bool
+	transport  QUICTransport
+	extensions *quicExtensionHandler
+
+	hState            HandshakeState
+	state             StateConnected
+	handshakeAlert    Alert
+	handshakeComplete bool
+
+	readLevel  QUICEncryptionLevel
+	writeLevel QUICEncryptionLevel
+	input      []byte
+}
+
+// NewQUICConn returns a client or server that sends the given QUIC transport
+// parameters to the peer.
+func NewQUICConn(config *Config, isClient bool, transport QUICTransport, params []byte) *QUICConn {
+	return &QUICConn{
+		config:         config,
+		isClient:       isClient,
+		transport:      transport,
+		extensions:     &quicExtensionHandler{isClient: isClient, params: params},
+		handshakeAlert: AlertNoAlert,
+	}
+}
+
+// Start sets up the handshake.  A client sends its ClientHello, at the Initial
+// level; a server waits for the client's.
+func (q *QUICConn) Start() Alert {
+	if q.hState != nil {
+		logf(logTypeHandshake, "[quic] Handshake already started")
+		return AlertInternalError
+	}
+
+	if err := q.config.Init(q.isClient); err != nil {
+		logf(logTypeHandshake, "[quic] Error initializing config: %v", err)
+		return AlertInternalError
+	}
+
+	caps := q.config.capabilities()
+	caps.AllowEarlyData = false
+	q.extensions.next = caps.ExtensionHandler
+	caps.ExtensionHandler = q.extensions
+
+	if !q.isClient {
+		q.hState = ServerStateStart{Caps: caps}
+		return AlertNoAlert
+	}
+
+	opts := ConnectionOptions{
+		ServerName: q.config.ServerName,
+		NextProtos: q.config.NextProtos,
+	}
+	// Tickets that don't make it into the ClientHello can be used again
+	psks := pskOffers(caps.PSKs, opts.ServerName)
+	state, actions, alert := ClientStateStart{Caps: caps, Opts: opts, offeredPSKs: psks, havePSKs: true}.Next(nil)
+	putBackUnsentPSKs(caps.PSKs, opts.ServerName, psks, state)
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "[quic] Error initializing client state: %v", alert)
+		return q.fail(alert)
+	}
+
+	q.hState = state
+	return q.fail(q.takeActions(actions))
+}
+
+// HandleData processes handshake bytes that the peer sent at the given level.
+// Messages may be split across calls arbitrarily.  Once the handshake has
+// failed, the alert that ended it is returned by every later call.
+func (q *QUICConn) HandleData(level QUICEncryptionLevel, data []byte) Alert {
+	if q.handshakeAlert != AlertNoAlert {
+		return q.handshakeAlert
+	}
+	if q.hState == nil {
+		logf(logTypeHandshake, "[quic] Data received before handshake start")
+		return AlertInternalError
+	}
+
+	if level != q.readLevel {
+		logf(logTypeHandshake, "[quic] Data received at level %d, expected %d", level, q.readLevel)
+		return q.fail(AlertUnexpectedMessage)
+	}
+
+	q.input = append(q.input, data...)
+	for len(q.input) >= handshakeHeaderLen {
+		hmType := HandshakeType(q.input[0])
+		hmLen := (int(q.input[1]) << 16) + (int(q.input[2]) << 8) + int(q.input[3])
+		maxLen := maxQUICMessageLen
+		if hmType == HandshakeTypeCertificate {
+			maxLen = maxQUICCertificateMessageLen
+		}
+		if hmLen > maxLen {
+			logf(logTypeHandshake, "[quic] Message too large [%d] > [%d]", hmLen, maxLen)
+			return q.fail(AlertUnexpectedMessage)
+		}
+		if len(q.input) < handshakeHeaderLen+hmLen {
+			break
+		}
+
+		hm := &HandshakeMessage{
+			msgType: hmType,
+			body:    append([]byte{}, q.input[handshakeHeaderLen:handshakeHeaderLen+hmLen]...),
+		}
+		q.input = q.input[handshakeHeaderLen+hmLen:]
+
+		alert := q.handleMessage(hm)
+		if alert != AlertNoAlert {
+			return q.fail(alert)
+		}
+
+		// A message must not span a key change
+		if q.readLevel != level && len(q.input) > 0 {
+			logf(logTypeHandshake, "[quic] Data remaining at level %d after key change", level)
+			return q.fail(AlertUnexpectedMessage)
+		}
+	}
+
+	return AlertNoAlert
+}
+
+func (q *QUICConn) handleMessage(hm *HandshakeMessage) Alert {
+	logf(logTypeHandshake, "[quic] Read message with type: %v", hm.msgType)
+
+	if q.handshakeComplete {
+		// QUIC has its own key update mechanism
+		if hm.msgType == HandshakeTypeKeyUpdate {
+			logf(logTypeHandshake, "[quic] Received KeyUpdate")
+			return AlertUnexpectedMessage
+		}
+
+		state, actions, alert := q.state.Next(hm)
+		if alert != AlertNoAlert {
+			logf(logTypeHandshake, "[quic] Error in state transition: %v", alert)
+			return alert
+		}
+
+		q.state = state.(StateConnected)
+		return q.takeActions(actions)
+	}
+
+	state, actions, alert := q.hState.Next(hm)
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "[quic] Error in state transition: %v", alert)
+		return alert
+	}
+
+	alert = q.takeActions(actions)
+	if alert != AlertNoAlert {
+		return alert
+	}
+
+	q.hState = state
+	connected, ok := state.(StateConnected)
+	if !ok {
+		return AlertNoAlert
+	}
+
+	q.state = connected
+	q.handshakeComplete = true
+
+	// Send NewSessionTicket if acting as server
+	if !q.isClient && q.config.SendSessionTickets {
+		actions, alert := q.state.NewSessionTicket(
+			q.config.TicketLen,
+			q.config.TicketLifetime,
+			0, // no early data
+			q.config.SessionTicketKeys)
+		if alert != AlertNoAlert {
+			return alert
+		}
+		return q.takeActions(actions)
+	}
+
+	return AlertNoAlert
+}
+
+func (q *QUICConn) takeActions(actions []HandshakeAction) Alert {
+	for _, actionGeneric := range actions {
+		alert := q.takeAction(actionGeneric)
+		if alert != AlertNoAlert {
+			logf(logTypeHandshake, "[quic] Error during handshake actions: %v", alert)
+			return alert
+		}
+	}
+	return AlertNoAlert
+}
+
+func (q *QUICConn) takeAction(actionGeneric HandshakeAction) Alert {
+	switch action := actionGeneric.(type) {
+	case SendHandshakeMessage:
+		err := q.transport.WriteHandshakeData(q.writeLevel, action.Message.Marshal())
+		if err != nil {
+			logf(logTypeHandshake, "[quic] Error writing handshake message: %v", err)
+			return AlertInternalError
+		}
+
+	case RekeyIn:
+		level, ok := quicLevels[action.Label]
+		if !ok {
+			logf(logTypeHandshake, "[quic] Unsupported inbound rekey to %s", action.Label)
+			return AlertInternalError
+		}
+
+		logf(logTypeHandshake, "[quic] Rekeying in to %s", action.Label)
+		err := q.transport.SetReadSecret(level, action.KeySet.suite, action.KeySet.secret)
+		if err != nil {
+			logf(logTypeHandshake, "[quic] Unable to set read secret: %v", err)
+			return AlertInternalError
+		}
+		q.readLevel = level
+
+	case RekeyOut:
+		level, ok := quicLevels[action.Label]
+		if !ok {
+			logf(logTypeHandshake, "[quic] Unsupported outbound rekey to %s", action.Label)
+			return AlertInternalError
+		}
+
+		logf(logTypeHandshake, "[quic] Rekeying out to %s", action.Label)
+		err := q.transport.SetWriteSecret(level, action.KeySet.suite, action.KeySet.secret)
+		if err != nil {
+			logf(logTypeHandshake, "[quic] Unable to set write secret: %v", err)
+			return AlertInternalError
+		}
+		q.writeLevel = level
+
+	case ReadPastEarlyData:
+		// Rejected 0-RTT packets are discarded by QUIC, so there is
+		// nothing in the handshake stream to skip.
+
+	case StorePSK:
+		logf(logTypeHandshake, "[quic] Storing new session ticket with identity [%x]", action.PSK.Identity)
+		if q.isClient {
+			// Clients look up PSKs based on server name
+			q.config.PSKs.Put(q.config.ServerName, action.PSK)
+		} else {
+			// Servers look them up based on the identity in the extension
+			q.config.PSKs.Put(hex.EncodeToString(action.PSK.Identity), action.PSK)
+		}
+
+	default:
+		logf(logTypeHandshake, "[quic] Unsupported action type %T", actionGeneric)
+		return AlertInternalError
+	}
+
+	return AlertNoAlert
+}
+
+// fail records an alert that ends the handshake
+func (q *QUICConn) fail(alert Alert) Alert {
+	if alert != AlertNoAlert {
+		q.handshakeAlert = alert
+	}
+	return alert
+}
+
+// HandshakeComplete reports whether the handshake has finished
+func (q *QUICConn) HandshakeComplete() bool {
+	return q.handshakeComplete
+}
+
+// PeerTransportParameters returns the QUIC transport parameters sent by the
+// peer, or nil if they have not been received yet.
+func (q *QUICConn) PeerTransportParameters() []byte {
+	return q.extensions.peerParams
+}
+
+func (q *QUICConn) State() ConnectionState {
+	state := ConnectionState{}
+	if q.hState != nil {
+		state.HandshakeState = reflect.TypeOf(q.hState).Name()
+	}
+
+	if q.handshakeComplete {
+		q.state.fillConnectionState(&state)
+	}
+
+	return state
+}
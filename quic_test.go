@@ -0,0 +1,195 @@
+package mint
+
+import (
+	"fmt"
+	"testing"
+)
+
+// quicTestTransport records what a QUICConn hands to its transport
+type quicTestTransport struct {
+	out          map[QUICEncryptionLevel][]byte
+	readSecrets  map[QUICEncryptionLevel][]byte
+	writeSecrets map[QUICEncryptionLevel][]byte
+	suite        CipherSuite
+	fail         bool
+}
+
+func newQUICTestTransport() *quicTestTransport {
+	return &quicTestTransport{
+		out:          map[QUICEncryptionLevel][]byte{},
+		readSecrets:  map[QUICEncryptionLevel][]byte{},
+		writeSecrets: map[QUICEncryptionLevel][]byte{},
+	}
+}
+
+func (qt *quicTestTransport) WriteHandshakeData(level QUICEncryptionLevel, data []byte) error {
+	if qt.fail {
+		return fmt.Errorf("transport failure")
+	}
+	qt.out[level] = append(qt.out[level], data...)
+	return nil
+}
+
+func (qt *quicTestTransport) SetReadSecret(level QUICEncryptionLevel, suite CipherSuite, secret []byte) error {
+	qt.suite = suite
+	qt.readSecrets[level] = secret
+	return nil
+}
+
+func (qt *quicTestTransport) SetWriteSecret(level QUICEncryptionLevel, suite CipherSuite, secret []byte) error {
+	qt.suite = suite
+	qt.writeSecrets[level] = secret
+	return nil
+}
+
+// deliver passes the data written by one side to the other, level by level
+func (qt *quicTestTransport) deliver(to *QUICConn) Alert {
+	levels := []QUICEncryptionLevel{
+		QUICEncryptionLevelInitial,
+		QUICEncryptionLevelHandshake,
+		QUICEncryptionLevelApplication,
+	}
+	for _, level := range levels {
+		data := qt.out[level]
+		if len(data) == 0 {
+			continue
+		}
+
+		delete(qt.out, level)
+		alert := to.HandleData(level, data)
+		if alert != AlertNoAlert {
+			return alert
+		}
+	}
+	return AlertNoAlert
+}
+
+func runQUIC(t *testing.T, clientConfig, serverConfig *Config) (client, server *QUICConn, ct, st *quicTestTransport) {
+	ct, st = newQUICTestTransport(), newQUICTestTransport()
+	client = NewQUICConn(clientConfig, true, ct, []byte("client params"))
+	server = NewQUICConn(serverConfig, false, st, []byte("server params"))
+
+	assertEquals(t, server.Start(), AlertNoAlert)
+	assertEquals(t, client.Start(), AlertNoAlert)
+	for i := 0; i < 4; i++ {
+		assertEquals(t, ct.deliver(server), AlertNoAlert)
+		assertEquals(t, st.deliver(client), AlertNoAlert)
+	}
+	return
+}
+
+func TestQUICHandshake(t *testing.T) {
+	for _, conf := range []*Config{basicConfig, hrrConfig, alpnConfig} {
+		client, server, ct, st := runQUIC(t, conf, conf)
+
+		assert(t, client.HandshakeComplete(), "Client handshake did not complete")
+		assert(t, server.HandshakeComplete(), "Server handshake did not complete")
+		assertDeepEquals(t, client.state.Params, server.state.Params)
+		assertEquals(t, client.State().NextProto, server.State().NextProto)
+		assertEquals(t, client.State().HandshakeState, "StateConnected")
+
+		assertByteEquals(t, client.PeerTransportParameters(), []byte("server params"))
+		assertByteEquals(t, server.PeerTransportParameters(), []byte("client params"))
+
+		// Each side reads with the secrets the other writes with
+		assertEquals(t, ct.suite, client.state.Params.CipherSuite)
+		assertEquals(t, st.suite, server.state.Params.CipherSuite)
+		for _, level := range []QUICEncryptionLevel{QUICEncryptionLevelHandshake, QUICEncryptionLevelApplication} {
+			assertNotNil(t, ct.writeSecrets[level], "Missing client write secret")
+			assertNotNil(t, st.writeSecrets[level], "Missing server write secret")
+			assertByteEquals(t, ct.writeSecrets[level], st.readSecrets[level])
+			assertByteEquals(t, st.writeSecrets[level], ct.readSecrets[level])
+		}
+		assertByteEquals(t, ct.writeSecrets[QUICEncryptionLevelApplication], client.state.clientTrafficSecret)
+		assertByteEquals(t, st.writeSecrets[QUICEncryptionLevelApplication], server.state.serverTrafficSecret)
+		assertEquals(t, len(ct.writeSecrets[QUICEncryptionLevelEarly]), 0)
+	}
+}
+
+func TestQUICFragmentedData(t *testing.T) {
+	ct, st := newQUICTestTransport(), newQUICTestTransport()
+	client := NewQUICConn(basicConfig, true, ct, []byte("client params"))
+	server := NewQUICConn(basicConfig, false, st, []byte("server params"))
+	assertEquals(t, server.Start(), AlertNoAlert)
+	assertEquals(t, client.Start(), AlertNoAlert)
+
+	// The ClientHello is processed once its last byte arrives
+	ch := ct.out[QUICEncryptionLevelInitial]
+	delete(ct.out, QUICEncryptionLevelInitial)
+	for i := range ch {
+		assertEquals(t, len(st.out[QUICEncryptionLevelInitial]), 0)
+		alert := server.HandleData(QUICEncryptionLevelInitial, ch[i:i+1])
+		assertEquals(t, alert, AlertNoAlert)
+	}
+	assert(t, len(st.out[QUICEncryptionLevelInitial]) > 0, "Server did not respond to ClientHello")
+	assert(t, len(st.out[QUICEncryptionLevelHandshake]) > 0, "Server did not send its flight")
+
+	assertEquals(t, st.deliver(client), AlertNoAlert)
+	assertEquals(t, ct.deliver(server), AlertNoAlert)
+	assert(t, client.HandshakeComplete(), "Client handshake did not complete")
+	assert(t, server.HandshakeComplete(), "Server handshake did not complete")
+}
+
+func TestQUICResumption(t *testing.T) {
+	clientConfig := *resumptionConfig
+	serverConfig := *resumptionConfig
+
+	// The ticket is sent at the application level after the handshake
+	_, _, _, st := runQUIC(t, &clientConfig, &serverConfig)
+	assertEquals(t, len(st.out[QUICEncryptionLevelApplication]), 0)
+	assertEquals(t, clientConfig.PSKs.Size(), 1)
+	assertEquals(t, serverConfig.PSKs.Size(), 1)
+
+	client, server, _, _ := runQUIC(t, &clientConfig, &serverConfig)
+	assert(t, client.HandshakeComplete(), "Client handshake did not complete")
+	assert(t, client.State().DidResume, "Client did not report resumption")
+	assert(t, server.State().DidResume, "Server did not report resumption")
+	assertByteEquals(t, client.PeerTransportParameters(), []byte("server params"))
+}
+
+func TestQUICFailures(t *testing.T) {
+	// Missing transport parameters
+	client := NewEngine(basicConfig, true)
+	assertEquals(t, client.Handshake(), WouldBlock)
+	ch := client.Output()[5:] // Strip the record header
+
+	server := NewQUICConn(basicConfig, false, newQUICTestTransport(), nil)
+	assertEquals(t, server.Start(), AlertNoAlert)
+	alert := server.HandleData(QUICEncryptionLevelInitial, ch)
+	assertEquals(t, alert, AlertMissingExtension)
+
+	// Later calls return the same alert
+	alert = server.HandleData(QUICEncryptionLevelInitial, ch)
+	assertEquals(t, alert, AlertMissingExtension)
+
+	// Data at the wrong level
+	server = NewQUICConn(basicConfig, false, newQUICTestTransport(), nil)
+	assertEquals(t, server.Start(), AlertNoAlert)
+	alert = server.HandleData(QUICEncryptionLevelHandshake, ch)
+	assertEquals(t, alert, AlertUnexpectedMessage)
+
+	// A message that is too large is refused before its body arrives
+	server = NewQUICConn(basicConfig, false, newQUICTestTransport(), nil)
+	assertEquals(t, server.Start(), AlertNoAlert)
+	header := []byte{byte(HandshakeTypeClientHello), 0x01, 0x00, 0x01}
+	alert = server.HandleData(QUICEncryptionLevelInitial, header)
+	assertEquals(t, alert, AlertUnexpectedMessage)
+
+	// Data before Start
+	server = NewQUICConn(basicConfig, false, newQUICTestTransport(), nil)
+	alert = server.HandleData(QUICEncryptionLevelInitial, ch)
+	assertEquals(t, alert, AlertInternalError)
+
+	// Transport failure
+	ct := newQUICTestTransport()
+	ct.fail = true
+	quicClient := NewQUICConn(basicConfig, true, ct, nil)
+	assertEquals(t, quicClient.Start(), AlertInternalError)
+
+	// KeyUpdate is not allowed after the handshake
+	quicClient, _, _, _ = runQUIC(t, basicConfig, basicConfig)
+	ku, err := HandshakeMessageFromBody(&KeyUpdateBody{KeyUpdateRequest: KeyUpdateNotRequested})
+	assertNotError(t, err, "Failed to marshal KeyUpdate")
+	alert = quicClient.HandleData(QUICEncryptionLevelApplication, ku.Marshal())
+	assertEquals(t, alert, AlertUnexpectedMessage)
+}
@@ -12,6 +12,9 @@ const (
 	sequenceNumberLen = 8       // sequence number length
 	recordHeaderLen   = 5       // record header length
 	maxFragmentLen    = 1 << 14 // max number of bytes in a record
+
+	// Max number of change_cipher_spec records dropped in a row
+	maxChangeCipherSpecs = 16
 )
 
 type DecryptError string
@@ -20,14 +23,23 @@ func (err DecryptError) Error() string {
 	return string(err)
 }
 
+// UnexpectedRecordError is returned for a record that is not allowed at this
+// point in the connection, which the peer should be sent the
+// unexpected_message alert for.
+type UnexpectedRecordError string
+
+func (err UnexpectedRecordError) Error() string {
+	return string(err)
+}
+
 // struct {
 //     ContentType type;
-//     ProtocolVersion record_version = { 3, 1 };    /* TLS v1.x */
+//     ProtocolVersion legacy_record_version = 0x0303;    /* TLS v1.2 */
 //     uint16 length;
 //     opaque fragment[TLSPlaintext.length];
 // } TLSPlaintext;
 type TLSPlaintext struct {
-	// Omitted: record_version (static)
+	// Omitted: legacy_record_version (static)
 	// Omitted: length         (computed from fragment)
 	contentType RecordType
 	fragment    []byte
@@ -46,6 +58,21 @@ type RecordLayer struct {
 	seq      []byte      // Zero-padded sequence number
 	nonce    []byte      // Buffer for per-record nonces
 	cipher   cipher.AEAD // AEAD cipher
+
+	// Usage of the current key, for deciding when to update it
+	records      uint64 // Records protected with the key
+	bytes        uint64 // Plaintext bytes protected with the key
+	seqExhausted bool   // The last sequence number has been used
+
+	// Plaintext bytes in records that failed to decrypt and were dropped,
+	// e.g., early data rejected by a server
+	droppedBytes int
+
+	// Whether change_cipher_spec records are dropped rather than rejected,
+	// which is only the case during the handshake, and how many have been
+	// dropped in a row
+	allowChangeCipherSpec bool
+	changeCipherSpecs     int
 }
 
 type recordLayerFrameDetails struct{}
@@ -81,15 +108,21 @@ func (r *RecordLayer) Rekey(cipher aeadFactory, key []byte, iv []byte) error {
 	r.seq = bytes.Repeat([]byte{0}, r.ivLength)
 	r.nonce = make([]byte, r.ivLength)
 	copy(r.nonce, iv)
+	r.records = 0
+	r.bytes = 0
+	r.seqExhausted = false
 	return nil
 }
 
+// incrementSequenceNumber moves on to the next sequence number.  Sequence
+// numbers are not allowed to wrap, so once the last one has been used, no
+// more records can be protected until the key is updated.
 func (r *RecordLayer) incrementSequenceNumber() {
 	if r.ivLength == 0 {
 		return
 	}
 
-	for i := r.ivLength - 1; i > r.ivLength-sequenceNumberLen; i-- {
+	for i := r.ivLength - 1; i >= r.ivLength-sequenceNumberLen; i-- {
 		r.seq[i]++
 		r.nonce[i] ^= (r.seq[i] - 1) ^ r.seq[i]
 		if r.seq[i] != 0 {
@@ -97,10 +130,29 @@ func (r *RecordLayer) incrementSequenceNumber() {
 		}
 	}
 
-	// Not allowed to let sequence number wrap.
-	// Instead, must renegotiate before it does.
-	// Not likely enough to bother.
-	panic("TLS: sequence number wraparound")
+	r.seqExhausted = true
+}
+
+// protect checks that another record can be protected with the current key,
+// and counts it toward the key's usage
+func (r *RecordLayer) protect(pt *TLSPlaintext) error {
+	if r.seqExhausted {
+		return fmt.Errorf("tls.record: Sequence number exhausted, key must be updated")
+	}
+
+	r.records++
+	r.bytes += uint64(len(pt.fragment))
+	return nil
+}
+
+// additionalData returns the AEAD additional data for a protected record, which
+// is the record header:
+//
+// additional_data = TLSCiphertext.opaque_type ||
+//                   TLSCiphertext.legacy_record_version ||
+//                   TLSCiphertext.length
+func additionalData(contentType RecordType, length int) []byte {
+	return []byte{byte(contentType), 0x03, 0x03, byte(length >> 8), byte(length)}
 }
 
 func (r *RecordLayer) encrypt(pt *TLSPlaintext, padLen int) *TLSPlaintext {
@@ -122,7 +174,7 @@ func (r *RecordLayer) encrypt(pt *TLSPlaintext, padLen int) *TLSPlaintext {
 
 	// Encrypt the fragment
 	payload := out.fragment[:plaintextLen]
-	r.cipher.Seal(payload[:0], r.nonce, payload, nil)
+	r.cipher.Seal(payload[:0], r.nonce, payload, additionalData(out.contentType, ciphertextLen))
 	return out
 }
 
@@ -139,7 +191,8 @@ func (r *RecordLayer) decrypt(pt *TLSPlaintext) (*TLSPlaintext, int, error) {
 	}
 
 	// Decrypt
-	_, err := r.cipher.Open(out.fragment[:0], r.nonce, pt.fragment, nil)
+	aad := additionalData(pt.contentType, len(pt.fragment))
+	_, err := r.cipher.Open(out.fragment[:0], r.nonce, pt.fragment, aad)
 	if err != nil {
 		return nil, 0, DecryptError("tls.record.decrypt: AEAD decrypt failed")
 	}
@@ -184,12 +237,8 @@ func (r *RecordLayer) ReadRecord() (*TLSPlaintext, error) {
 	return pt, err
 }
 
-func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
-	if r.cachedRecord != nil {
-		logf(logTypeIO, "Returning cached record")
-		return r.cachedRecord, r.cachedError
-	}
-
+// readFrame reads the header and body of the next record
+func (r *RecordLayer) readFrame() ([]byte, []byte, error) {
 	// Loop until one of three things happens:
 	//
 	// 1. We get a frame
@@ -205,11 +254,11 @@ func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
 			n, err := r.conn.Read(buf)
 			if err != nil {
 				logf(logTypeIO, "Error reading, %v", err)
-				return nil, err
+				return nil, nil, err
 			}
 
 			if n == 0 {
-				return nil, WouldBlock
+				return nil, nil, WouldBlock
 			}
 
 			logf(logTypeIO, "Read %v bytes", n)
@@ -222,28 +271,67 @@ func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
 		// Loop around on WouldBlock to see if some
 		// data is now available.
 		if err != nil && err != WouldBlock {
-			return nil, err
+			return nil, nil, err
 		}
 	}
+	return header, body, nil
+}
 
-	pt := &TLSPlaintext{}
-	// Validate content type
-	switch RecordType(header[0]) {
-	default:
-		return nil, fmt.Errorf("tls.record: Unknown content type %02x", header[0])
-	case RecordTypeAlert, RecordTypeHandshake, RecordTypeApplicationData:
-		pt.contentType = RecordType(header[0])
+func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
+	if r.cachedRecord != nil {
+		logf(logTypeIO, "Returning cached record")
+		return r.cachedRecord, r.cachedError
 	}
 
-	// Validate version
-	if !allowWrongVersionNumber && (header[1] != 0x03 || header[2] != 0x01) {
-		return nil, fmt.Errorf("tls.record: Invalid version %02x%02x", header[1], header[2])
-	}
+	// Peers in middlebox compatibility mode send unencrypted
+	// change_cipher_spec records during the handshake, which we drop.
+	var header, body []byte
+	var size int
+	pt := &TLSPlaintext{}
+	for {
+		var err error
+		header, body, err = r.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		// Validate content type
+		switch RecordType(header[0]) {
+		default:
+			return nil, fmt.Errorf("tls.record: Unknown content type %02x", header[0])
+		case RecordTypeAlert, RecordTypeHandshake, RecordTypeApplicationData, RecordTypeChangeCipherSpec:
+			pt.contentType = RecordType(header[0])
+		}
+
+		// Validate version.  Everything should be 0x0303, but an initial
+		// ClientHello may be sent with 0x0301.
+		if !allowWrongVersionNumber && (header[1] != 0x03 || (header[2] != 0x01 && header[2] != 0x03)) {
+			return nil, fmt.Errorf("tls.record: Invalid version %02x%02x", header[1], header[2])
+		}
 
-	// Validate size < max
-	size := (int(header[3]) << 8) + int(header[4])
-	if size > maxFragmentLen+256 {
-		return nil, fmt.Errorf("tls.record: Ciphertext size too big")
+		// Validate size < max
+		size = (int(header[3]) << 8) + int(header[4])
+		if size > maxFragmentLen+256 {
+			return nil, fmt.Errorf("tls.record: Ciphertext size too big")
+		}
+
+		if pt.contentType != RecordTypeChangeCipherSpec {
+			r.changeCipherSpecs = 0
+			break
+		}
+
+		if !r.allowChangeCipherSpec {
+			return nil, UnexpectedRecordError("tls.record: Unexpected change_cipher_spec record")
+		}
+		if size != 1 || body[0] != 0x01 {
+			return nil, fmt.Errorf("tls.record: Invalid change_cipher_spec record")
+		}
+		r.changeCipherSpecs++
+		if r.changeCipherSpecs > maxChangeCipherSpecs {
+			return nil, UnexpectedRecordError("tls.record: Too many change_cipher_spec records")
+		}
+
+		logf(logTypeIO, "Dropping change_cipher_spec record")
 	}
 
 	pt.fragment = make([]byte, size)
@@ -251,7 +339,18 @@ func (r *RecordLayer) nextRecord() (*TLSPlaintext, error) {
 
 	// Attempt to decrypt fragment
 	if r.cipher != nil {
-		pt, _, err = r.decrypt(pt)
+		var err error
+		ct := pt
+		pt, _, err = r.decrypt(ct)
+		if err != nil {
+			if _, ok := err.(DecryptError); ok && len(ct.fragment) > r.cipher.Overhead() {
+				// Don't count the overhead or the content type
+				r.droppedBytes += len(ct.fragment) - r.cipher.Overhead() - 1
+			}
+			return nil, err
+		}
+
+		err = r.protect(pt)
 		if err != nil {
 			return nil, err
 		}
@@ -274,18 +373,24 @@ func (r *RecordLayer) WriteRecord(pt *TLSPlaintext) error {
 }
 
 func (r *RecordLayer) WriteRecordWithPadding(pt *TLSPlaintext, padLen int) error {
+	// The limit applies to the content and padding, not to the ciphertext,
+	// which is expanded by encryption
+	if len(pt.fragment)+padLen > maxFragmentLen {
+		return fmt.Errorf("tls.record: Record size too big")
+	}
+
 	if r.cipher != nil {
+		err := r.protect(pt)
+		if err != nil {
+			return err
+		}
 		pt = r.encrypt(pt, padLen)
 	} else if padLen > 0 {
 		return fmt.Errorf("tls.record: Padding can only be done on encrypted records")
 	}
 
-	if len(pt.fragment) > maxFragmentLen {
-		return fmt.Errorf("tls.record: Record size too big")
-	}
-
 	length := len(pt.fragment)
-	header := []byte{byte(pt.contentType), 0x03, 0x01, byte(length >> 8), byte(length)}
+	header := []byte{byte(pt.contentType), 0x03, 0x03, byte(length >> 8), byte(length)}
 	record := append(header, pt.fragment...)
 
 	logf(logTypeIO, "RecordLayer.WriteRecord [%d] [%x]", pt.contentType, pt.fragment)
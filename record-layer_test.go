@@ -9,16 +9,17 @@ import (
 )
 
 const (
-	plaintextHex = "1503010005F0F1F2F3F4"
+	plaintextHex        = "1503030005F0F1F2F3F4"
+	changeCipherSpecHex = "140303000101"
 
 	// Random key and IV; hand-encoded ciphertext for the above plaintext
 	keyHex         = "45c71e5819170d622a9f4e3a089a0beb"
 	ivHex          = "2b7fbbf689f240e3e7aa44a6"
 	paddingLength  = 4
 	sequenceChange = 17
-	ciphertext0Hex = "1703010016621a75932c037ff74d2a9ec7776790e09dcd4811db97"
-	ciphertext1Hex = "170301001a621a75932c03076e386b3cebbb8dbf2f37e49ad3e82a70a17833"
-	ciphertext2Hex = "170301001a1da650d5da822b7f4eba67f954767fcbbbd4c4bc7f1c61daf701"
+	ciphertext0Hex = "1703030016621a75932c031422a4199bbed361371d52242e078b57"
+	ciphertext1Hex = "170303001a621a75932c03076e386b17a5d5ff96dda7dafeb95b1edaf01a58"
+	ciphertext2Hex = "170303001a1da650d5da822b7f4eba4cb73a0456392beaa0d6cc28cb8b956a"
 )
 
 func TestRekey(t *testing.T) {
@@ -31,21 +32,76 @@ func TestRekey(t *testing.T) {
 }
 
 func TestSequenceNumberRollover(t *testing.T) {
-	defer func() {
-		r := recover()
-		assert(t, r != nil, "failed to panic on sequence number overflow")
-	}()
-
 	key := unhex(keyHex)
 	iv := unhex(ivHex)
+	plaintext := unhex(plaintextHex)
+	pt := &TLSPlaintext{
+		contentType: RecordType(plaintext[0]),
+		fragment:    plaintext[5:],
+	}
 
 	r := NewRecordLayer(bytes.NewBuffer(nil))
 	r.Rekey(newAESGCM, key, iv)
 
+	// The last sequence number can be used, but not wrapped around
 	for i := 0; i < sequenceNumberLen; i++ {
 		r.seq[r.ivLength-i-1] = 0xFF
 	}
-	r.incrementSequenceNumber()
+	err := r.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write with the last sequence number")
+	err = r.WriteRecord(pt)
+	assertError(t, err, "Allowed sequence number to wrap")
+
+	// A new key starts a new sequence
+	r.Rekey(newAESGCM, key, iv)
+	err = r.WriteRecord(pt)
+	assertNotError(t, err, "Failed to write after rekey")
+}
+
+func TestKeyUsage(t *testing.T) {
+	key := unhex(keyHex)
+	iv := unhex(ivHex)
+	plaintext := unhex(plaintextHex)
+	pt := &TLSPlaintext{
+		contentType: RecordType(plaintext[0]),
+		fragment:    plaintext[5:],
+	}
+
+	// Plaintext records do not count
+	b := bytes.NewBuffer(nil)
+	w := NewRecordLayer(b)
+	w.WriteRecord(pt)
+	assertEquals(t, w.records, uint64(0))
+
+	// Protected records count on both sides, until the next rekey
+	w.Rekey(newAESGCM, key, iv)
+	r := NewRecordLayer(b)
+	r.ReadRecord()
+	r.Rekey(newAESGCM, key, iv)
+	for i := 0; i < 3; i++ {
+		assertNotError(t, w.WriteRecord(pt), "Failed to write record")
+		_, err := r.ReadRecord()
+		assertNotError(t, err, "Failed to read record")
+	}
+	assertEquals(t, w.records, uint64(3))
+	assertEquals(t, w.bytes, uint64(3*len(pt.fragment)))
+	assertEquals(t, r.records, uint64(3))
+	assertEquals(t, r.bytes, uint64(3*len(pt.fragment)))
+
+	w.Rekey(newAESGCM, key, iv)
+	assertEquals(t, w.records, uint64(0))
+	assertEquals(t, w.bytes, uint64(0))
+
+	// Every suite built on AES limits how many records a key protects
+	aesSuites := []CipherSuite{
+		TLS_AES_128_GCM_SHA256,
+		TLS_AES_256_GCM_SHA384,
+		TLS_AES_128_CCM_SHA256,
+		TLS_AES_128_CCM_8_SHA256,
+	}
+	for _, suite := range aesSuites {
+		assert(t, cipherSuiteMap[suite].RecordLimit > 0, fmt.Sprintf("No record limit for %04x", suite))
+	}
 }
 
 func TestReadRecord(t *testing.T) {
@@ -72,9 +128,51 @@ func TestReadRecord(t *testing.T) {
 	r = NewRecordLayer(bytes.NewBuffer(plaintext))
 	pt, err = r.ReadRecord()
 	assertError(t, err, "Failed to reject record with incorrect version")
+
+	// Test success on the version used for an initial ClientHello
 	plaintext[2] = 0x01
+	r = NewRecordLayer(bytes.NewBuffer(plaintext))
+	pt, err = r.ReadRecord()
+	assertNotError(t, err, "Failed to accept record with version 0x0301")
+	plaintext[2] = 0x03
 	allowWrongVersionNumber = originalAllowWrongVersionNumber
 
+	// Test that change_cipher_spec records are dropped during the handshake
+	ccs := unhex(changeCipherSpecHex)
+	r = NewRecordLayer(bytes.NewBuffer(append(ccs, plaintext...)))
+	r.allowChangeCipherSpec = true
+	pt, err = r.ReadRecord()
+	assertNotError(t, err, "Failed to skip change_cipher_spec record")
+	assertEquals(t, pt.contentType, RecordTypeAlert)
+	assertByteEquals(t, pt.fragment, plaintext[5:])
+
+	// Test failure on a change_cipher_spec record outside the handshake
+	r = NewRecordLayer(bytes.NewBuffer(append(ccs, plaintext...)))
+	pt, err = r.ReadRecord()
+	_, ok := err.(UnexpectedRecordError)
+	assert(t, ok, "Accepted a change_cipher_spec record outside the handshake")
+
+	// Test failure on too many change_cipher_spec records in a row, which
+	// are dropped without growing the stack
+	stream := bytes.Repeat(ccs, maxChangeCipherSpecs)
+	r = NewRecordLayer(bytes.NewBuffer(append(stream, plaintext...)))
+	r.allowChangeCipherSpec = true
+	pt, err = r.ReadRecord()
+	assertNotError(t, err, "Failed to skip change_cipher_spec records")
+	stream = bytes.Repeat(ccs, maxChangeCipherSpecs+1)
+	r = NewRecordLayer(bytes.NewBuffer(append(stream, plaintext...)))
+	r.allowChangeCipherSpec = true
+	pt, err = r.ReadRecord()
+	_, ok = err.(UnexpectedRecordError)
+	assert(t, ok, "Accepted too many change_cipher_spec records")
+
+	// Test failure on a malformed change_cipher_spec record
+	ccs[len(ccs)-1] = 0x02
+	r = NewRecordLayer(bytes.NewBuffer(ccs))
+	r.allowChangeCipherSpec = true
+	pt, err = r.ReadRecord()
+	assertError(t, err, "Accepted a malformed change_cipher_spec record")
+
 	// Test failure on size too big
 	plaintext[3] = 0xFF
 	r = NewRecordLayer(bytes.NewBuffer(plaintext))
@@ -206,7 +304,7 @@ func TestEncryptRecord(t *testing.T) {
 	assertNotError(t, err, "Failed to properly handle sequence number change")
 	assertByteEquals(t, b.Bytes(), ciphertext2)
 
-	// Test failure on size too big after encrypt
+	// Test success on a full-size record, which is expanded by encryption
 	b.Truncate(0)
 	r = NewRecordLayer(b)
 	r.Rekey(newAESGCM, key, iv)
@@ -215,6 +313,17 @@ func TestEncryptRecord(t *testing.T) {
 		fragment:    bytes.Repeat([]byte{0}, maxFragmentLen-paddingLength),
 	}
 	err = r.WriteRecordWithPadding(pt, paddingLength)
+	assertNotError(t, err, "Refused a full-size record")
+
+	// Test failure on size too big with padding
+	b.Truncate(0)
+	r = NewRecordLayer(b)
+	r.Rekey(newAESGCM, key, iv)
+	pt = &TLSPlaintext{
+		contentType: RecordType(plaintext[0]),
+		fragment:    bytes.Repeat([]byte{0}, maxFragmentLen-paddingLength+1),
+	}
+	err = r.WriteRecordWithPadding(pt, paddingLength)
 	assertError(t, err, "Allowed a too-large record")
 }
 
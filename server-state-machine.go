@@ -2,8 +2,10 @@ package mint
 
 import (
 	"bytes"
+	"crypto/x509"
 	"hash"
 	"reflect"
+	"time"
 )
 
 // Server State Machine
@@ -61,6 +63,9 @@ type ServerStateStart struct {
 	Caps Capabilities
 
 	cookie            []byte
+	cipherSuite       CipherSuite // from the HelloRetryRequest
+	version           uint16
+	requestedGroup    NamedGroup
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 }
@@ -81,7 +86,7 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	clientHello := hm
 	connParams := ConnectionParameters{}
 
-	supportedVersions := new(SupportedVersionsExtension)
+	supportedVersions := &SupportedVersionsExtension{HandshakeType: HandshakeTypeClientHello}
 	serverName := new(ServerNameExtension)
 	supportedGroups := new(SupportedGroupsExtension)
 	signatureAlgorithms := new(SignatureAlgorithmsExtension)
@@ -101,29 +106,89 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	ch.Extensions.Find(clientPSK)
 	ch.Extensions.Find(clientALPN)
 	ch.Extensions.Find(clientPSKModes)
-	ch.Extensions.Find(clientCookie)
+	gotCookie := ch.Extensions.Find(clientCookie)
+	connParams.PostHandshakeAuth = ch.Extensions.Find(&PostHandshakeAuthExtension{})
 
 	if gotServerName {
 		connParams.ServerName = string(*serverName)
 	}
 
+	// With stateless cookies, the state from a HelloRetryRequest comes back in
+	// the cookie instead of being kept here
+	if len(state.Caps.CookieKey) > 0 && state.helloRetryRequest == nil && gotCookie {
+		cs, ok := openCookie(state.Caps.CookieKey, clientCookie.Cookie)
+		if !ok {
+			logf(logTypeHandshake, "[ServerStateStart] Invalid cookie [%x]", clientCookie.Cookie)
+			return nil, nil, AlertAccessDenied
+		}
+
+		helloRetryRequest, err := newHelloRetryRequest(ch.LegacySessionID, cs.CipherSuite, cs.Version, cs.RequestedGroup, clientCookie.Cookie)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error rebuilding HRR [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		state.cookie = clientCookie.Cookie
+		state.cipherSuite = cs.CipherSuite
+		state.version = cs.Version
+		state.requestedGroup = cs.RequestedGroup
+		state.firstClientHello = &HandshakeMessage{
+			msgType: HandshakeTypeMessageHash,
+			body:    cs.ClientHelloHash,
+		}
+		state.helloRetryRequest = helloRetryRequest
+	}
+
+	keyLog := newKeyLogger(state.Caps.KeyLogWriter, ch.Random)
+
 	// If the client didn't send supportedVersions or doesn't support 1.3,
 	// then we're done here.
 	if !gotSupportedVersions {
 		logf(logTypeHandshake, "[ServerStateStart] Client did not send supported_versions")
 		return nil, nil, AlertProtocolVersion
 	}
-	versionOK, _ := VersionNegotiation(supportedVersions.Versions, []uint16{supportedVersion})
+	versionOK, version := VersionNegotiation(supportedVersions.Versions, state.Caps.SupportedVersions)
 	if !versionOK {
 		logf(logTypeHandshake, "[ServerStateStart] Client does not support the same version")
 		return nil, nil, AlertProtocolVersion
 	}
+	connParams.Version = version
+
+	// The second ClientHello has to lead to the version and ciphersuite that
+	// the HelloRetryRequest committed to
+	if state.helloRetryRequest != nil && connParams.Version != state.version {
+		logf(logTypeHandshake, "[ServerStateStart] Version changed after HelloRetryRequest [%04x] != [%04x]", connParams.Version, state.version)
+		return nil, nil, AlertIllegalParameter
+	}
+
+	// A client can't send early data after a HelloRetryRequest
+	if state.helloRetryRequest != nil && gotEarlyData {
+		logf(logTypeHandshake, "[ServerStateStart] Early data signaled after HelloRetryRequest")
+		return nil, nil, AlertIllegalParameter
+	}
+
+	if state.Caps.ExtensionHandler != nil {
+		err := state.Caps.ExtensionHandler.Receive(HandshakeTypeClientHello, &ch.Extensions)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error processing application extensions [%v]", err)
+			return nil, nil, extensionHandlerAlert(err, AlertIllegalParameter)
+		}
+	}
 
 	if state.Caps.RequireCookie && state.cookie != nil && !bytes.Equal(state.cookie, clientCookie.Cookie) {
 		logf(logTypeHandshake, "[ServerStateStart] Cookie mismatch [%x] != [%x]", clientCookie.Cookie, state.cookie)
 		return nil, nil, AlertAccessDenied
 	}
 
+	// If we asked for a key share in a specific group, then the client must
+	// have sent exactly that one
+	if state.requestedGroup != 0 {
+		if len(clientKeyShares.Shares) != 1 || clientKeyShares.Shares[0].Group != state.requestedGroup {
+			logf(logTypeHandshake, "[ServerStateStart] Client did not send a key share for the requested group [%04x]", state.requestedGroup)
+			return nil, nil, AlertIllegalParameter
+		}
+	}
+
 	// Figure out if we can do DH
 	canDoDH, dhGroup, dhPublic, dhSecret := DHNegotiation(clientKeyShares.Shares, state.Caps.Groups)
 
@@ -164,45 +229,74 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		logf(logTypeHandshake, "[ServerStateStart] No common ciphersuite found [%v]", err)
 		return nil, nil, AlertHandshakeFailure
 	}
+	if state.helloRetryRequest != nil && connParams.CipherSuite != state.cipherSuite {
+		logf(logTypeHandshake, "[ServerStateStart] Ciphersuite changed after HelloRetryRequest [%04x] != [%04x]", connParams.CipherSuite, state.cipherSuite)
+		return nil, nil, AlertIllegalParameter
+	}
 
-	// Send a cookie if required
+	// If we need to do DH, but the client didn't send a key share we can use,
+	// ask for one in a group we have in common
+	var requestedGroup NamedGroup
+	if !connParams.UsingDH && !connParams.UsingPSK && state.helloRetryRequest == nil && gotSupportedGroups {
+		_, requestedGroup = GroupNegotiation(supportedGroups.Groups, state.Caps.Groups)
+	}
+
+	// Send a HelloRetryRequest if we need a cookie or a new key share
 	// NB: Need to do this here because it's after ciphersuite selection, which
 	// has to be after PSK selection.
-	// XXX: Doing this statefully for now, could be stateless
-	if state.Caps.RequireCookie && state.cookie == nil {
-		cookie, err := NewCookie()
-		if err != nil {
-			logf(logTypeHandshake, "[ServerStateStart] Error generating cookie [%v]", err)
-			return nil, nil, AlertInternalError
+	sendCookie := state.Caps.RequireCookie && state.cookie == nil
+	if sendCookie || requestedGroup != 0 {
+		params := cipherSuiteMap[connParams.CipherSuite]
+		h := params.Hash.New()
+		h.Write(clientHello.Marshal())
+		firstClientHello := &HandshakeMessage{
+			msgType: HandshakeTypeMessageHash,
+			body:    h.Sum(nil),
 		}
 
-		// Ignoring errors because everything here is newly constructed, so there
-		// shouldn't be marshal errors
-		hrr := &HelloRetryRequestBody{
-			Version:     supportedVersion,
-			CipherSuite: connParams.CipherSuite,
+		var cookie []byte
+		if len(state.Caps.CookieKey) > 0 {
+			cookie, err = sealCookie(state.Caps.CookieKey, cookieState{
+				IssuedAt:        uint64(time.Now().Unix()),
+				CipherSuite:     connParams.CipherSuite,
+				Version:         connParams.Version,
+				RequestedGroup:  requestedGroup,
+				ClientHelloHash: firstClientHello.body,
+			})
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateStart] Error generating cookie [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		} else if sendCookie {
+			cookieExt, err := NewCookie()
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateStart] Error generating cookie [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+
+			cookie = cookieExt.Cookie
+		}
+
+		if requestedGroup != 0 {
+			logf(logTypeHandshake, "[ServerStateStart] Requesting a key share for group [%04x]", requestedGroup)
 		}
-		hrr.Extensions.Add(cookie)
 
-		helloRetryRequest, err := HandshakeMessageFromBody(hrr)
+		helloRetryRequest, err := newHelloRetryRequest(ch.LegacySessionID, connParams.CipherSuite, connParams.Version, requestedGroup, cookie)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateStart] Error marshaling HRR [%v]", err)
 			return nil, nil, AlertInternalError
 		}
 
-		params := cipherSuiteMap[connParams.CipherSuite]
-		h := params.Hash.New()
-		h.Write(clientHello.Marshal())
-		firstClientHello := &HandshakeMessage{
-			msgType: HandshakeTypeMessageHash,
-			body:    h.Sum(nil),
-		}
-
-		nextState := ServerStateStart{
-			Caps:              state.Caps,
-			cookie:            cookie.Cookie,
-			firstClientHello:  firstClientHello,
-			helloRetryRequest: helloRetryRequest,
+		// A stateless server starts over, and gets its state back from the
+		// cookie in the next ClientHello
+		nextState := ServerStateStart{Caps: state.Caps}
+		if len(state.Caps.CookieKey) == 0 {
+			nextState.cookie = cookie
+			nextState.cipherSuite = connParams.CipherSuite
+			nextState.version = connParams.Version
+			nextState.requestedGroup = requestedGroup
+			nextState.firstClientHello = firstClientHello
+			nextState.helloRetryRequest = helloRetryRequest
 		}
 		toSend := []HandshakeAction{SendHandshakeMessage{helloRetryRequest}}
 		logf(logTypeHandshake, "[ServerStateStart] -> [ServerStateStart]")
@@ -220,34 +314,102 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 	var certScheme SignatureScheme
 	if connParams.UsingPSK {
 		pskSecret = psk.Key
+		connParams.UsingResumption = psk.IsResumption
 	} else {
 		psk = nil
 
 		// If we're not using a PSK mode, then we need to have certain extensions
-		if !gotServerName || !gotSupportedGroups || !gotSignatureAlgorithms {
-			logf(logTypeHandshake, "[ServerStateStart] Insufficient extensions (%v %v %v)",
-				gotServerName, gotSupportedGroups, gotSignatureAlgorithms)
+		if !gotSupportedGroups || !gotSignatureAlgorithms {
+			logf(logTypeHandshake, "[ServerStateStart] Insufficient extensions (%v %v)",
+				gotSupportedGroups, gotSignatureAlgorithms)
 			return nil, nil, AlertMissingExtension
 		}
 
-		// Select a certificate
-		name := string(*serverName)
-		var err error
-		cert, certScheme, err = CertificateSelection(&name, signatureAlgorithms.Algorithms, state.Caps.Certificates)
-		if err != nil {
-			logf(logTypeHandshake, "[ServerStateStart] No appropriate certificate found [%v]", err)
-			return nil, nil, AlertAccessDenied
+		// Let the application choose a certificate if it wants to
+		if state.Caps.GetCertificate != nil {
+			hello := &ClientHelloInfo{
+				ServerName:       connParams.ServerName,
+				SignatureSchemes: signatureAlgorithms.Algorithms,
+				SupportedProtos:  clientALPN.Protocols,
+			}
+
+			appCert, err := state.Caps.GetCertificate(hello)
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateStart] Error getting certificate [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+
+			if appCert != nil {
+				cert, certScheme, err = CertificateSelection(nil, signatureAlgorithms.Algorithms, []*Certificate{appCert})
+				if err != nil {
+					logf(logTypeHandshake, "[ServerStateStart] Application certificate is not usable [%v]", err)
+					return nil, nil, AlertHandshakeFailure
+				}
+			}
+		}
+
+		// Otherwise, select one of the configured certificates, falling back to
+		// a default one if none match the server name
+		if cert == nil {
+			var name *string
+			if gotServerName {
+				name = &connParams.ServerName
+			}
+
+			var err error
+			cert, certScheme, err = CertificateSelection(name, signatureAlgorithms.Algorithms, state.Caps.Certificates)
+			if err != nil && name != nil {
+				logf(logTypeHandshake, "[ServerStateStart] Using default certificate [%v]", err)
+				cert, certScheme, err = CertificateSelection(nil, signatureAlgorithms.Algorithms, state.Caps.Certificates)
+			}
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateStart] No appropriate certificate found [%v]", err)
+				return nil, nil, AlertAccessDenied
+			}
 		}
+		connParams.SignatureScheme = certScheme
 	}
 
-	if !connParams.UsingDH {
+	if connParams.UsingDH {
+		connParams.Group = dhGroup
+	} else {
 		dhSecret = nil
 	}
 
-	// Figure out if we're going to do early data
+	// Figure out if we're going to do early data.  The client sends early data
+	// with its first PSK, so it can only be accepted if that one was selected,
+	// and tickets only allow it if they advertised a limit.
 	var clientEarlyTrafficSecret []byte
 	connParams.ClientSendingEarlyData = gotEarlyData
-	connParams.UsingEarlyData = EarlyDataNegotiation(connParams.UsingPSK, gotEarlyData, state.Caps.AllowEarlyData)
+	usingFirstPSK := connParams.UsingPSK && selectedPSK == 0
+	pskAllowsEarlyData := usingFirstPSK && (!psk.IsResumption || psk.MaxEarlyDataSize > 0)
+	connParams.UsingEarlyData = EarlyDataNegotiation(pskAllowsEarlyData, gotEarlyData, state.Caps.AllowEarlyData)
+	if connParams.UsingEarlyData {
+		var ticketAge time.Duration
+		if psk.IsResumption {
+			obfuscatedAge := clientPSK.Identities[selectedPSK].ObfuscatedTicketAge
+			ticketAge = time.Duration(obfuscatedAge-psk.TicketAgeAdd) * time.Millisecond
+		}
+
+		var antiReplay AntiReplay = FreshTickets{}
+		if state.Caps.AntiReplay != nil {
+			antiReplay = state.Caps.AntiReplay
+		}
+
+		binder := clientPSK.Binders[selectedPSK].Binder
+		if !antiReplay.AcceptEarlyData(psk, binder, ticketAge) {
+			logf(logTypeHandshake, "[ServerStateStart] Rejecting early data as a possible replay")
+			connParams.UsingEarlyData = false
+		}
+	}
+
+	// Early data is limited by the ticket it was sent with, or by the
+	// configured limit with external PSKs.  Rejected early data is skipped up
+	// to the same limit.
+	maxEarlyDataSize := state.Caps.MaxEarlyDataSize
+	if connParams.UsingPSK && psk.IsResumption && psk.MaxEarlyDataSize > 0 {
+		maxEarlyDataSize = psk.MaxEarlyDataSize
+	}
 	if connParams.UsingEarlyData {
 
 		h := params.Hash.New()
@@ -257,6 +419,7 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		zero := bytes.Repeat([]byte{0}, params.Hash.Size())
 		earlySecret := HkdfExtract(params.Hash, zero, pskSecret)
 		clientEarlyTrafficSecret = deriveSecret(params, earlySecret, labelEarlyTrafficSecret, chHash)
+		keyLog.log(keyLogLabelClientEarlyTraffic, clientEarlyTrafficSecret)
 	}
 
 	// Select a next protocol
@@ -279,13 +442,53 @@ func (state ServerStateStart) Next(hm *HandshakeMessage) (HandshakeState, []Hand
 		cert:                     cert,
 		certScheme:               certScheme,
 		clientEarlyTrafficSecret: clientEarlyTrafficSecret,
+		maxEarlyDataSize:         maxEarlyDataSize,
+		legacySessionID:          ch.LegacySessionID,
 
 		firstClientHello:  state.firstClientHello,
 		helloRetryRequest: state.helloRetryRequest,
 		clientHello:       clientHello,
+		keyLog:            keyLog,
 	}.Next(nil)
 }
 
+// newHelloRetryRequest builds a HelloRetryRequest, with a key_share extension
+// if a group is requested and a cookie extension if a cookie is provided
+func newHelloRetryRequest(legacySessionID []byte, suite CipherSuite, version uint16, requestedGroup NamedGroup, cookie []byte) (*HandshakeMessage, error) {
+	hrr := &HelloRetryRequestBody{
+		Version:         tls12Version,
+		LegacySessionID: legacySessionID,
+		CipherSuite:     suite,
+	}
+
+	err := hrr.Extensions.Add(&SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeHelloRetryRequest,
+		Versions:      []uint16{version},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if requestedGroup != 0 {
+		err = hrr.Extensions.Add(&KeyShareExtension{
+			HandshakeType: HandshakeTypeHelloRetryRequest,
+			SelectedGroup: requestedGroup,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cookie != nil {
+		err = hrr.Extensions.Add(&CookieExtension{Cookie: cookie})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return HandshakeMessageFromBody(hrr)
+}
+
 type ServerStateNegotiated struct {
 	Caps   Capabilities
 	Params ConnectionParameters
@@ -295,13 +498,16 @@ type ServerStateNegotiated struct {
 	dhSecret                 []byte
 	pskSecret                []byte
 	clientEarlyTrafficSecret []byte
+	maxEarlyDataSize         uint32
 	selectedPSK              int
 	cert                     *Certificate
 	certScheme               SignatureScheme
+	legacySessionID          []byte
 
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 	clientHello       *HandshakeMessage
+	keyLog            keyLogger
 }
 
 func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -312,14 +518,26 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 
 	// Create the ServerHello
 	sh := &ServerHelloBody{
-		Version:     supportedVersion,
-		CipherSuite: state.Params.CipherSuite,
+		Version:         tls12Version,
+		LegacySessionID: state.legacySessionID,
+		CipherSuite:     state.Params.CipherSuite,
 	}
 	_, err := prng.Read(sh.Random[:])
 	if err != nil {
 		logf(logTypeHandshake, "[ServerStateNegotiated] Error creating server random [%v]", err)
 		return nil, nil, AlertInternalError
 	}
+
+	// NB: We only ever negotiate TLS 1.3, so the random value never needs a
+	// downgrade sentinel.
+	err = sh.Extensions.Add(&SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeServerHello,
+		Versions:      []uint16{state.Params.Version},
+	})
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateNegotiated] Error adding supported_versions extension [%v]", err)
+		return nil, nil, AlertInternalError
+	}
 	if state.Params.UsingDH {
 		logf(logTypeHandshake, "[ServerStateNegotiated] sending DH extension")
 		err = sh.Extensions.Add(&KeyShareExtension{
@@ -391,6 +609,8 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 	logf(logTypeCrypto, "client handshake traffic secret: [%d] %x", len(clientHandshakeTrafficSecret), clientHandshakeTrafficSecret)
 	logf(logTypeCrypto, "server handshake traffic secret: [%d] %x", len(serverHandshakeTrafficSecret), serverHandshakeTrafficSecret)
 	logf(logTypeCrypto, "master secret: [%d] %x", len(masterSecret), masterSecret)
+	state.keyLog.log(keyLogLabelClientHandshakeTraffic, clientHandshakeTrafficSecret)
+	state.keyLog.log(keyLogLabelServerHandshakeTraffic, serverHandshakeTrafficSecret)
 
 	clientHandshakeKeys := makeTrafficKeys(params, clientHandshakeTrafficSecret)
 	serverHandshakeKeys := makeTrafficKeys(params, serverHandshakeTrafficSecret)
@@ -413,6 +633,13 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 			return nil, nil, AlertInternalError
 		}
 	}
+	if state.Caps.ExtensionHandler != nil {
+		err = state.Caps.ExtensionHandler.Send(HandshakeTypeEncryptedExtensions, &eeList)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiated] Error adding application extensions [%v]", err)
+			return nil, nil, extensionHandlerAlert(err, AlertInternalError)
+		}
+	}
 	ee := &EncryptedExtensionsBody{eeList}
 	eem, err := HandshakeMessageFromBody(ee)
 	if err != nil {
@@ -477,7 +704,7 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 		hcv := handshakeHash.Sum(nil)
 		logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
-		err = certificateVerify.Sign(state.cert.PrivateKey, hcv)
+		err = certificateVerify.Sign(state.cert.PrivateKey, serverSignatureContext, hcv)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateNegotiated] Error signing CertificateVerify [%v]", err)
 			return nil, nil, AlertInternalError
@@ -525,6 +752,9 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 
 	exporterSecret := deriveSecret(params, masterSecret, labelExporterSecret, h4)
 	logf(logTypeCrypto, "server exporter secret: [%d] %x", len(exporterSecret), exporterSecret)
+	state.keyLog.logTraffic(keyLogLabelClientTraffic, 0, clientTrafficSecret)
+	state.keyLog.logTraffic(keyLogLabelServerTraffic, 0, serverTrafficSecret)
+	state.keyLog.log(keyLogLabelExporter, exporterSecret)
 
 	if state.Params.UsingEarlyData {
 		clientEarlyTrafficKeys := makeTrafficKeys(params, state.clientEarlyTrafficSecret)
@@ -532,6 +762,9 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 		logf(logTypeHandshake, "[ServerStateNegotiated] -> [ServerStateWaitEOED]")
 		nextState := ServerStateWaitEOED{
 			AuthCertificate:              state.Caps.AuthCertificate,
+			reportVerifyError:            state.Caps.reportVerifyError,
+			ClientCAs:                    state.Caps.ClientCAs,
+			InsecureSkipVerify:           state.Caps.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 params,
 			handshakeHash:                handshakeHash,
@@ -540,10 +773,11 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 			clientTrafficSecret:          clientTrafficSecret,
 			serverTrafficSecret:          serverTrafficSecret,
 			exporterSecret:               exporterSecret,
+			keyLog:                       state.keyLog,
 		}
 		toSend = append(toSend, []HandshakeAction{
 			RekeyIn{Label: "early", KeySet: clientEarlyTrafficKeys},
-			ReadEarlyData{},
+			ReadEarlyData{MaxSize: state.maxEarlyDataSize},
 		}...)
 		return nextState, toSend, AlertNoAlert
 	}
@@ -551,10 +785,13 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 	logf(logTypeHandshake, "[ServerStateNegotiated] -> [ServerStateWaitFlight2]")
 	toSend = append(toSend, []HandshakeAction{
 		RekeyIn{Label: "handshake", KeySet: clientHandshakeKeys},
-		ReadPastEarlyData{},
+		ReadPastEarlyData{MaxSize: state.maxEarlyDataSize},
 	}...)
 	waitFlight2 := ServerStateWaitFlight2{
 		AuthCertificate:              state.Caps.AuthCertificate,
+		reportVerifyError:            state.Caps.reportVerifyError,
+		ClientCAs:                    state.Caps.ClientCAs,
+		InsecureSkipVerify:           state.Caps.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 params,
 		handshakeHash:                handshakeHash,
@@ -563,6 +800,7 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 		clientTrafficSecret:          clientTrafficSecret,
 		serverTrafficSecret:          serverTrafficSecret,
 		exporterSecret:               exporterSecret,
+		keyLog:                       state.keyLog,
 	}
 	nextState, moreToSend, alert := waitFlight2.Next(nil)
 	toSend = append(toSend, moreToSend...)
@@ -571,6 +809,9 @@ func (state ServerStateNegotiated) Next(hm *HandshakeMessage) (HandshakeState, [
 
 type ServerStateWaitEOED struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	reportVerifyError            func(err error)
+	ClientCAs                    *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 CipherSuiteParams
 	masterSecret                 []byte
@@ -579,6 +820,7 @@ type ServerStateWaitEOED struct {
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
 	exporterSecret               []byte
+	keyLog                       keyLogger
 }
 
 func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -602,6 +844,9 @@ func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []H
 	}
 	waitFlight2 := ServerStateWaitFlight2{
 		AuthCertificate:              state.AuthCertificate,
+		reportVerifyError:            state.reportVerifyError,
+		ClientCAs:                    state.ClientCAs,
+		InsecureSkipVerify:           state.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		handshakeHash:                state.handshakeHash,
@@ -610,6 +855,7 @@ func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []H
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
 		exporterSecret:               state.exporterSecret,
+		keyLog:                       state.keyLog,
 	}
 	nextState, moreToSend, alert := waitFlight2.Next(nil)
 	toSend = append(toSend, moreToSend...)
@@ -618,6 +864,9 @@ func (state ServerStateWaitEOED) Next(hm *HandshakeMessage) (HandshakeState, []H
 
 type ServerStateWaitFlight2 struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	reportVerifyError            func(err error)
+	ClientCAs                    *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 CipherSuiteParams
 	masterSecret                 []byte
@@ -626,6 +875,7 @@ type ServerStateWaitFlight2 struct {
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
 	exporterSecret               []byte
+	keyLog                       keyLogger
 }
 
 func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -638,6 +888,9 @@ func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState,
 		logf(logTypeHandshake, "[ServerStateWaitFlight2] -> [ServerStateWaitCert]")
 		nextState := ServerStateWaitCert{
 			AuthCertificate:              state.AuthCertificate,
+			reportVerifyError:            state.reportVerifyError,
+			ClientCAs:                    state.ClientCAs,
+			InsecureSkipVerify:           state.InsecureSkipVerify,
 			Params:                       state.Params,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
@@ -646,6 +899,7 @@ func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState,
 			clientTrafficSecret:          state.clientTrafficSecret,
 			serverTrafficSecret:          state.serverTrafficSecret,
 			exporterSecret:               state.exporterSecret,
+			keyLog:                       state.keyLog,
 		}
 		return nextState, nil, AlertNoAlert
 	}
@@ -660,12 +914,16 @@ func (state ServerStateWaitFlight2) Next(hm *HandshakeMessage) (HandshakeState,
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
 		exporterSecret:               state.exporterSecret,
+		keyLog:                       state.keyLog,
 	}
 	return nextState, nil, AlertNoAlert
 }
 
 type ServerStateWaitCert struct {
 	AuthCertificate              func(chain []CertificateEntry) error
+	reportVerifyError            func(err error)
+	ClientCAs                    *x509.CertPool
+	InsecureSkipVerify           bool
 	Params                       ConnectionParameters
 	cryptoParams                 CipherSuiteParams
 	masterSecret                 []byte
@@ -674,6 +932,7 @@ type ServerStateWaitCert struct {
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
 	exporterSecret               []byte
+	keyLog                       keyLogger
 }
 
 func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -691,26 +950,19 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 
 	state.handshakeHash.Write(hm.Marshal())
 
+	// A certificate is only requested during the handshake if it is required,
+	// whether or not it is going to be verified
 	if len(cert.CertificateList) == 0 {
-		logf(logTypeHandshake, "[ServerStateWaitCert] WARNING client did not provide a certificate")
-
-		logf(logTypeHandshake, "[ServerStateWaitCert] -> [ServerStateWaitFinished]")
-		nextState := ServerStateWaitFinished{
-			Params:                       state.Params,
-			cryptoParams:                 state.cryptoParams,
-			masterSecret:                 state.masterSecret,
-			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
-			handshakeHash:                state.handshakeHash,
-			clientTrafficSecret:          state.clientTrafficSecret,
-			serverTrafficSecret:          state.serverTrafficSecret,
-			exporterSecret:               state.exporterSecret,
-		}
-		return nextState, nil, AlertNoAlert
+		logf(logTypeHandshake, "[ServerStateWaitCert] Client did not provide a certificate")
+		return nil, nil, AlertCertificateRequired
 	}
 
 	logf(logTypeHandshake, "[ServerStateWaitCert] -> [ServerStateWaitCV]")
 	nextState := ServerStateWaitCV{
 		AuthCertificate:              state.AuthCertificate,
+		reportVerifyError:            state.reportVerifyError,
+		ClientCAs:                    state.ClientCAs,
+		InsecureSkipVerify:           state.InsecureSkipVerify,
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
 		masterSecret:                 state.masterSecret,
@@ -720,14 +972,18 @@ func (state ServerStateWaitCert) Next(hm *HandshakeMessage) (HandshakeState, []H
 		serverTrafficSecret:          state.serverTrafficSecret,
 		clientCertificate:            cert,
 		exporterSecret:               state.exporterSecret,
+		keyLog:                       state.keyLog,
 	}
 	return nextState, nil, AlertNoAlert
 }
 
 type ServerStateWaitCV struct {
-	AuthCertificate func(chain []CertificateEntry) error
-	Params          ConnectionParameters
-	cryptoParams    CipherSuiteParams
+	AuthCertificate    func(chain []CertificateEntry) error
+	reportVerifyError  func(err error)
+	ClientCAs          *x509.CertPool
+	InsecureSkipVerify bool
+	Params             ConnectionParameters
+	cryptoParams       CipherSuiteParams
 
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
@@ -738,6 +994,7 @@ type ServerStateWaitCV struct {
 	exporterSecret      []byte
 
 	clientCertificate *CertificateBody
+	keyLog            keyLogger
 }
 
 func (state ServerStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -757,20 +1014,34 @@ func (state ServerStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	hcv := state.handshakeHash.Sum(nil)
 	logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
-	clientPublicKey := state.clientCertificate.CertificateList[0].CertData.PublicKey
-	if err := certVerify.Verify(clientPublicKey, hcv); err != nil {
+	clientPublicKey := certificatePublicKey(state.clientCertificate.CertificateList[0].CertData)
+	if err := certVerify.Verify(clientPublicKey, clientSignatureContext, hcv); err != nil {
 		logf(logTypeHandshake, "[ServerStateWaitCV] Failure in client auth verification [%v]", err)
 		return nil, nil, AlertHandshakeFailure
 	}
 
+	peerCertificates := make([]*x509.Certificate, len(state.clientCertificate.CertificateList))
+	for i, entry := range state.clientCertificate.CertificateList {
+		peerCertificates[i] = entry.CertData
+	}
+
+	var verifiedChains [][]*x509.Certificate
+	if !state.InsecureSkipVerify {
+		verifiedChains, err = verifyCertificateChain(peerCertificates, state.ClientCAs, "", x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateWaitCV] Client certificate failed to verify [%v]", err)
+			return nil, nil, verifyFailure(state.reportVerifyError, peerCertificates, err)
+		}
+	} else {
+		logf(logTypeHandshake, "[ServerStateWaitCV] WARNING: No verification of client certificate")
+	}
+
 	if state.AuthCertificate != nil {
 		err := state.AuthCertificate(state.clientCertificate.CertificateList)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateWaitCV] Application rejected client certificate")
-			return nil, nil, AlertBadCertificate
+			return nil, nil, verifyFailure(state.reportVerifyError, peerCertificates, err)
 		}
-	} else {
-		logf(logTypeHandshake, "[ServerStateWaitCV] WARNING: No verification of client certificate")
 	}
 
 	// If it passes, record the certificateVerify in the transcript hash
@@ -780,12 +1051,15 @@ func (state ServerStateWaitCV) Next(hm *HandshakeMessage) (HandshakeState, []Han
 	nextState := ServerStateWaitFinished{
 		Params:                       state.Params,
 		cryptoParams:                 state.cryptoParams,
+		peerCertificates:             peerCertificates,
+		verifiedChains:               verifiedChains,
 		masterSecret:                 state.masterSecret,
 		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 		handshakeHash:                state.handshakeHash,
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
 		exporterSecret:               state.exporterSecret,
+		keyLog:                       state.keyLog,
 	}
 	return nextState, nil, AlertNoAlert
 }
@@ -794,6 +1068,9 @@ type ServerStateWaitFinished struct {
 	Params       ConnectionParameters
 	cryptoParams CipherSuiteParams
 
+	peerCertificates []*x509.Certificate
+	verifiedChains   [][]*x509.Certificate
+
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 
@@ -801,6 +1078,7 @@ type ServerStateWaitFinished struct {
 	clientTrafficSecret []byte
 	serverTrafficSecret []byte
 	exporterSecret      []byte
+	keyLog              keyLogger
 }
 
 func (state ServerStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert) {
@@ -844,10 +1122,14 @@ func (state ServerStateWaitFinished) Next(hm *HandshakeMessage) (HandshakeState,
 		Params:              state.Params,
 		isClient:            false,
 		cryptoParams:        state.cryptoParams,
+		peerCertificates:    state.peerCertificates,
+		verifiedChains:      state.verifiedChains,
 		resumptionSecret:    resumptionSecret,
 		clientTrafficSecret: state.clientTrafficSecret,
 		serverTrafficSecret: state.serverTrafficSecret,
 		exporterSecret:      state.exporterSecret,
+		keyLog:              state.keyLog,
+		handshakeHash:       state.handshakeHash,
 	}
 	toSend := []HandshakeAction{
 		RekeyIn{Label: "application", KeySet: clientTrafficKeys},
@@ -1,6 +1,12 @@
 package mint
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
 	"time"
 )
 
@@ -14,9 +20,17 @@ type SendHandshakeMessage struct {
 
 type SendEarlyData struct{}
 
-type ReadEarlyData struct{}
+// ReadEarlyData reads early data of up to MaxSize bytes, or any amount if
+// MaxSize is zero
+type ReadEarlyData struct {
+	MaxSize uint32
+}
 
-type ReadPastEarlyData struct{}
+// ReadPastEarlyData skips rejected early data of up to MaxSize bytes, or any
+// amount if MaxSize is zero
+type ReadPastEarlyData struct {
+	MaxSize uint32
+}
 
 type RekeyIn struct {
 	Label  string
@@ -32,6 +46,15 @@ type StorePSK struct {
 	PSK PreSharedKey
 }
 
+// extensionHandlerAlert returns the alert for an error from an
+// AppExtensionHandler, which may return an Alert to choose its own.
+func extensionHandlerAlert(err error, defaultAlert Alert) Alert {
+	if alert, ok := err.(Alert); ok {
+		return alert
+	}
+	return defaultAlert
+}
+
 type HandshakeState interface {
 	Next(hm *HandshakeMessage) (HandshakeState, []HandshakeAction, Alert)
 }
@@ -40,21 +63,37 @@ type HandshakeState interface {
 // as an input to TLS negotiation
 type Capabilities struct {
 	// For both client and server
-	CipherSuites     []CipherSuite
-	Groups           []NamedGroup
-	SignatureSchemes []SignatureScheme
-	PSKs             PreSharedKeyCache
-	Certificates     []*Certificate
-	AuthCertificate  func(chain []CertificateEntry) error
+	SupportedVersions []uint16
+	CipherSuites      []CipherSuite
+	Groups            []NamedGroup
+	SignatureSchemes  []SignatureScheme
+	PSKs              PreSharedKeyCache
+	Certificates      []*Certificate
+	AuthCertificate   func(chain []CertificateEntry) error
+	ExtensionHandler  AppExtensionHandler
+	KeyLogWriter      io.Writer
+
+	// Skip verification of the peer's certificate chain
+	InsecureSkipVerify bool
+
+	// Called with the error when the peer's certificates fail verification
+	reportVerifyError func(err error)
 
 	// For client
-	PSKModes []PSKKeyExchangeMode
+	PSKModes       []PSKKeyExchangeMode
+	KeyShareGroups []NamedGroup
+	RootCAs        *x509.CertPool
 
 	// For server
 	NextProtos        []string
 	AllowEarlyData    bool
+	MaxEarlyDataSize  uint32
+	AntiReplay        AntiReplay
 	RequireCookie     bool
+	CookieKey         []byte
 	RequireClientAuth bool
+	ClientCAs         *x509.CertPool
+	GetCertificate    func(*ClientHelloInfo) (*Certificate, error)
 }
 
 // ConnectionOptions objects represent per-connection settings for a client
@@ -73,10 +112,15 @@ type ConnectionParameters struct {
 	ClientSendingEarlyData bool
 	UsingEarlyData         bool
 	UsingClientAuth        bool
-
-	CipherSuite CipherSuite
-	ServerName  string
-	NextProto   string
+	UsingResumption        bool
+	PostHandshakeAuth      bool // the client offered post-handshake authentication
+
+	Version         uint16
+	CipherSuite     CipherSuite
+	Group           NamedGroup
+	SignatureScheme SignatureScheme
+	ServerName      string
+	NextProto       string
 }
 
 // StateConnected is symmetric between client and server
@@ -84,10 +128,26 @@ type StateConnected struct {
 	Params              ConnectionParameters
 	isClient            bool
 	cryptoParams        CipherSuiteParams
+	peerCertificates    []*x509.Certificate
+	verifiedChains      [][]*x509.Certificate
 	resumptionSecret    []byte
 	clientTrafficSecret []byte
 	serverTrafficSecret []byte
 	exporterSecret      []byte
+	keyLog              keyLogger
+
+	// Number of key updates applied to each traffic secret
+	clientGeneration int
+	serverGeneration int
+
+	// For post-handshake authentication: the transcript through the client's
+	// Finished, the client's certificates, the server's outstanding
+	// CertificateRequest, if any, and whether the client answered the last
+	// one without a certificate
+	handshakeHash hash.Hash
+	certificates  []*Certificate
+	pendingAuth   *pendingClientAuth
+	authDeclined  bool
 }
 
 func (state *StateConnected) KeyUpdate(request KeyUpdateRequest) ([]HandshakeAction, Alert) {
@@ -96,10 +156,14 @@ func (state *StateConnected) KeyUpdate(request KeyUpdateRequest) ([]HandshakeAct
 		state.clientTrafficSecret = HkdfExpandLabel(state.cryptoParams.Hash, state.clientTrafficSecret,
 			labelClientApplicationTrafficSecret, []byte{}, state.cryptoParams.Hash.Size())
 		trafficKeys = makeTrafficKeys(state.cryptoParams, state.clientTrafficSecret)
+		state.clientGeneration++
+		state.keyLog.logTraffic(keyLogLabelClientTraffic, state.clientGeneration, state.clientTrafficSecret)
 	} else {
 		state.serverTrafficSecret = HkdfExpandLabel(state.cryptoParams.Hash, state.serverTrafficSecret,
 			labelServerApplicationTrafficSecret, []byte{}, state.cryptoParams.Hash.Size())
 		trafficKeys = makeTrafficKeys(state.cryptoParams, state.serverTrafficSecret)
+		state.serverGeneration++
+		state.keyLog.logTraffic(keyLogLabelServerTraffic, state.serverGeneration, state.serverTrafficSecret)
 	}
 
 	kum, err := HandshakeMessageFromBody(&KeyUpdateBody{KeyUpdateRequest: request})
@@ -115,17 +179,27 @@ func (state *StateConnected) KeyUpdate(request KeyUpdateRequest) ([]HandshakeAct
 	return toSend, AlertNoAlert
 }
 
-func (state *StateConnected) NewSessionTicket(length int, lifetime, earlyDataLifetime uint32) ([]HandshakeAction, Alert) {
+// NewSessionTicket issues a ticket for resuming this connection.  If ticket
+// keys are provided, the resumption state is sealed into the ticket itself,
+// and nothing needs to be stored; otherwise the ticket is random and the PSK
+// is stored in the server's cache.  The ticket allows early data of up to
+// maxEarlyDataSize bytes, or none if it is zero.
+func (state *StateConnected) NewSessionTicket(length int, lifetime, maxEarlyDataSize uint32, ticketKeys [][32]byte) ([]HandshakeAction, Alert) {
 	tkt, err := NewSessionTicket(length, lifetime)
 	if err != nil {
 		logf(logTypeHandshake, "[StateConnected] Error generating NewSessionTicket: %v", err)
 		return nil, AlertInternalError
 	}
 
-	err = tkt.Extensions.Add(&TicketEarlyDataInfoExtension{earlyDataLifetime})
-	if err != nil {
-		logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
-		return nil, AlertInternalError
+	if maxEarlyDataSize > 0 {
+		err = tkt.Extensions.Add(&EarlyDataExtension{
+			HandshakeType:    HandshakeTypeNewSessionTicket,
+			MaxEarlyDataSize: maxEarlyDataSize,
+		})
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
+			return nil, AlertInternalError
+		}
 	}
 
 	resumptionKey := HkdfExpandLabel(state.cryptoParams.Hash, state.resumptionSecret,
@@ -140,6 +214,16 @@ func (state *StateConnected) NewSessionTicket(length int, lifetime, earlyDataLif
 		ReceivedAt:   time.Now(),
 		ExpiresAt:    time.Now().Add(time.Duration(tkt.TicketLifetime) * time.Second),
 		TicketAgeAdd: tkt.TicketAgeAdd,
+
+		MaxEarlyDataSize: maxEarlyDataSize,
+	}
+
+	if len(ticketKeys) > 0 {
+		tkt.Ticket, err = sealTicket(ticketKeys, newPSK)
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error sealing session ticket: %v", err)
+			return nil, AlertInternalError
+		}
 	}
 
 	tktm, err := HandshakeMessageFromBody(tkt)
@@ -148,9 +232,9 @@ func (state *StateConnected) NewSessionTicket(length int, lifetime, earlyDataLif
 		return nil, AlertInternalError
 	}
 
-	toSend := []HandshakeAction{
-		StorePSK{newPSK},
-		SendHandshakeMessage{tktm},
+	toSend := []HandshakeAction{SendHandshakeMessage{tktm}}
+	if len(ticketKeys) == 0 {
+		toSend = append([]HandshakeAction{StorePSK{newPSK}}, toSend...)
 	}
 	return toSend, AlertNoAlert
 }
@@ -174,10 +258,14 @@ func (state StateConnected) Next(hm *HandshakeMessage) (HandshakeState, []Handsh
 			state.clientTrafficSecret = HkdfExpandLabel(state.cryptoParams.Hash, state.clientTrafficSecret,
 				labelClientApplicationTrafficSecret, []byte{}, state.cryptoParams.Hash.Size())
 			trafficKeys = makeTrafficKeys(state.cryptoParams, state.clientTrafficSecret)
+			state.clientGeneration++
+			state.keyLog.logTraffic(keyLogLabelClientTraffic, state.clientGeneration, state.clientTrafficSecret)
 		} else {
 			state.serverTrafficSecret = HkdfExpandLabel(state.cryptoParams.Hash, state.serverTrafficSecret,
 				labelServerApplicationTrafficSecret, []byte{}, state.cryptoParams.Hash.Size())
 			trafficKeys = makeTrafficKeys(state.cryptoParams, state.serverTrafficSecret)
+			state.serverGeneration++
+			state.keyLog.logTraffic(keyLogLabelServerTraffic, state.serverGeneration, state.serverTrafficSecret)
 		}
 
 		toSend := []HandshakeAction{RekeyIn{Label: "update", KeySet: trafficKeys}}
@@ -214,10 +302,292 @@ func (state StateConnected) Next(hm *HandshakeMessage) (HandshakeState, []Handsh
 			TicketAgeAdd: body.TicketAgeAdd,
 		}
 
+		earlyData := EarlyDataExtension{HandshakeType: HandshakeTypeNewSessionTicket}
+		if body.Extensions.Find(&earlyData) {
+			psk.MaxEarlyDataSize = earlyData.MaxEarlyDataSize
+		}
+
 		toSend := []HandshakeAction{StorePSK{psk}}
 		return state, toSend, AlertNoAlert
+
+	case *CertificateRequestBody:
+		if !state.isClient {
+			logf(logTypeHandshake, "[StateConnected] Unexpected CertificateRequest from client")
+			return nil, nil, AlertUnexpectedMessage
+		}
+
+		return state.answerCertificateRequest(hm, body)
+
+	case *CertificateBody, *CertificateVerifyBody, *FinishedBody:
+		if state.isClient || state.pendingAuth == nil {
+			logf(logTypeHandshake, "[StateConnected] Unexpected client authentication message")
+			return nil, nil, AlertUnexpectedMessage
+		}
+
+		return state.readClientAuth(hm, bodyGeneric)
 	}
 
 	logf(logTypeHandshake, "[StateConnected] Unexpected message type %v", hm.msgType)
 	return nil, nil, AlertUnexpectedMessage
 }
+
+// pendingClientAuth is a post-handshake CertificateRequest that the server is
+// waiting for the client to answer, along with how to verify the answer
+type pendingClientAuth struct {
+	context            []byte
+	handshakeHash      hash.Hash
+	clientCAs          *x509.CertPool
+	insecureSkipVerify bool
+	authCertificate    func(chain []CertificateEntry) error
+	reportVerifyError  func(err error)
+
+	certificate      *CertificateBody
+	peerCertificates []*x509.Certificate
+	verifiedChains   [][]*x509.Certificate
+}
+
+// transcriptHash returns a copy of the hash of the handshake transcript, which
+// a post-handshake authentication exchange can extend without changing the
+// original.
+func (state *StateConnected) transcriptHash() (hash.Hash, error) {
+	marshaler, ok := state.handshakeHash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("tls.postauth: Transcript hash cannot be copied")
+	}
+
+	data, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	h := state.cryptoParams.Hash.New()
+	unmarshaler, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, fmt.Errorf("tls.postauth: Transcript hash cannot be copied")
+	}
+	return h, unmarshaler.UnmarshalBinary(data)
+}
+
+// CertificateRequest asks the client to authenticate after the handshake.  The
+// client's response is verified according to the server's capabilities.
+func (state *StateConnected) CertificateRequest(caps Capabilities) ([]HandshakeAction, Alert) {
+	if state.isClient || !state.Params.PostHandshakeAuth || state.pendingAuth != nil {
+		logf(logTypeHandshake, "[StateConnected] Cannot request client authentication")
+		return nil, AlertInternalError
+	}
+
+	context := make([]byte, 32)
+	_, err := prng.Read(context)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error creating CertificateRequest context [%v]", err)
+		return nil, AlertInternalError
+	}
+
+	cr := &CertificateRequestBody{CertificateRequestContext: context}
+	schemes := &SignatureAlgorithmsExtension{Algorithms: caps.SignatureSchemes}
+	err = cr.Extensions.Add(schemes)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error adding supported schemes to CertificateRequest [%v]", err)
+		return nil, AlertInternalError
+	}
+
+	crm, err := HandshakeMessageFromBody(cr)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error marshaling CertificateRequest [%v]", err)
+		return nil, AlertInternalError
+	}
+
+	handshakeHash, err := state.transcriptHash()
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error copying transcript hash [%v]", err)
+		return nil, AlertInternalError
+	}
+	handshakeHash.Write(crm.Marshal())
+
+	state.authDeclined = false
+	state.pendingAuth = &pendingClientAuth{
+		context:            context,
+		handshakeHash:      handshakeHash,
+		clientCAs:          caps.ClientCAs,
+		insecureSkipVerify: caps.InsecureSkipVerify,
+		authCertificate:    caps.AuthCertificate,
+		reportVerifyError:  caps.reportVerifyError,
+	}
+	return []HandshakeAction{SendHandshakeMessage{crm}}, AlertNoAlert
+}
+
+// answerCertificateRequest sends the client's Certificate, CertificateVerify,
+// and Finished in response to a post-handshake CertificateRequest.  If none of
+// the client's certificates is suitable, an empty Certificate is sent.
+func (state StateConnected) answerCertificateRequest(hm *HandshakeMessage, cr *CertificateRequestBody) (HandshakeState, []HandshakeAction, Alert) {
+	if !state.Params.PostHandshakeAuth {
+		logf(logTypeHandshake, "[StateConnected] CertificateRequest without post-handshake auth")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	if len(cr.CertificateRequestContext) == 0 {
+		logf(logTypeHandshake, "[StateConnected] Empty context in post-handshake CertificateRequest")
+		return nil, nil, AlertIllegalParameter
+	}
+
+	schemes := SignatureAlgorithmsExtension{}
+	if !cr.Extensions.Find(&schemes) {
+		logf(logTypeHandshake, "[StateConnected] No signature algorithms in CertificateRequest")
+		return nil, nil, AlertMissingExtension
+	}
+
+	handshakeHash, err := state.transcriptHash()
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error copying transcript hash [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+	handshakeHash.Write(hm.Marshal())
+
+	// Select a certificate, if there is one that fits
+	certificate := &CertificateBody{CertificateRequestContext: cr.CertificateRequestContext}
+	cert, certScheme, err := CertificateSelection(nil, schemes.Algorithms, state.certificates)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] WARNING no appropriate certificate found [%v]", err)
+		cert = nil
+	} else {
+		certificate.CertificateList = make([]CertificateEntry, len(cert.Chain))
+		for i, entry := range cert.Chain {
+			certificate.CertificateList[i] = CertificateEntry{CertData: entry}
+		}
+	}
+
+	certm, err := HandshakeMessageFromBody(certificate)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error marshaling Certificate [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+
+	toSend := []HandshakeAction{SendHandshakeMessage{certm}}
+	handshakeHash.Write(certm.Marshal())
+
+	if cert != nil {
+		certificateVerify := &CertificateVerifyBody{Algorithm: certScheme}
+		err = certificateVerify.Sign(cert.PrivateKey, clientSignatureContext, handshakeHash.Sum(nil))
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error signing CertificateVerify [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		certvm, err := HandshakeMessageFromBody(certificateVerify)
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error marshaling CertificateVerify [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		toSend = append(toSend, SendHandshakeMessage{certvm})
+		handshakeHash.Write(certvm.Marshal())
+		state.Params.UsingClientAuth = true
+	}
+
+	// The Finished is keyed with the current client traffic secret
+	finishedData := computeFinishedData(state.cryptoParams, state.clientTrafficSecret, handshakeHash.Sum(nil))
+	fin := &FinishedBody{
+		VerifyDataLen: len(finishedData),
+		VerifyData:    finishedData,
+	}
+	finm, err := HandshakeMessageFromBody(fin)
+	if err != nil {
+		logf(logTypeHandshake, "[StateConnected] Error marshaling Finished [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+
+	toSend = append(toSend, SendHandshakeMessage{finm})
+	return state, toSend, AlertNoAlert
+}
+
+// readClientAuth processes the client's answer to a post-handshake
+// CertificateRequest.  Once the client's Finished has been verified, its
+// certificates become the peer certificates of the connection.
+func (state StateConnected) readClientAuth(hm *HandshakeMessage, bodyGeneric HandshakeMessageBody) (HandshakeState, []HandshakeAction, Alert) {
+	auth := state.pendingAuth
+
+	switch body := bodyGeneric.(type) {
+	case *CertificateBody:
+		if auth.certificate != nil {
+			logf(logTypeHandshake, "[StateConnected] Unexpected Certificate")
+			return nil, nil, AlertUnexpectedMessage
+		}
+
+		if !bytes.Equal(body.CertificateRequestContext, auth.context) {
+			logf(logTypeHandshake, "[StateConnected] Certificate for unknown request [%x]", body.CertificateRequestContext)
+			return nil, nil, AlertIllegalParameter
+		}
+
+		// A client can decline to authenticate after the handshake, which
+		// only means that the connection stays unauthenticated
+		if len(body.CertificateList) == 0 {
+			logf(logTypeHandshake, "[StateConnected] Client did not provide a certificate")
+		}
+
+		auth.certificate = body
+		auth.handshakeHash.Write(hm.Marshal())
+
+	case *CertificateVerifyBody:
+		if auth.certificate == nil || len(auth.certificate.CertificateList) == 0 || auth.peerCertificates != nil {
+			logf(logTypeHandshake, "[StateConnected] Unexpected CertificateVerify")
+			return nil, nil, AlertUnexpectedMessage
+		}
+
+		hcv := auth.handshakeHash.Sum(nil)
+		clientPublicKey := certificatePublicKey(auth.certificate.CertificateList[0].CertData)
+		if err := body.Verify(clientPublicKey, clientSignatureContext, hcv); err != nil {
+			logf(logTypeHandshake, "[StateConnected] Failure in client auth verification [%v]", err)
+			return nil, nil, AlertHandshakeFailure
+		}
+
+		peerCertificates := make([]*x509.Certificate, len(auth.certificate.CertificateList))
+		for i, entry := range auth.certificate.CertificateList {
+			peerCertificates[i] = entry.CertData
+		}
+
+		if !auth.insecureSkipVerify {
+			verifiedChains, err := verifyCertificateChain(peerCertificates, auth.clientCAs, "", x509.ExtKeyUsageClientAuth)
+			if err != nil {
+				logf(logTypeHandshake, "[StateConnected] Client certificate failed to verify [%v]", err)
+				return nil, nil, verifyFailure(auth.reportVerifyError, peerCertificates, err)
+			}
+			auth.verifiedChains = verifiedChains
+		} else {
+			logf(logTypeHandshake, "[StateConnected] WARNING: No verification of client certificate")
+		}
+
+		if auth.authCertificate != nil {
+			err := auth.authCertificate(auth.certificate.CertificateList)
+			if err != nil {
+				logf(logTypeHandshake, "[StateConnected] Application rejected client certificate")
+				return nil, nil, verifyFailure(auth.reportVerifyError, peerCertificates, err)
+			}
+		}
+
+		auth.peerCertificates = peerCertificates
+		auth.handshakeHash.Write(hm.Marshal())
+
+	case *FinishedBody:
+		if auth.certificate == nil || (len(auth.certificate.CertificateList) > 0 && auth.peerCertificates == nil) {
+			logf(logTypeHandshake, "[StateConnected] Unexpected Finished")
+			return nil, nil, AlertUnexpectedMessage
+		}
+
+		finishedData := computeFinishedData(state.cryptoParams, state.clientTrafficSecret, auth.handshakeHash.Sum(nil))
+		if !bytes.Equal(body.VerifyData, finishedData) {
+			logf(logTypeHandshake, "[StateConnected] Client's Finished failed to verify")
+			return nil, nil, AlertHandshakeFailure
+		}
+
+		if auth.peerCertificates != nil {
+			state.peerCertificates = auth.peerCertificates
+			state.verifiedChains = auth.verifiedChains
+			state.Params.UsingClientAuth = true
+		} else {
+			state.authDeclined = true
+		}
+		state.pendingAuth = nil
+	}
+
+	return state, nil, AlertNoAlert
+}
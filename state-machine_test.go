@@ -13,26 +13,29 @@ var (
 		serverCapabilities  Capabilities
 		clientStateSequence []HandshakeState
 		serverStateSequence []HandshakeState
+		serverAlert         Alert // the handshake is expected to fail
 	}{
 		"normal": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
-				Certificates:     certificates,
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
+				Certificates:      certificates,
 			},
 			clientStateSequence: []HandshakeState{
 				ClientStateStart{},
@@ -52,24 +55,67 @@ var (
 
 		"helloRetryRequest": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
-				Certificates:     certificates,
-				RequireCookie:    true,
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
+				Certificates:      certificates,
+				RequireCookie:     true,
+			},
+			clientStateSequence: []HandshakeState{
+				ClientStateStart{},
+				ClientStateWaitSH{},
+				ClientStateWaitSH{},
+				ClientStateWaitEE{},
+				ClientStateWaitCertCR{},
+				ClientStateWaitCV{},
+				ClientStateWaitFinished{},
+				StateConnected{},
+			},
+			serverStateSequence: []HandshakeState{
+				ServerStateStart{},
+				ServerStateStart{},
+				ServerStateWaitFinished{},
+				StateConnected{},
+			},
+		},
+
+		"helloRetryRequestKeyShare": {
+			clientCapabilities: Capabilities{
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{X25519, P256},
+				KeyShareGroups:    []NamedGroup{X25519},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
+			},
+			clientOptions: ConnectionOptions{
+				ServerName: "example.com",
+				NextProtos: []string{"h2"},
+			},
+			serverCapabilities: Capabilities{
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
+				Certificates:      certificates,
 			},
 			clientStateSequence: []HandshakeState{
 				ClientStateStart{},
@@ -92,10 +138,11 @@ var (
 		// PSK case, no early data
 		"psk": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
 				PSKs: &PSKMapCache{
 					"example.com": psk,
 				},
@@ -105,10 +152,11 @@ var (
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
 				PSKs: &PSKMapCache{
 					"00010203": psk,
 				},
@@ -131,10 +179,11 @@ var (
 		// PSK case, with early data
 		"pskWithEarlyData": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
 				PSKs: &PSKMapCache{
 					"example.com": psk,
 				},
@@ -145,10 +194,11 @@ var (
 				EarlyData:  []byte{0, 1, 2, 3},
 			},
 			serverCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
 				PSKs: &PSKMapCache{
 					"00010203": psk,
 				},
@@ -173,10 +223,11 @@ var (
 		// PSK case, server rejects PSK
 		"pskRejected": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
 				PSKs: &PSKMapCache{
 					"example.com": psk,
 				},
@@ -186,12 +237,13 @@ var (
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
-				Certificates:     certificates,
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
+				Certificates:      certificates,
 			},
 			clientStateSequence: []HandshakeState{
 				ClientStateStart{},
@@ -212,18 +264,20 @@ var (
 		// Client auth, successful
 		"clientAuth": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
-				Certificates:     certificates,
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
+				Certificates:      certificates,
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
+				SupportedVersions: []uint16{supportedVersion},
 				Groups:            []NamedGroup{P256},
 				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
 				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
@@ -251,20 +305,22 @@ var (
 			},
 		},
 
-		// Client auth, no certificate found
+		// Client auth, no certificate found, which the server refuses
 		"clientAuthNoCertificate": {
 			clientCapabilities: Capabilities{
-				Groups:           []NamedGroup{P256},
-				SignatureSchemes: []SignatureScheme{RSA_PSS_SHA256},
-				PSKModes:         []PSKKeyExchangeMode{PSKModeDHEKE},
-				CipherSuites:     []CipherSuite{TLS_AES_128_GCM_SHA256},
-				PSKs:             &PSKMapCache{},
+				SupportedVersions: []uint16{supportedVersion},
+				Groups:            []NamedGroup{P256},
+				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
+				CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+				PSKs:              &PSKMapCache{},
 			},
 			clientOptions: ConnectionOptions{
 				ServerName: "example.com",
 				NextProtos: []string{"h2"},
 			},
 			serverCapabilities: Capabilities{
+				SupportedVersions: []uint16{supportedVersion},
 				Groups:            []NamedGroup{P256},
 				SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
 				PSKModes:          []PSKKeyExchangeMode{PSKModeDHEKE},
@@ -286,9 +342,8 @@ var (
 			serverStateSequence: []HandshakeState{
 				ServerStateStart{},
 				ServerStateWaitCert{},
-				ServerStateWaitFinished{},
-				StateConnected{},
 			},
+			serverAlert: AlertCertificateRequired,
 		},
 	}
 )
@@ -311,12 +366,18 @@ func TestStateMachineIntegration(t *testing.T) {
 	for caseName, params := range stateMachineIntegrationCases {
 		t.Logf("=== Integration Test (%s) ===", caseName)
 
+		// The test certificates are self-signed
+		clientCaps := params.clientCapabilities
+		clientCaps.InsecureSkipVerify = true
+		serverCaps := params.serverCapabilities
+		serverCaps.InsecureSkipVerify = true
+
 		var clientState, serverState HandshakeState
 		clientState = ClientStateStart{
-			Caps: params.clientCapabilities,
+			Caps: clientCaps,
 			Opts: params.clientOptions,
 		}
-		serverState = ServerStateStart{Caps: params.serverCapabilities}
+		serverState = ServerStateStart{Caps: serverCaps}
 		t.Logf("Client: %s", reflect.TypeOf(clientState).Name())
 		t.Logf("Server: %s", reflect.TypeOf(serverState).Name())
 
@@ -331,6 +392,7 @@ func TestStateMachineIntegration(t *testing.T) {
 		clientStateSequence = append(clientStateSequence, clientState)
 		assertEquals(t, len(clientToSend), 1)
 
+	handshake:
 		for {
 			var clientInstr, serverInstr []HandshakeAction
 			var alert Alert
@@ -340,6 +402,15 @@ func TestStateMachineIntegration(t *testing.T) {
 			for _, body := range clientToSend {
 				t.Logf("C->S: %d", body.msgType)
 				serverState, serverInstr, alert = serverState.Next(body)
+				if alert != AlertNoAlert && alert == params.serverAlert {
+					// Test that the server failed in the expected state
+					t.Logf("Server: alert [%v]", alert)
+					assertEquals(t, len(serverStateSequence), len(params.serverStateSequence))
+					for i, state := range serverStateSequence {
+						assertSameType(t, state, params.serverStateSequence[i])
+					}
+					break handshake
+				}
 				serverResponses := messagesFromActions(serverInstr)
 				assert(t, alert == AlertNoAlert, fmt.Sprintf("Alert from server [%v]", alert))
 				serverStateSequence = append(serverStateSequence, serverState)
@@ -397,3 +468,232 @@ func TestStateMachineIntegration(t *testing.T) {
 		}
 	}
 }
+
+func TestClientDowngradeProtection(t *testing.T) {
+	caps := Capabilities{
+		SupportedVersions: []uint16{supportedVersion},
+		Groups:            []NamedGroup{P256},
+		SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+		CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:              &PSKMapCache{},
+	}
+	opts := ConnectionOptions{ServerName: "example.com"}
+
+	clientState, _, alert := ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+
+	serverHello := func(version uint16, sentinel []byte, exts ...ExtensionBody) *HandshakeMessage {
+		sh := &ServerHelloBody{
+			Version:     version,
+			CipherSuite: TLS_AES_128_GCM_SHA256,
+		}
+		copy(sh.Random[len(sh.Random)-len(sentinel):], sentinel)
+		for _, ext := range exts {
+			sh.Extensions.Add(ext)
+		}
+		hm, err := HandshakeMessageFromBody(sh)
+		assertNotError(t, err, "Failed to marshal ServerHello")
+		return hm
+	}
+
+	// A TLS 1.2 ServerHello is refused
+	_, _, alert = clientState.Next(serverHello(tls12Version, nil))
+	assertEquals(t, alert, AlertProtocolVersion)
+
+	// ... and is detected as a downgrade if it carries a sentinel
+	_, _, alert = clientState.Next(serverHello(tls12Version, downgradeSentinelTLS12))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	_, _, alert = clientState.Next(serverHello(0x0302, downgradeSentinelTLS11))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// A server may not select a version the client did not offer
+	sv := &SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeServerHello,
+		Versions:      []uint16{maxDraftVersion},
+	}
+	_, _, alert = clientState.Next(serverHello(tls12Version, nil, sv))
+	assertEquals(t, alert, AlertIllegalParameter)
+}
+
+func TestClientHelloRetryRequest(t *testing.T) {
+	caps := Capabilities{
+		SupportedVersions: []uint16{supportedVersion},
+		Groups:            []NamedGroup{X25519, P256, P384},
+		KeyShareGroups:    []NamedGroup{X25519},
+		SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+		CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:              &PSKMapCache{},
+	}
+	opts := ConnectionOptions{ServerName: "example.com"}
+
+	clientState, _, alert := ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+
+	helloRetryRequest := func(exts ...ExtensionBody) *HandshakeMessage {
+		hrr := &HelloRetryRequestBody{
+			Version:     tls12Version,
+			CipherSuite: TLS_AES_128_GCM_SHA256,
+		}
+		hrr.Extensions.Add(&SupportedVersionsExtension{
+			HandshakeType: HandshakeTypeHelloRetryRequest,
+			Versions:      []uint16{supportedVersion},
+		})
+		for _, ext := range exts {
+			hrr.Extensions.Add(ext)
+		}
+		hm, err := HandshakeMessageFromBody(hrr)
+		assertNotError(t, err, "Failed to marshal HelloRetryRequest")
+		return hm
+	}
+	keyShare := func(group NamedGroup) *KeyShareExtension {
+		return &KeyShareExtension{
+			HandshakeType: HandshakeTypeHelloRetryRequest,
+			SelectedGroup: group,
+		}
+	}
+
+	// The client sends a new ClientHello with only the requested share
+	nextState, actions, alert := clientState.Next(helloRetryRequest(keyShare(P256)))
+	assertEquals(t, alert, AlertNoAlert)
+	assertSameType(t, nextState, ClientStateWaitSH{})
+	assertEquals(t, len(nextState.(ClientStateWaitSH).OfferedDH), 1)
+	_, offeredP256 := nextState.(ClientStateWaitSH).OfferedDH[P256]
+	assert(t, offeredP256, "Did not offer a key share for the requested group")
+
+	msgs := messagesFromActions(actions)
+	assertEquals(t, len(msgs), 1)
+	ch := &ClientHelloBody{}
+	_, err := ch.Unmarshal(msgs[0].body)
+	assertNotError(t, err, "Failed to unmarshal second ClientHello")
+	clientKeyShares := &KeyShareExtension{HandshakeType: HandshakeTypeClientHello}
+	assert(t, ch.Extensions.Find(clientKeyShares), "No key_share in second ClientHello")
+	assertEquals(t, len(clientKeyShares.Shares), 1)
+	assertEquals(t, clientKeyShares.Shares[0].Group, P256)
+
+	// A group we already sent a share for is refused
+	_, _, alert = clientState.Next(helloRetryRequest(keyShare(X25519)))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// ... as is a group we don't support
+	_, _, alert = clientState.Next(helloRetryRequest(keyShare(P521)))
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// ... and an HRR that wouldn't change anything
+	_, _, alert = clientState.Next(helloRetryRequest())
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// Extensions other than cookie and key_share are not allowed
+	alpn := &ALPNExtension{Protocols: []string{"h2"}}
+	_, _, alert = clientState.Next(helloRetryRequest(keyShare(P256), alpn))
+	assertEquals(t, alert, AlertUnsupportedExtension)
+}
+
+func TestClientHelloRetryRequestRepeatsClientHello(t *testing.T) {
+	caps := Capabilities{
+		SupportedVersions: []uint16{supportedVersion},
+		Groups:            []NamedGroup{X25519, P256},
+		KeyShareGroups:    []NamedGroup{X25519},
+		SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+		CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256, TLS_CHACHA20_POLY1305_SHA256},
+		PSKs:              &PSKMapCache{},
+	}
+	opts := ConnectionOptions{ServerName: "example.com", NextProtos: []string{"h2"}}
+
+	clientState, actions, alert := ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+	ch1 := &ClientHelloBody{}
+	_, err := ch1.Unmarshal(messagesFromActions(actions)[0].body)
+	assertNotError(t, err, "Failed to unmarshal first ClientHello")
+
+	hrr := &HelloRetryRequestBody{
+		Version:     tls12Version,
+		CipherSuite: TLS_CHACHA20_POLY1305_SHA256,
+	}
+	hrr.Extensions.Add(&SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeHelloRetryRequest,
+		Versions:      []uint16{supportedVersion},
+	})
+	hrr.Extensions.Add(&KeyShareExtension{
+		HandshakeType: HandshakeTypeHelloRetryRequest,
+		SelectedGroup: P256,
+	})
+	hrr.Extensions.Add(&CookieExtension{Cookie: []byte{0, 1, 2, 3}})
+	hrrMessage, err := HandshakeMessageFromBody(hrr)
+	assertNotError(t, err, "Failed to marshal HelloRetryRequest")
+
+	_, actions, alert = clientState.Next(hrrMessage)
+	assertEquals(t, alert, AlertNoAlert)
+	ch2 := &ClientHelloBody{}
+	_, err = ch2.Unmarshal(messagesFromActions(actions)[0].body)
+	assertNotError(t, err, "Failed to unmarshal second ClientHello")
+
+	// Only key_share and cookie change
+	assertByteEquals(t, ch2.Random[:], ch1.Random[:])
+	assertDeepEquals(t, ch2.CipherSuites, ch1.CipherSuites)
+	assertByteEquals(t, ch2.LegacySessionID, ch1.LegacySessionID)
+
+	changed := map[ExtensionType]bool{
+		ExtensionTypeKeyShare: true,
+		ExtensionTypeCookie:   true,
+	}
+	unchanged := func(exts ExtensionList) ExtensionList {
+		list := ExtensionList{}
+		for _, ext := range exts {
+			if !changed[ext.ExtensionType] {
+				list = append(list, ext)
+			}
+		}
+		return list
+	}
+	assertDeepEquals(t, unchanged(ch2.Extensions), unchanged(ch1.Extensions))
+	assert(t, ch2.Extensions.Find(&CookieExtension{}), "No cookie in second ClientHello")
+}
+
+func TestServerHelloRetryRequestKeyShare(t *testing.T) {
+	clientCaps := Capabilities{
+		SupportedVersions: []uint16{supportedVersion},
+		Groups:            []NamedGroup{X25519, P256},
+		KeyShareGroups:    []NamedGroup{X25519},
+		SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+		CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:              &PSKMapCache{},
+	}
+	serverCaps := Capabilities{
+		SupportedVersions: []uint16{supportedVersion},
+		Groups:            []NamedGroup{P384, P256},
+		SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+		CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:              &PSKMapCache{},
+		Certificates:      certificates,
+	}
+	opts := ConnectionOptions{ServerName: "example.com"}
+
+	_, actions, alert := ClientStateStart{Caps: clientCaps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+	clientHello := messagesFromActions(actions)[0]
+
+	// The server asks for a share in the first group that both sides support
+	serverState, actions, alert := ServerStateStart{Caps: serverCaps}.Next(clientHello)
+	assertEquals(t, alert, AlertNoAlert)
+	assertSameType(t, serverState, ServerStateStart{})
+
+	msgs := messagesFromActions(actions)
+	assertEquals(t, len(msgs), 1)
+	assert(t, isHelloRetryRequest(msgs[0].body), "Server did not send a HelloRetryRequest")
+	hrr := &HelloRetryRequestBody{}
+	_, err := hrr.Unmarshal(msgs[0].body)
+	assertNotError(t, err, "Failed to unmarshal HelloRetryRequest")
+	serverKeyShare := &KeyShareExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+	assert(t, hrr.Extensions.Find(serverKeyShare), "No key_share in HelloRetryRequest")
+	assertEquals(t, serverKeyShare.SelectedGroup, P256)
+
+	// A second ClientHello without a share for that group is refused
+	_, _, alert = serverState.Next(clientHello)
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// No HelloRetryRequest is sent if there are no groups in common
+	serverCaps.Groups = []NamedGroup{P521}
+	_, _, alert = ServerStateStart{Caps: serverCaps}.Next(clientHello)
+	assertEquals(t, alert, AlertHandshakeFailure)
+}
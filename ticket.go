@@ -0,0 +1,178 @@
+package mint
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Session tickets that carry their own resumption state, so that a server
+// does not need to remember the tickets it has issued.  A ticket is sealed
+// with AES-256-GCM under a ticket key:
+//
+//   key_name (16) || nonce (12) || AES-GCM(ticketState)
+//
+// The key name is derived from the key and is used to find the key again
+// when the ticket comes back.
+
+const (
+	ticketKeyNameLen = 16
+	ticketNonceSize  = 12
+)
+
+// struct {
+//     CipherSuite cipher_suite;
+//     opaque key<1..255>;
+//     opaque next_proto<0..255>;
+//     uint64 received_at;    /* milliseconds since the epoch */
+//     uint64 expires_at;     /* milliseconds since the epoch */
+//     uint32 ticket_age_add;
+//     uint32 max_early_data_size;
+// } TicketState;
+type ticketState struct {
+	CipherSuite      CipherSuite
+	Key              []byte `tls:"head=1,min=1"`
+	NextProto        []byte `tls:"head=1"`
+	ReceivedAt       uint64
+	ExpiresAt        uint64
+	TicketAgeAdd     uint32
+	MaxEarlyDataSize uint32
+}
+
+func ticketKeyName(key [32]byte) []byte {
+	h := sha256.Sum256(append([]byte("mint ticket key name"), key[:]...))
+	return h[:ticketKeyNameLen]
+}
+
+func ticketAEAD(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func unixMillis(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func fromUnixMillis(ms uint64) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// sealTicket encrypts the resumption state of a PSK under the first of the
+// ticket keys.  The result is used as the PSK identity.
+func sealTicket(keys [][32]byte, psk PreSharedKey) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("tls.ticket: No ticket keys")
+	}
+
+	state := ticketState{
+		CipherSuite:  psk.CipherSuite,
+		Key:          psk.Key,
+		NextProto:    []byte(psk.NextProto),
+		ReceivedAt:   unixMillis(psk.ReceivedAt),
+		ExpiresAt:    unixMillis(psk.ExpiresAt),
+		TicketAgeAdd: psk.TicketAgeAdd,
+
+		MaxEarlyDataSize: psk.MaxEarlyDataSize,
+	}
+	plaintext, err := syntax.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := ticketAEAD(keys[0])
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, ticketKeyNameLen+ticketNonceSize)
+	copy(header, ticketKeyName(keys[0]))
+	_, err = prng.Read(header[ticketKeyNameLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := header[ticketKeyNameLen:]
+	return aead.Seal(header, nonce, plaintext, header[:ticketKeyNameLen]), nil
+}
+
+// openTicket decrypts a ticket sealed under any of the ticket keys, returning
+// the PSK it carries.  Expired tickets are rejected.
+func openTicket(keys [][32]byte, ticket []byte) (PreSharedKey, bool) {
+	if len(ticket) < ticketKeyNameLen+ticketNonceSize {
+		return PreSharedKey{}, false
+	}
+
+	name := ticket[:ticketKeyNameLen]
+	nonce := ticket[ticketKeyNameLen : ticketKeyNameLen+ticketNonceSize]
+	ciphertext := ticket[ticketKeyNameLen+ticketNonceSize:]
+
+	for _, key := range keys {
+		if !bytes.Equal(ticketKeyName(key), name) {
+			continue
+		}
+
+		aead, err := ticketAEAD(key)
+		if err != nil {
+			return PreSharedKey{}, false
+		}
+
+		plaintext, err := aead.Open(nil, nonce, ciphertext, name)
+		if err != nil {
+			logf(logTypeNegotiation, "Failed to decrypt ticket: %v", err)
+			return PreSharedKey{}, false
+		}
+
+		var state ticketState
+		read, err := syntax.Unmarshal(plaintext, &state)
+		if err != nil || read != len(plaintext) {
+			logf(logTypeNegotiation, "Failed to decode ticket state: %v", err)
+			return PreSharedKey{}, false
+		}
+
+		psk := PreSharedKey{
+			CipherSuite:  state.CipherSuite,
+			IsResumption: true,
+			Identity:     ticket,
+			Key:          state.Key,
+			NextProto:    string(state.NextProto),
+			ReceivedAt:   fromUnixMillis(state.ReceivedAt),
+			ExpiresAt:    fromUnixMillis(state.ExpiresAt),
+			TicketAgeAdd: state.TicketAgeAdd,
+
+			MaxEarlyDataSize: state.MaxEarlyDataSize,
+		}
+		if time.Now().After(psk.ExpiresAt) {
+			logf(logTypeNegotiation, "Ticket expired at %v", psk.ExpiresAt)
+			return PreSharedKey{}, false
+		}
+		return psk, true
+	}
+
+	return PreSharedKey{}, false
+}
+
+// ticketPSKCache finds PSKs in tickets sealed under the ticket keys, and
+// otherwise in an ordinary PSK cache, e.g., for external PSKs.
+type ticketPSKCache struct {
+	PreSharedKeyCache
+	keys [][32]byte
+}
+
+func (cache ticketPSKCache) Get(key string) (PreSharedKey, bool) {
+	identity, err := hex.DecodeString(key)
+	if err == nil {
+		if psk, ok := openTicket(cache.keys, identity); ok {
+			return psk, true
+		}
+	}
+	return cache.PreSharedKeyCache.Get(key)
+}
@@ -0,0 +1,123 @@
+package mint
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+var (
+	ticketKey1 = [32]byte{1, 2, 3, 4}
+	ticketKey2 = [32]byte{5, 6, 7, 8}
+)
+
+func TestTicketSealOpen(t *testing.T) {
+	psk := PreSharedKey{
+		CipherSuite:  TLS_AES_128_GCM_SHA256,
+		IsResumption: true,
+		Key:          []byte{0, 1, 2, 3},
+		NextProto:    "h2",
+		ReceivedAt:   time.Now(),
+		ExpiresAt:    time.Now().Add(time.Hour),
+		TicketAgeAdd: 0x01020304,
+	}
+
+	// Test successful seal and open
+	ticket, err := sealTicket([][32]byte{ticketKey1}, psk)
+	assertNotError(t, err, "Failed to seal ticket")
+
+	opened, ok := openTicket([][32]byte{ticketKey1}, ticket)
+	assert(t, ok, "Failed to open ticket")
+	assertEquals(t, opened.CipherSuite, psk.CipherSuite)
+	assert(t, opened.IsResumption, "Ticket PSK is not for resumption")
+	assertByteEquals(t, opened.Identity, ticket)
+	assertByteEquals(t, opened.Key, psk.Key)
+	assertEquals(t, opened.NextProto, psk.NextProto)
+	assertEquals(t, opened.TicketAgeAdd, psk.TicketAgeAdd)
+	assertEquals(t, opened.ReceivedAt.UnixNano()/int64(time.Millisecond), psk.ReceivedAt.UnixNano()/int64(time.Millisecond))
+
+	// Test that tickets can be opened after key rotation
+	_, ok = openTicket([][32]byte{ticketKey2, ticketKey1}, ticket)
+	assert(t, ok, "Failed to open ticket after rotation")
+
+	// Test that the ticket cache finds tickets and falls back to its cache
+	cache := ticketPSKCache{
+		PreSharedKeyCache: &PSKMapCache{"00010203": psk},
+		keys:              [][32]byte{ticketKey1},
+	}
+	_, ok = cache.Get(hex.EncodeToString(ticket))
+	assert(t, ok, "Ticket cache did not find ticket")
+	_, ok = cache.Get("00010203")
+	assert(t, ok, "Ticket cache did not find cached PSK")
+
+	// Test failure on an unknown key
+	_, ok = openTicket([][32]byte{ticketKey2}, ticket)
+	assert(t, !ok, "Opened ticket with the wrong key")
+
+	// Test failure on a modified ticket
+	ticket[len(ticket)-1] ^= 0xff
+	_, ok = openTicket([][32]byte{ticketKey1}, ticket)
+	assert(t, !ok, "Opened modified ticket")
+
+	// Test failure on a truncated ticket
+	_, ok = openTicket([][32]byte{ticketKey1}, ticket[:ticketKeyNameLen])
+	assert(t, !ok, "Opened truncated ticket")
+
+	// Test failure on an expired ticket
+	psk.ExpiresAt = time.Now().Add(-time.Second)
+	ticket, err = sealTicket([][32]byte{ticketKey1}, psk)
+	assertNotError(t, err, "Failed to seal ticket")
+	_, ok = openTicket([][32]byte{ticketKey1}, ticket)
+	assert(t, !ok, "Opened expired ticket")
+
+	// Test failure without keys
+	_, err = sealTicket(nil, psk)
+	assertError(t, err, "Sealed ticket without keys")
+}
+
+func TestStatelessResumption(t *testing.T) {
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}
+	newServerConfig := func(keys ...[32]byte) *Config {
+		return &Config{
+			Certificates:       certificates,
+			SendSessionTickets: true,
+			TicketLifetime:     3600,
+			SessionTicketKeys:  keys,
+		}
+	}
+
+	// Get a ticket from one server, which stores nothing
+	serverConfig1 := newServerConfig(ticketKey1)
+	client := NewEngine(clientConfig, true)
+	server := NewEngine(serverConfig1, false)
+	clientErr, serverErr := runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+
+	_, err := client.Read(make([]byte, 1))
+	assertEquals(t, err, WouldBlock)
+	assertEquals(t, clientConfig.PSKs.Size(), 1)
+	assertEquals(t, serverConfig1.PSKs.Size(), 0)
+
+	// Resume with another server, which has rotated in a new key
+	serverConfig2 := newServerConfig(ticketKey2, ticketKey1)
+	client = NewEngine(clientConfig, true)
+	server = NewEngine(serverConfig2, false)
+	clientErr, serverErr = runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, client.State().DidResume, "Client did not report resumption")
+	assert(t, server.State().DidResume, "Server did not report resumption")
+	assertByteEquals(t, client.state.resumptionSecret, server.state.resumptionSecret)
+
+	// A server without the key does a full handshake
+	client = NewEngine(clientConfig, true)
+	server = NewEngine(newServerConfig(ticketKey2), false)
+	clientErr, serverErr = runEngines(client, server)
+	assertNotError(t, clientErr, "Client handshake failed")
+	assertNotError(t, serverErr, "Server handshake failed")
+	assert(t, !server.State().DidResume, "Server resumed without the ticket key")
+}
@@ -3,9 +3,11 @@ package mint
 // XXX(rlb): This file is borrowed pretty much wholesale from crypto/tls
 
 import (
+	"context"
 	"errors"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,27 +28,119 @@ func Client(conn net.Conn, config *Config) *Conn {
 }
 
 // A listener implements a network listener (net.Listener) for TLS connections.
+//
+// Unless config.DeferHandshake is set, handshakes are run in the background on
+// a bounded pool of goroutines, so that a slow client cannot hold up the
+// connections behind it.  Accept only returns connections that have completed
+// the handshake.
 type Listener struct {
 	net.Listener
 	config *Config
+
+	start sync.Once
+	ready chan *Conn    // Connections that have completed the handshake
+	done  chan struct{} // Closed when the inner listener fails for good
+	err   error         // The error that caused done to be closed
 }
 
 // Accept waits for and returns the next incoming TLS connection.
 // The returned connection c is a *tls.Conn.
 func (l *Listener) Accept() (c net.Conn, err error) {
-	c, err = l.Listener.Accept()
-	if err != nil {
+	if l.config.DeferHandshake {
+		c, err = l.Listener.Accept()
+		if err != nil {
+			return
+		}
+		c = Server(c, l.config)
 		return
 	}
+
+	l.start.Do(func() {
+		go l.acceptLoop()
+	})
+
+	select {
+	case server := <-l.ready:
+		return server, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// acceptLoop accepts raw connections from the inner listener and hands each
+// one to a handshake goroutine.  At most MaxConcurrentHandshakes handshakes are
+// in progress at any time; beyond that, new connections wait in the inner
+// listener's backlog.  Temporary errors from the inner listener, such as
+// running out of file descriptors, are retried with backoff, as in
+// net/http.Server.
+func (l *Listener) acceptLoop() {
+	maxHandshakes := l.config.MaxConcurrentHandshakes
+	if maxHandshakes <= 0 {
+		maxHandshakes = defaultMaxConcurrentHandshakes
+	}
+	slots := make(chan struct{}, maxHandshakes)
+
+	var delay time.Duration
+	for {
+		slots <- struct{}{}
+		c, err := l.Listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			<-slots
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			logf(logTypeHandshake, "[listener] Accept failed: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		delay = 0
+
+		go func() {
+			defer func() { <-slots }()
+			l.handshake(c)
+		}()
+	}
+}
+
+func (l *Listener) handshake(c net.Conn) {
+	timeout := l.config.HandshakeTimeout
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+
 	server := Server(c, l.config)
-	err = server.Handshake()
-	if err == AlertNoAlert {
-		err = nil
+	if err := server.Handshake(); err != nil {
+		logf(logTypeHandshake, "[listener] Handshake with %v failed: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	if timeout > 0 {
+		c.SetDeadline(time.Time{})
+	}
+
+	select {
+	case l.ready <- server:
+	case <-l.done:
+		server.Close()
 	}
-	c = server
-	return
 }
 
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
 // NewListener creates a Listener which accepts connections from an inner
 // Listener and wraps each connection with Server.
 // The configuration config must be non-nil and must include
@@ -55,6 +149,8 @@ func NewListener(inner net.Listener, config *Config) net.Listener {
 	l := new(Listener)
 	l.Listener = inner
 	l.config = config
+	l.ready = make(chan *Conn)
+	l.done = make(chan struct{})
 	return l
 }
 
@@ -87,6 +183,17 @@ func (TimeoutError) Temporary() bool { return true }
 // DialWithDialer interprets a nil configuration as equivalent to the zero
 // configuration; see the documentation of Config for the defaults.
 func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
+	return dial(context.Background(), dialer, network, addr, config)
+}
+
+// DialContext connects to the given network address and initiates a TLS
+// handshake, like Dial.  If ctx is done before the handshake completes, the
+// connection is abandoned and the context's error is returned.
+func DialContext(ctx context.Context, network, addr string, config *Config) (*Conn, error) {
+	return dial(ctx, new(net.Dialer), network, addr, config)
+}
+
+func dial(ctx context.Context, dialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
 	// We want the Timeout and Deadline values from dialer to cover the
 	// whole process: TCP connection and TLS handshake. This means that we
 	// also need to start our own timers now.
@@ -99,16 +206,13 @@ func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*
 		}
 	}
 
-	var errChannel chan error
-
 	if timeout != 0 {
-		errChannel = make(chan error, 2)
-		time.AfterFunc(timeout, func() {
-			errChannel <- TimeoutError{}
-		})
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	rawConn, err := dialer.Dial(network, addr)
+	rawConn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -132,25 +236,12 @@ func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*
 	}
 
 	conn := Client(rawConn, config)
-
-	if timeout == 0 {
-		err = conn.Handshake()
-		if err == AlertNoAlert {
-			err = nil
-		}
-	} else {
-		go func() {
-			errChannel <- conn.Handshake()
-		}()
-
-		err = <-errChannel
-		if err == AlertNoAlert {
-			err = nil
-		}
-	}
-
+	err = conn.HandshakeContext(ctx)
 	if err != nil {
 		rawConn.Close()
+		if err == context.DeadlineExceeded && timeout != 0 {
+			return nil, TimeoutError{}
+		}
 		return nil, err
 	}
 
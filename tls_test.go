@@ -1,9 +1,13 @@
 package mint
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -55,6 +59,154 @@ func TestDialTimeout(t *testing.T) {
 	}
 }
 
+func TestDialContextCancel(t *testing.T) {
+	listener := newLocalListener(t)
+	defer listener.Close()
+
+	complete := make(chan bool)
+	defer close(complete)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		<-complete
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := DialContext(ctx, "tcp", listener.Addr().String(), nil)
+	assertEquals(t, err, context.DeadlineExceeded)
+}
+
+func TestHandshakeContextCancel(t *testing.T) {
+	listener := newLocalListener(t)
+	defer listener.Close()
+
+	// The server reads the ClientHello and anything after it, but never
+	// responds.  The handshake is canceled once the ClientHello has arrived.
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan []byte, 1)
+	go func() {
+		defer cancel()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		header := make([]byte, 5)
+		_, err = io.ReadFull(conn, header)
+		if err == nil {
+			_, err = io.ReadFull(conn, make([]byte, int(header[3])<<8|int(header[4])))
+		}
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+
+		cancel()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	rawConn, err := net.Dial("tcp", listener.Addr().String())
+	assertNotError(t, err, "Failed to connect")
+	client := Client(rawConn, &Config{ServerName: serverName, InsecureSkipVerify: true})
+
+	err = client.HandshakeContext(ctx)
+	assertEquals(t, err, context.Canceled)
+
+	// After the ClientHello, the server sees a user_canceled alert and then
+	// close_notify
+	data := <-received
+	assertByteEquals(t, data, []byte{
+		byte(RecordTypeAlert), 0x03, 0x03, 0x00, 0x02, byte(AlertLevelWarning), byte(AlertUserCanceled),
+		byte(RecordTypeAlert), 0x03, 0x03, 0x00, 0x02, byte(AlertLevelWarning), byte(AlertCloseNotify),
+	})
+
+	// A context that is already done stops the handshake before it starts
+	client = Client(rawConn, &Config{ServerName: serverName, InsecureSkipVerify: true})
+	assertEquals(t, client.HandshakeContext(ctx), context.Canceled)
+}
+
+// deadlineConn records the deadlines set on a pipe without applying them.  On
+// its second write, it cancels a context and waits for the deadline that
+// interrupts the handshake, so that the handshake finishes just after it has
+// been interrupted.
+type deadlineConn struct {
+	*pipeConn
+	cancel      context.CancelFunc
+	writes      int
+	interrupted chan struct{}
+
+	mutex         sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (d *deadlineConn) Write(data []byte) (int, error) {
+	d.writes++
+	if d.writes == 2 {
+		d.cancel()
+		<-d.interrupted
+	}
+	return d.pipeConn.Write(data)
+}
+
+func (d *deadlineConn) SetDeadline(t time.Time) error {
+	if !t.IsZero() && t.Before(time.Now()) {
+		close(d.interrupted)
+	}
+	d.SetReadDeadline(t)
+	return d.SetWriteDeadline(t)
+}
+
+func (d *deadlineConn) SetReadDeadline(t time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.readDeadline = t
+	return nil
+}
+
+func (d *deadlineConn) SetWriteDeadline(t time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.writeDeadline = t
+	return nil
+}
+
+func TestHandshakeContextKeepsDeadline(t *testing.T) {
+	cConn, sConn := pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &deadlineConn{pipeConn: cConn, cancel: cancel, interrupted: make(chan struct{})}
+
+	done := make(chan error)
+	go func() {
+		done <- Server(sConn, &Config{Certificates: certificates}).Handshake()
+	}()
+
+	// The handshake completes even though it was interrupted, and the
+	// deadline set before it is put back
+	deadline := time.Now().Add(time.Hour)
+	client := Client(conn, &Config{ServerName: serverName, InsecureSkipVerify: true})
+	client.SetDeadline(deadline)
+	assertNotError(t, client.HandshakeContext(ctx), "Client handshake failed")
+	assertNotError(t, <-done, "Server handshake failed")
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	assert(t, conn.readDeadline.Equal(deadline), "Read deadline was not restored")
+	assert(t, conn.writeDeadline.Equal(deadline), "Write deadline was not restored")
+}
+
 // tests that Conn.Read returns (non-zero, io.EOF) instead of
 // (non-zero, nil) when a Close (alertCloseNotify) is sitting right
 // behind the application data in the buffer.
@@ -92,15 +244,15 @@ func testConnReadNonzeroAndEOF(t *testing.T, delay time.Duration) error {
 		}
 		serverConfig := Config{ServerName: "example.com"}
 		srv := Server(sconn, &serverConfig)
-		if alert := srv.Handshake(); alert != AlertNoAlert {
-			serr = fmt.Errorf("handshake: %v", alert)
+		if err := srv.Handshake(); err != nil {
+			serr = fmt.Errorf("handshake: %v", err)
 			srvCh <- nil
 			return
 		}
 		srvCh <- srv
 	}()
 
-	clientConfig := Config{ServerName: "example.com"}
+	clientConfig := Config{ServerName: "example.com", InsecureSkipVerify: true}
 	conn, err := Dial("tcp", ln.Addr().String(), &clientConfig)
 	if err != nil {
 		t.Fatal(err)
@@ -176,15 +328,15 @@ func TestExchangeData(t *testing.T) {
 		}
 		serverConfig := Config{ServerName: "example.com"}
 		srv := Server(sconn, &serverConfig)
-		if alert := srv.Handshake(); alert != AlertNoAlert {
-			serr = fmt.Errorf("handshake: %v", alert)
+		if err := srv.Handshake(); err != nil {
+			serr = fmt.Errorf("handshake: %v", err)
 			srvCh <- nil
 			return
 		}
 		srvCh <- srv
 	}()
 
-	clientConfig := Config{ServerName: "example.com"}
+	clientConfig := Config{ServerName: "example.com", InsecureSkipVerify: true}
 	conn, err := Dial("tcp", ln.Addr().String(), &clientConfig)
 	if err != nil {
 		t.Fatal(err)
@@ -192,7 +344,7 @@ func TestExchangeData(t *testing.T) {
 	defer conn.Close()
 
 	srv := <-srvCh
-	assertNotNil(t, srv, "Server should have completed handshake")
+	assertNotNil(t, srv, fmt.Sprintf("Server should have completed handshake: %v", serr))
 
 	buf := make([]byte, 16)
 	buf = buf[0:6]
@@ -223,3 +375,158 @@ func TestExchangeData(t *testing.T) {
 
 	return
 }
+
+func TestListenerSlowClient(t *testing.T) {
+	serverConfig := &Config{
+		ServerName:              "example.com",
+		HandshakeTimeout:        500 * time.Millisecond,
+		MaxConcurrentHandshakes: 2,
+	}
+	ln := NewListener(newLocalListener(t), serverConfig)
+	defer ln.Close()
+
+	// A client that connects but never sends a ClientHello
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	assertNotError(t, err, "Failed to open stalled connection")
+	defer stalled.Close()
+
+	srvCh := make(chan net.Conn, 1)
+	go func() {
+		sconn, err := ln.Accept()
+		if err != nil {
+			srvCh <- nil
+			return
+		}
+		srvCh <- sconn
+	}()
+
+	clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true}
+	conn, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Dial failed behind a stalled client")
+	defer conn.Close()
+
+	select {
+	case sconn := <-srvCh:
+		assertNotNil(t, sconn, "Accept failed")
+		_, ok := sconn.(*Conn)
+		assert(t, ok, "Accept should return a *Conn")
+		sconn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Accept blocked behind a stalled client")
+	}
+}
+
+func TestListenerHandshakeTimeout(t *testing.T) {
+	serverConfig := &Config{
+		ServerName:              "example.com",
+		HandshakeTimeout:        100 * time.Millisecond,
+		MaxConcurrentHandshakes: 1,
+	}
+	ln := NewListener(newLocalListener(t), serverConfig)
+	defer ln.Close()
+
+	// With only one handshake slot, the stalled client has to time out before
+	// the real client can be served.
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	assertNotError(t, err, "Failed to open stalled connection")
+	defer stalled.Close()
+
+	srvCh := make(chan net.Conn, 1)
+	go func() {
+		sconn, _ := ln.Accept()
+		srvCh <- sconn
+	}()
+
+	clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true}
+	conn, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Dial failed after stalled client timed out")
+	defer conn.Close()
+
+	sconn := <-srvCh
+	assertNotNil(t, sconn, "Accept failed")
+	sconn.Close()
+}
+
+// temporaryError is a net.Error that a listener should retry after
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first Accept with a temporary error
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	if !f.failed {
+		f.failed = true
+		return nil, temporaryError{}
+	}
+	return f.Listener.Accept()
+}
+
+func TestListenerTemporaryError(t *testing.T) {
+	serverConfig := &Config{ServerName: "example.com"}
+	inner := &flakyListener{Listener: newLocalListener(t)}
+	ln := NewListener(inner, serverConfig)
+	defer ln.Close()
+
+	srvCh := make(chan error, 1)
+	go func() {
+		sconn, err := ln.Accept()
+		if err == nil {
+			sconn.Close()
+		}
+		srvCh <- err
+	}()
+
+	clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true}
+	conn, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Dial failed after a temporary error")
+	defer conn.Close()
+
+	assertNotError(t, <-srvCh, "Accept failed after a temporary error")
+	assert(t, inner.failed, "Inner listener did not fail")
+
+	// Errors after the listener is closed are permanent
+	ln.Close()
+	_, err = ln.Accept()
+	assertError(t, err, "Accept succeeded after Close")
+}
+
+func TestListenerDeferHandshake(t *testing.T) {
+	serverConfig := &Config{
+		ServerName:     "example.com",
+		DeferHandshake: true,
+	}
+	ln := NewListener(newLocalListener(t), serverConfig)
+	defer ln.Close()
+
+	srvCh := make(chan error, 1)
+	go func() {
+		sconn, err := ln.Accept()
+		if err != nil {
+			srvCh <- err
+			return
+		}
+		defer sconn.Close()
+
+		// The handshake happens on the first Write
+		_, err = sconn.Write([]byte("hello"))
+		srvCh <- err
+	}()
+
+	clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true}
+	conn, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	assertNotError(t, err, "Dial failed")
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	n, err := conn.Read(buf)
+	assertNotError(t, err, "Read failed")
+	assertEquals(t, string(buf[:n]), "hello")
+	assertNotError(t, <-srvCh, "Server write failed")
+}
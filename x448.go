@@ -0,0 +1,22 @@
+package mint
+
+import (
+	circlx448 "github.com/cloudflare/circl/dh/x448"
+)
+
+// X448 key agreement, as specified in RFC 7748, Section 5, using circl's
+// constant-time implementation.
+
+const x448KeySize = circlx448.Size
+
+var x448BasePoint = append([]byte{5}, make([]byte, x448KeySize-1)...)
+
+// x448 returns the X448 function of scalar and u.  It returns false if the
+// result is all zeros, i.e. if u is a point of small order.
+func x448(scalar, u []byte) ([]byte, bool) {
+	var secret, public, shared circlx448.Key
+	copy(secret[:], scalar)
+	copy(public[:], u)
+	ok := circlx448.Shared(&shared, &secret, &public)
+	return shared[:], ok
+}
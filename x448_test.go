@@ -0,0 +1,80 @@
+package mint
+
+import (
+	"testing"
+)
+
+func TestX448(t *testing.T) {
+	// Test vector from RFC 7748, Section 5.2
+	scalar := unhex("3d262fddf9ec8e88495266fea19a34d28882acef045104d0d1aae121700a779c984c24f8cdd78fbff44943eba368f54b29259a4f1c600ad3")
+	u := unhex("06fce640fa3487bfda5f6cf2d5263f8aad88334cbd07437f020f08f9814dc031ddbdc38c19c6da2583fa5429db94ada18aa7a7fb4ef8a086")
+	out := unhex("ce3e4ff95a60dc6697da1db1d85e6afbdf79b50a2412d7546d5f239fe14fbaadeb445fc66a01b0779d98223961111e21766282f73dd96b6f")
+	result, ok := x448(scalar, u)
+	assert(t, ok, "X448 returned an all-zero result")
+	assertByteEquals(t, result, out)
+
+	// Diffie-Hellman test vector from RFC 7748, Section 6.2
+	alicePriv := unhex("9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf574a9419744897391006382a6f127ab1d9ac2d8c0a598726b")
+	alicePub := unhex("9b08f7cc31b7e3e67d22d5aea121074a273bd2b83de09c63faa73d2c22c5d9bbc836647241d953d40c5b12da88120d53177f80e532c41fa0")
+	bobPriv := unhex("1c306a7ac2a0e2e0990b294470cba339e6453772b075811d8fad0d1d6927c120bb5ee8972b0d3e21374c9c921b09d1b0366f10b65173992d")
+	bobPub := unhex("3eb7a829b0cd20f5bcfc0b599b6feccf6da4627107bdb0d4f345b43027d8b972fc3e34fb4232a13ca706dcb57aec3dae07bdc1c67bf33609")
+	shared := unhex("07fff4181ac6cc95ec1c16a94a0f74d12da232ce40a77552281d282bb60c0b56fd2464c335543936521c24403085d59a449a5037514a879d")
+
+	result, _ = x448(alicePriv, x448BasePoint)
+	assertByteEquals(t, result, alicePub)
+	result, _ = x448(bobPriv, x448BasePoint)
+	assertByteEquals(t, result, bobPub)
+
+	secret, err := keyAgreement(X448, bobPub, alicePriv)
+	assertNotError(t, err, "X448 key agreement failed")
+	assertByteEquals(t, secret, shared)
+
+	secret, err = keyAgreement(X448, alicePub, bobPriv)
+	assertNotError(t, err, "X448 key agreement failed")
+	assertByteEquals(t, secret, shared)
+}
+
+func TestX448LowOrderPoint(t *testing.T) {
+	priv := unhex("9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf574a9419744897391006382a6f127ab1d9ac2d8c0a598726b")
+
+	// u = 0 and u = 1 are points of small order
+	zero := make([]byte, x448KeySize)
+	one := append([]byte{1}, make([]byte, x448KeySize-1)...)
+	for _, pub := range [][]byte{zero, one} {
+		_, err := keyAgreement(X448, pub, priv)
+		assertError(t, err, "X448 key agreement accepted a low-order point")
+	}
+}
+
+func TestX448LowOrderPointClient(t *testing.T) {
+	caps := Capabilities{
+		SupportedVersions: []uint16{supportedVersion},
+		Groups:            []NamedGroup{X448},
+		SignatureSchemes:  []SignatureScheme{RSA_PSS_SHA256},
+		CipherSuites:      []CipherSuite{TLS_AES_128_GCM_SHA256},
+		PSKs:              &PSKMapCache{},
+	}
+	opts := ConnectionOptions{ServerName: "example.com"}
+
+	clientState, _, alert := ClientStateStart{Caps: caps, Opts: opts}.Next(nil)
+	assertEquals(t, alert, AlertNoAlert)
+
+	// A server key share of small order is refused, rather than giving an
+	// all-zero shared secret
+	sh := &ServerHelloBody{
+		Version:     tls12Version,
+		CipherSuite: TLS_AES_128_GCM_SHA256,
+	}
+	sh.Extensions.Add(&SupportedVersionsExtension{
+		HandshakeType: HandshakeTypeServerHello,
+		Versions:      []uint16{supportedVersion},
+	})
+	sh.Extensions.Add(&KeyShareExtension{
+		HandshakeType: HandshakeTypeServerHello,
+		Shares:        []KeyShareEntry{{Group: X448, KeyExchange: make([]byte, x448KeySize)}},
+	})
+	hm, err := HandshakeMessageFromBody(sh)
+	assertNotError(t, err, "Failed to marshal ServerHello")
+	_, _, alert = clientState.Next(hm)
+	assertEquals(t, alert, AlertIllegalParameter)
+}